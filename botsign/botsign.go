@@ -0,0 +1,166 @@
+// Package botsign signs and verifies the HTTP requests exchanged with the Discord bot.
+// A request carries a timestamp, a nonce and an HMAC-SHA256 over its direction, method,
+// path, both headers and the body; stale requests are refused and nonces are remembered
+// behind NonceStore to refuse replays.
+package botsign
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"io"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	TimestampHeader = "X-Bot-Timestamp"
+	NonceHeader     = "X-Bot-Nonce"
+	SignatureHeader = "X-Bot-Signature"
+
+	// signatureVersion prefixes the hex signature so the scheme can change later.
+	// v2 added the direction, method and path to v1's timestamp, nonce and body.
+	signatureVersion = "v2="
+
+	// Directions, signed so a webhook this server sent can't be replayed back at it
+	directionToBot   = "server-to-bot"
+	directionFromBot = "bot-to-server"
+
+	// MaxSkew is how far a request's timestamp may be from this server's clock
+	MaxSkew = 5 * time.Minute
+
+	maxNonceLength = 64
+	maxBodyBytes   = 1 << 20
+)
+
+var (
+	ErrInvalidSignature = errors.New("invalid signature")
+	ErrStale            = errors.New("request timestamp outside the allowed window")
+	ErrReplayed         = errors.New("request nonce already used")
+)
+
+// NonceStore remembers nonces that were already accepted
+type NonceStore interface {
+	// Use records nonce until expiresAt. Returns false if it's already recorded.
+	Use(ctx context.Context, nonce string, expiresAt time.Time) (bool, error)
+}
+
+// Signer holds the shared secrets. The first secret signs; any of them verifies, so the
+// secret can be rotated by adding the new one in front while the bot still uses the old one.
+type Signer struct {
+	secrets [][]byte
+	nonces  NonceStore
+}
+
+// New returns a Signer for the non-empty secrets, current first, or nil if there are none
+func New(nonces NonceStore, secrets ...string) *Signer {
+	s := &Signer{nonces: nonces}
+	for _, secret := range secrets {
+		if secret != "" {
+			s.secrets = append(s.secrets, []byte(secret))
+		}
+	}
+	if len(s.secrets) == 0 {
+		return nil
+	}
+	return s
+}
+
+// Sign sets the signature headers on an outgoing request with the given body
+func (s *Signer) Sign(req *http.Request, body []byte) error {
+	raw := make([]byte, 16)
+	if _, err := rand.Read(raw); err != nil {
+		return err
+	}
+	nonce := hex.EncodeToString(raw)
+
+	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+	req.Header.Set(TimestampHeader, timestamp)
+	req.Header.Set(NonceHeader, nonce)
+	req.Header.Set(SignatureHeader, signatureVersion+s.signature(s.secrets[0], directionToBot, req.Method, req.URL.Path, timestamp, nonce, body))
+	return nil
+}
+
+// Verify checks an incoming request's signature, timestamp and nonce and returns its body
+func (s *Signer) Verify(r *http.Request) ([]byte, error) {
+	timestamp := r.Header.Get(TimestampHeader)
+	nonce := r.Header.Get(NonceHeader)
+	hexSignature, versioned := strings.CutPrefix(r.Header.Get(SignatureHeader), signatureVersion)
+	signature, err := hex.DecodeString(hexSignature)
+	if !versioned || err != nil || len(signature) == 0 || nonce == "" || len(nonce) > maxNonceLength {
+		return nil, ErrInvalidSignature
+	}
+
+	unix, err := strconv.ParseInt(timestamp, 10, 64)
+	if err != nil {
+		return nil, ErrInvalidSignature
+	}
+	sent := time.Unix(unix, 0)
+	if skew := time.Since(sent); skew > MaxSkew || skew < -MaxSkew {
+		return nil, ErrStale
+	}
+
+	body, err := io.ReadAll(io.LimitReader(r.Body, maxBodyBytes))
+	if err != nil {
+		return nil, err
+	}
+
+	valid := false
+	for _, secret := range s.secrets {
+		expected, _ := hex.DecodeString(s.signature(secret, directionFromBot, r.Method, r.URL.Path, timestamp, nonce, body))
+		if hmac.Equal(signature, expected) {
+			valid = true
+		}
+	}
+	if !valid {
+		return nil, ErrInvalidSignature
+	}
+
+	// Checked only once the signature is valid, so unsigned requests can't fill the store.
+	// A nonce has to be kept until its timestamp falls out of the window.
+	fresh, err := s.nonces.Use(r.Context(), nonce, sent.Add(MaxSkew))
+	if err != nil {
+		return nil, err
+	}
+	if !fresh {
+		return nil, ErrReplayed
+	}
+
+	return body, nil
+}
+
+// Require refuses requests that aren't signed with one of the secrets.
+// The handler behind it reads the body as usual.
+func (s *Signer) Require(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, err := s.Verify(r)
+		switch {
+		case errors.Is(err, ErrInvalidSignature), errors.Is(err, ErrStale), errors.Is(err, ErrReplayed):
+			slog.Warn("rejected bot request", "reason", err, "path", r.URL.Path)
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		case err != nil:
+			slog.Error("failed to verify bot request", "error", err)
+			http.Error(w, "Internal server error", http.StatusInternalServerError)
+			return
+		}
+
+		r.Body = io.NopCloser(bytes.NewReader(body))
+		next.ServeHTTP(w, r)
+	})
+}
+
+// signature is the hex HMAC-SHA256 of "direction\nMETHOD\n/path\ntimestamp\nnonce\nbody"
+func (s *Signer) signature(secret []byte, direction, method, path, timestamp, nonce string, body []byte) string {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(strings.Join([]string{direction, method, path, timestamp, nonce}, "\n") + "\n"))
+	mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}
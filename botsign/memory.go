@@ -0,0 +1,46 @@
+package botsign
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// MemoryStore keeps nonces in process memory (single instance only)
+type MemoryStore struct {
+	mu        sync.Mutex
+	nonces    map[string]time.Time
+	lastSweep time.Time
+}
+
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{nonces: map[string]time.Time{}, lastSweep: time.Now()}
+}
+
+func (s *MemoryStore) Use(ctx context.Context, nonce string, expiresAt time.Time) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now()
+	s.sweep(now)
+
+	if until, ok := s.nonces[nonce]; ok && until.After(now) {
+		return false, nil
+	}
+	s.nonces[nonce] = expiresAt
+	return true, nil
+}
+
+// sweep drops nonces whose requests would be refused as stale anyway
+func (s *MemoryStore) sweep(now time.Time) {
+	if now.Sub(s.lastSweep) < time.Minute {
+		return
+	}
+	s.lastSweep = now
+
+	for nonce, until := range s.nonces {
+		if !until.After(now) {
+			delete(s.nonces, nonce)
+		}
+	}
+}
@@ -0,0 +1,44 @@
+package botsign
+
+import (
+	"context"
+	"database/sql"
+	"time"
+)
+
+// PostgresStore keeps nonces in public.bot_request_nonces so replicas share them
+type PostgresStore struct {
+	db *sql.DB
+}
+
+func NewPostgresStore(db *sql.DB) *PostgresStore {
+	return &PostgresStore{db: db}
+}
+
+func (s *PostgresStore) Use(ctx context.Context, nonce string, expiresAt time.Time) (bool, error) {
+	// An expired row may be reused; its request would have been refused as stale
+	result, err := s.db.ExecContext(ctx, `
+		INSERT INTO public.bot_request_nonces (nonce, expires_at)
+		VALUES ($1, $2)
+		ON CONFLICT (nonce) DO UPDATE SET expires_at = EXCLUDED.expires_at
+		WHERE bot_request_nonces.expires_at <= NOW()
+	`, nonce, expiresAt)
+	if err != nil {
+		return false, err
+	}
+
+	n, err := result.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+	return n == 1, nil
+}
+
+// Purge removes nonces whose requests would be refused as stale anyway
+func (s *PostgresStore) Purge(ctx context.Context) (int64, error) {
+	result, err := s.db.ExecContext(ctx, `DELETE FROM public.bot_request_nonces WHERE expires_at <= NOW()`)
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected()
+}
@@ -1,34 +1,116 @@
 package config
 
 import (
+	"fmt"
 	"os"
+	"strings"
+	"time"
 
 	"github.com/joho/godotenv"
 )
 
 type Config struct {
-	JWTPrivateKey      string
-	DatabaseURL        string // PostgreSQL (auth)
-	GameAccountDBURL   string // MySQL (game accounts)
-	GameCharacterDBURL string // MySQL (game characters)
-	Port               string
-	AllowedOrigins     []string
-	BotSharedSecret    string
-	BotWebhookURL      string
+	JWTPrivateKey          string
+	JWTKeysDir             string        // Directory of PEM signing keys, newest signs
+	JWTKeyRotationInterval time.Duration // 0 disables scheduled rotation
+	DatabaseURL            string        // PostgreSQL (auth)
+	GameAccountDBURL       string        // MySQL (game accounts)
+	GameCharacterDBURL     string        // MySQL (game characters)
+	Port                   string
+	AllowedOrigins         []string
+	BotSharedSecret        string // Deprecated: X-Bot-Secret header, accepted until the bot signs requests
+	BotSigningSecret       string // HMAC key for requests to and from the Discord bot
+	BotSigningSecretOld    string // Previous key, still accepted from the bot while rotating
+	BotNonceStore          string // "postgres" (shared by replicas) or "memory" (single instance)
+	BotWebhookURL          string
+	GameServerSecret       string // Authenticates the game server when redeeming launcher tickets
+	LegacyGameCredentials  bool   // Serve the permanent game API key at GET /game/credentials, for launchers without tickets
+	MFAIssuer              string // Name shown in authenticator apps
+	MFASecretKey           string // Encrypts TOTP secrets at rest, required
+	MailDriver             string // "smtp" or "log", empty disables password reset and email verification
+	MailLogFile            string // log driver: file to append messages to, required
+	MailFrom               string
+	SMTPHost               string
+	SMTPPort               string
+	SMTPUsername           string
+	SMTPPassword           string
+	PasswordResetURL       string // Page the reset link points at, gets ?token=
+	EmailVerifyURL         string // Page the verification link points at, gets ?token=
+	EmailVerifySecret      string // HMAC key for verification links
+	RequireVerifiedEmail   bool   // Block purchases, vouchers and Discord linking until verified
+	GameBlockBanned        bool   // Mirror bans to tUser.bIsBlock in the game database
+	LockoutStore           string // "postgres" (shared by replicas) or "memory" (single instance)
+	RateLimitStore         string // "postgres" (shared by replicas) or "memory" (single instance)
+	RateLimits             string // Per-route overrides, e.g. "login=10/1m,voucher=5/10m"
+	OIDCIssuer             string // Public base URL of this server, empty disables the OpenID Connect provider
+	DeviceVerifyURL        string // Portal page where users approve device grants (the launcher)
 }
 
 func Load() (*Config, error) {
 	// Load .env file
 	godotenv.Load()
 
+	rotationInterval, err := getDuration("JWT_KEY_ROTATION_INTERVAL")
+	if err != nil {
+		return nil, err
+	}
+
 	return &Config{
-		JWTPrivateKey:      os.Getenv("JWT_PRIVATE_KEY"),
-		DatabaseURL:        os.Getenv("DATABASE_URL"),
-		GameAccountDBURL:   os.Getenv("GAME_ACCOUNT_DB_URL"),
-		GameCharacterDBURL: os.Getenv("GAME_CHARACTER_DB_URL"),
-		Port:               os.Getenv("PORT"),
-		AllowedOrigins:     []string{"*"},
-		BotSharedSecret:    os.Getenv("BOT_SHARED_SECRET"),
-		BotWebhookURL:      os.Getenv("BOT_WEBHOOK_URL"),
+		JWTPrivateKey:          os.Getenv("JWT_PRIVATE_KEY"),
+		JWTKeysDir:             os.Getenv("JWT_KEYS_DIR"),
+		JWTKeyRotationInterval: rotationInterval,
+		DatabaseURL:            os.Getenv("DATABASE_URL"),
+		GameAccountDBURL:       os.Getenv("GAME_ACCOUNT_DB_URL"),
+		GameCharacterDBURL:     os.Getenv("GAME_CHARACTER_DB_URL"),
+		Port:                   os.Getenv("PORT"),
+		AllowedOrigins:         []string{"*"},
+		BotSharedSecret:        os.Getenv("BOT_SHARED_SECRET"),
+		BotSigningSecret:       os.Getenv("BOT_SIGNING_SECRET"),
+		BotSigningSecretOld:    os.Getenv("BOT_SIGNING_SECRET_OLD"),
+		BotNonceStore:          getEnv("BOT_NONCE_STORE", "postgres"),
+		BotWebhookURL:          os.Getenv("BOT_WEBHOOK_URL"),
+		GameServerSecret:       os.Getenv("GAME_SERVER_SECRET"),
+		LegacyGameCredentials:  os.Getenv("LEGACY_GAME_CREDENTIALS") == "true",
+		MFAIssuer:              getEnv("MFA_ISSUER", "Authentication Server"),
+		MFASecretKey:           os.Getenv("MFA_SECRET_KEY"),
+		MailDriver:             os.Getenv("MAIL_DRIVER"),
+		MailLogFile:            os.Getenv("MAIL_LOG_FILE"),
+		MailFrom:               os.Getenv("MAIL_FROM"),
+		SMTPHost:               os.Getenv("SMTP_HOST"),
+		SMTPPort:               getEnv("SMTP_PORT", "587"),
+		SMTPUsername:           os.Getenv("SMTP_USERNAME"),
+		SMTPPassword:           os.Getenv("SMTP_PASSWORD"),
+		PasswordResetURL:       os.Getenv("PASSWORD_RESET_URL"),
+		EmailVerifyURL:         os.Getenv("EMAIL_VERIFY_URL"),
+		EmailVerifySecret:      os.Getenv("EMAIL_VERIFY_SECRET"),
+		RequireVerifiedEmail:   os.Getenv("REQUIRE_VERIFIED_EMAIL") == "true",
+		GameBlockBanned:        os.Getenv("GAME_BLOCK_BANNED") == "true",
+		LockoutStore:           getEnv("LOCKOUT_STORE", "postgres"),
+		RateLimitStore:         getEnv("RATE_LIMIT_STORE", "postgres"),
+		RateLimits:             os.Getenv("RATE_LIMITS"),
+		OIDCIssuer:             strings.TrimSuffix(os.Getenv("OIDC_ISSUER"), "/"),
+		DeviceVerifyURL:        os.Getenv("DEVICE_VERIFY_URL"),
 	}, nil
 }
+
+// getEnv returns the environment value or fallback when unset
+func getEnv(key, fallback string) string {
+	if value := os.Getenv(key); value != "" {
+		return value
+	}
+	return fallback
+}
+
+// getDuration parses a duration like "720h" from the environment, 0 when unset
+func getDuration(key string) (time.Duration, error) {
+	value := os.Getenv(key)
+	if value == "" {
+		return 0, nil
+	}
+
+	d, err := time.ParseDuration(value)
+	if err != nil {
+		return 0, fmt.Errorf("invalid %s: %w", key, err)
+	}
+	return d, nil
+}
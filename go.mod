@@ -4,6 +4,7 @@ go 1.25.3
 
 require (
 	github.com/ethan-mdev/central-auth v0.0.0-20251202000513-bf5180d47699
+	github.com/golang-jwt/jwt/v5 v5.3.0
 	github.com/joho/godotenv v1.5.1
 	github.com/lib/pq v1.10.9
 	github.com/microsoft/go-mssqldb v1.9.5
@@ -11,7 +12,6 @@ require (
 )
 
 require (
-	github.com/golang-jwt/jwt/v5 v5.3.0 // indirect
 	github.com/golang-sql/civil v0.0.0-20220223132316-b832511892a9 // indirect
 	github.com/golang-sql/sqlexp v0.1.0 // indirect
 	github.com/google/uuid v1.6.0 // indirect
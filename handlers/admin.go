@@ -1,29 +1,95 @@
 package handlers
 
 import (
+	"database/sql"
 	"encoding/json"
+	"errors"
+	"log/slog"
 	"net/http"
+	"strconv"
+	"strings"
 
+	"github.com/ethan-mdev/authentication-server/keyring"
 	"github.com/ethan-mdev/authentication-server/storage"
 )
 
 type AdminHandler struct {
-	Users *storage.ExtendedUserRepository
+	Users    *storage.ExtendedUserRepository
+	Sessions *storage.SessionRepository
+	Keys     *keyring.Ring
+	Audit    *storage.AuditRepository
+	GameDB   *sql.DB // set to mirror bans to tUser.bIsBlock
 }
 
-// ListUsers returns all users (admin only)
+// ListUsers returns a page of users, newest first by default (admin only).
+// Query: q (username, email or Discord ID), role, game_linked=true|false, banned=true|false,
+// sort=created_at|username|balance, order=asc|desc, limit, cursor (next_cursor of the previous page)
 // GET /admin/users
 func (h *AdminHandler) ListUsers() http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
-		// TODO: Implement pagination
-		users, err := h.Users.ListAll()
+		query := r.URL.Query()
+		filter := storage.UserFilter{
+			Search: strings.TrimSpace(query.Get("q")),
+			Role:   query.Get("role"),
+			Sort:   query.Get("sort"),
+			Cursor: query.Get("cursor"),
+			Limit:  storage.DefaultUserPageSize,
+		}
+
+		if filter.Sort != "" && !storage.ValidUserSort(filter.Sort) {
+			http.Error(w, "Invalid sort", http.StatusBadRequest)
+			return
+		}
+
+		switch query.Get("order") {
+		case "", "desc":
+		case "asc":
+			filter.Ascending = true
+		default:
+			http.Error(w, "Invalid order", http.StatusBadRequest)
+			return
+		}
+
+		if v := query.Get("game_linked"); v != "" {
+			linked, err := strconv.ParseBool(v)
+			if err != nil {
+				http.Error(w, "Invalid game_linked", http.StatusBadRequest)
+				return
+			}
+			filter.GameLinked = &linked
+		}
+
+		if v := query.Get("banned"); v != "" {
+			banned, err := strconv.ParseBool(v)
+			if err != nil {
+				http.Error(w, "Invalid banned", http.StatusBadRequest)
+				return
+			}
+			filter.Banned = &banned
+		}
+
+		if v := query.Get("limit"); v != "" {
+			limit, err := strconv.Atoi(v)
+			if err != nil || limit < 1 || limit > storage.MaxUserPageSize {
+				http.Error(w, "Invalid limit", http.StatusBadRequest)
+				return
+			}
+			filter.Limit = limit
+		}
+
+		page, err := h.Users.SearchUsers(filter)
+		if errors.Is(err, storage.ErrInvalidCursor) {
+			http.Error(w, "Invalid cursor", http.StatusBadRequest)
+			return
+		}
 		if err != nil {
+			slog.Error("failed to search users", "error", err)
 			http.Error(w, "Failed to fetch users", http.StatusInternalServerError)
 			return
 		}
 
 		w.Header().Set("Content-Type", "application/json")
-		json.NewEncoder(w).Encode(users)
+		json.NewEncoder(w).Encode(page)
 	}
 }
 
@@ -49,7 +115,12 @@ func (h *AdminHandler) UpdateUserRole() http.HandlerFunc {
 			return
 		}
 
-		if err := h.Users.UpdateRole(userId, req.Role); err != nil {
+		_, err := h.Users.UpdateRole(userId, req.Role, auditEvent(r, "user.role_change", "user", userId))
+		if err == sql.ErrNoRows {
+			http.Error(w, "User not found", http.StatusNotFound)
+			return
+		}
+		if err != nil {
 			http.Error(w, "Failed to update role", http.StatusInternalServerError)
 			return
 		}
@@ -60,3 +131,162 @@ func (h *AdminHandler) UpdateUserRole() http.HandlerFunc {
 		})
 	}
 }
+
+// ListOrders returns item mall orders, filterable by ?status=failed etc (admin only)
+// GET /admin/orders
+func (h *AdminHandler) ListOrders() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		orders, err := h.Users.ListOrders(r.URL.Query().Get("status"))
+		if err != nil {
+			http.Error(w, "Failed to fetch orders", http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(orders)
+	}
+}
+
+// ListVoucherRedemptions returns voucher redemptions, filterable by ?status=failed etc (admin only)
+// GET /admin/voucher-redemptions
+func (h *AdminHandler) ListVoucherRedemptions() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		redemptions, err := h.Users.ListVoucherRedemptions(r.URL.Query().Get("status"))
+		if err != nil {
+			http.Error(w, "Failed to fetch voucher redemptions", http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(redemptions)
+	}
+}
+
+// RefundOrder returns the reserved balance of a failed order (admin only).
+// Goods already delivered stay in the game account.
+// POST /admin/orders/{orderId}/refund
+func (h *AdminHandler) RefundOrder() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		claims, ok := keyring.Claims(r.Context())
+		if !ok {
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+
+		orderID, err := strconv.Atoi(r.PathValue("orderId"))
+		if err != nil {
+			http.Error(w, "Invalid order ID", http.StatusBadRequest)
+			return
+		}
+
+		var req struct {
+			Reason string `json:"reason"`
+		}
+
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "Invalid request body", http.StatusBadRequest)
+			return
+		}
+
+		if req.Reason == "" {
+			req.Reason = "refunded by admin"
+		}
+
+		newBalance, err := h.Users.RefundOrder(orderID, req.Reason, claims.UserID, auditEvent(r, "order.refund", "order", strconv.Itoa(orderID)))
+		if err == sql.ErrNoRows {
+			http.Error(w, "Order not found or not refundable", http.StatusConflict)
+			return
+		}
+		if err != nil {
+			slog.Error("failed to refund order", "error", err, "order_id", orderID)
+			http.Error(w, "Failed to refund order", http.StatusInternalServerError)
+			return
+		}
+
+		slog.Info("order refunded", "order_id", orderID)
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"message":     "Order refunded successfully",
+			"new_balance": newBalance,
+		})
+	}
+}
+
+// ListOutbox returns Discord bot notifications, optionally filtered by status,
+// e.g. ?status=dead for the deliveries that gave up (admin only)
+// GET /admin/outbox
+func (h *AdminHandler) ListOutbox() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		messages, err := h.Users.ListOutbox(r.URL.Query().Get("status"))
+		if err != nil {
+			slog.Error("failed to list outbox", "error", err)
+			http.Error(w, "Failed to fetch outbox", http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(messages)
+	}
+}
+
+// ReplayOutbox queues a dead-lettered notification for delivery again (admin only)
+// POST /admin/outbox/{id}/replay
+func (h *AdminHandler) ReplayOutbox() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		id, err := strconv.ParseInt(r.PathValue("id"), 10, 64)
+		if err != nil {
+			http.Error(w, "Invalid message ID", http.StatusBadRequest)
+			return
+		}
+
+		msg, err := h.Users.ReplayOutbox(id, auditEvent(r, "outbox.replay", "outbox", strconv.FormatInt(id, 10)))
+		if err == sql.ErrNoRows {
+			http.Error(w, "Message not found or not dead-lettered", http.StatusConflict)
+			return
+		}
+		if err != nil {
+			slog.Error("failed to replay outbox message", "error", err, "id", id)
+			http.Error(w, "Failed to replay message", http.StatusInternalServerError)
+			return
+		}
+
+		slog.Info("outbox message replayed", "id", id, "kind", msg.Kind)
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(msg)
+	}
+}
+
+// RotateSigningKey publishes a fresh key that starts signing after keyring.KeyActivationDelay;
+// older keys stay in the JWKS until their tokens expire
+// POST /admin/keys/rotate
+func (h *AdminHandler) RotateSigningKey() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		key, err := h.Keys.Rotate()
+		if errors.Is(err, keyring.ErrNoKeysDir) {
+			http.Error(w, "Key rotation needs JWT_KEYS_DIR", http.StatusConflict)
+			return
+		}
+		if err != nil {
+			slog.Error("failed to rotate signing key", "error", err)
+			http.Error(w, "Failed to rotate signing key", http.StatusInternalServerError)
+			return
+		}
+
+		audit(h.Audit, r, "signing_key.rotate", "signing_key", key.ID, nil, nil)
+
+		published := []string{}
+		for _, k := range h.Keys.Keys() {
+			published = append(published, k.ID)
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"message":        "Signing key rotated successfully",
+			"kid":            key.ID,
+			"active_at":      key.CreatedAt,
+			"published_kids": published,
+		})
+	}
+}
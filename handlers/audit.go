@@ -0,0 +1,159 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/ethan-mdev/authentication-server/keyring"
+	"github.com/ethan-mdev/authentication-server/storage"
+)
+
+const (
+	RequestIDHeader    = "X-Request-ID"
+	maxRequestIDLength = 64
+)
+
+type requestIDKey struct{}
+
+// RequestID tags every request with an ID, taken from X-Request-ID when a proxy set one,
+// and echoes it in the response so a support ticket can be matched to the audit log
+func RequestID(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id := r.Header.Get(RequestIDHeader)
+		if id == "" || len(id) > maxRequestIDLength {
+			var err error
+			if id, err = generateApiKey(16); err != nil {
+				id = strconv.FormatInt(time.Now().UnixNano(), 36)
+			}
+		}
+
+		w.Header().Set(RequestIDHeader, id)
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), requestIDKey{}, id)))
+	})
+}
+
+// requestID returns the ID RequestID gave the request
+func requestID(r *http.Request) string {
+	id, _ := r.Context().Value(requestIDKey{}).(string)
+	return id
+}
+
+// auditEvent describes an action taken by the request's caller on a target, for storage
+// methods that record it in the same transaction as the change
+func auditEvent(r *http.Request, action, targetType, targetID string) *storage.AuditEvent {
+	e := &storage.AuditEvent{
+		ActorType:  storage.AuditActorSystem,
+		Action:     action,
+		TargetType: targetType,
+		TargetID:   targetID,
+		IP:         clientIP(r),
+		RequestID:  requestID(r),
+	}
+	if claims, ok := keyring.Claims(r.Context()); ok {
+		e.ActorType, e.ActorID = storage.AuditActorUser, claims.UserID
+	} else if clientID, ok := keyring.ServiceClient(r.Context()); ok {
+		e.ActorType, e.ActorID = storage.AuditActorService, clientID
+	}
+	return e
+}
+
+// audit records an action by the request's caller that has no transaction of its own to
+// share, such as reading a secret. The error is logged and returned so reads can be refused.
+func audit(repo *storage.AuditRepository, r *http.Request, action, targetType, targetID string, before, after any) error {
+	e := auditEvent(r, action, targetType, targetID)
+	if err := repo.AppendAudit(e, before, after); err != nil {
+		slog.Error("failed to write audit event", "error", err, "action", action, "target_id", targetID, "actor_id", e.ActorID)
+		return err
+	}
+	return nil
+}
+
+// auditSystem records an action taken by a background job
+func auditSystem(repo *storage.AuditRepository, action, targetType, targetID string, before, after any) {
+	e := &storage.AuditEvent{
+		ActorType:  storage.AuditActorSystem,
+		Action:     action,
+		TargetType: targetType,
+		TargetID:   targetID,
+	}
+	if err := repo.AppendAudit(e, before, after); err != nil {
+		slog.Error("failed to write audit event", "error", err, "action", action, "target_id", targetID)
+	}
+}
+
+// ListAudit returns audit events, newest first (admin only).
+// Query: actor, action (exact, or a prefix like "discord."), target_type, target,
+// since and until (RFC 3339), limit, cursor (next_cursor of the previous page)
+// GET /admin/audit
+func (h *AdminHandler) ListAudit() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		query := r.URL.Query()
+		filter := storage.AuditFilter{
+			ActorID:    query.Get("actor"),
+			Action:     query.Get("action"),
+			TargetType: query.Get("target_type"),
+			TargetID:   query.Get("target"),
+			Cursor:     query.Get("cursor"),
+			Limit:      100,
+		}
+
+		for param, dst := range map[string]*time.Time{"since": &filter.Since, "until": &filter.Until} {
+			if v := query.Get(param); v != "" {
+				t, err := time.Parse(time.RFC3339, v)
+				if err != nil {
+					http.Error(w, "Invalid "+param, http.StatusBadRequest)
+					return
+				}
+				*dst = t
+			}
+		}
+
+		if v := query.Get("limit"); v != "" {
+			limit, err := strconv.Atoi(v)
+			if err != nil || limit < 1 || limit > 500 {
+				http.Error(w, "Invalid limit", http.StatusBadRequest)
+				return
+			}
+			filter.Limit = limit
+		}
+
+		page, err := h.Audit.ListAudit(filter)
+		if errors.Is(err, storage.ErrInvalidCursor) {
+			http.Error(w, "Invalid cursor", http.StatusBadRequest)
+			return
+		}
+		if err != nil {
+			slog.Error("failed to list audit events", "error", err)
+			http.Error(w, "Failed to fetch audit events", http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(page)
+	}
+}
+
+// VerifyAudit recomputes the audit log's hash chain and reports the first event that doesn't match (admin only)
+// GET /admin/audit/verify
+func (h *AdminHandler) VerifyAudit() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		report, err := h.Audit.VerifyAuditChain()
+		if err != nil {
+			slog.Error("failed to verify audit chain", "error", err)
+			http.Error(w, "Failed to verify audit log", http.StatusInternalServerError)
+			return
+		}
+
+		if !report.Valid {
+			slog.Error("security event: audit log hash chain broken", "event", "audit_chain_broken", "broken_at", report.BrokenAt)
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(report)
+	}
+}
@@ -0,0 +1,166 @@
+package handlers
+
+import (
+	"crypto/x509"
+	"database/sql"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"log/slog"
+	"net/http"
+	"strings"
+	"time"
+
+	gojwt "github.com/golang-jwt/jwt/v5"
+
+	"github.com/ethan-mdev/authentication-server/keyring"
+	"github.com/ethan-mdev/authentication-server/storage"
+)
+
+const (
+	clientAssertionType = "urn:ietf:params:oauth:client-assertion-type:jwt-bearer"
+	serviceTokenTTL     = 10 * time.Minute
+
+	// maxAssertionLifetime bounds how long a client assertion may be valid for,
+	// which also bounds how long its jti has to be remembered
+	maxAssertionLifetime = 5 * time.Minute
+
+	// BotVerifyScope lets the Discord bot create verification tokens
+	BotVerifyScope = "bot:verify"
+	// GameDeliverScope lets the game servers deliver purchases
+	GameDeliverScope = "game:deliver"
+)
+
+// serviceScopes can be registered on a client and granted through client credentials
+var serviceScopes = map[string]bool{BotVerifyScope: true, GameDeliverScope: true}
+
+// clientCredentials issues a short-lived token to the client itself (RFC 6749 section 4.4),
+// for services like the Discord bot. There is no refresh token; the client asks again.
+func (h *OIDCHandler) clientCredentials(w http.ResponseWriter, r *http.Request, client *storage.OAuthClient) {
+	if client.Public || len(client.Scopes) == 0 {
+		writeOAuthError(w, http.StatusBadRequest, "unauthorized_client", "The client is not registered for client credentials")
+		return
+	}
+
+	scopes := strings.Fields(r.PostForm.Get("scope"))
+	if len(scopes) == 0 {
+		scopes = client.Scopes
+	}
+	if !client.AllowsScopes(scopes) {
+		writeOAuthError(w, http.StatusBadRequest, "invalid_scope", "The client is not registered for the requested scope")
+		return
+	}
+	scope := strings.Join(scopes, " ")
+
+	jti, err := generateApiKey(32)
+	if err != nil {
+		writeOAuthError(w, http.StatusInternalServerError, "server_error", "")
+		return
+	}
+
+	now := time.Now()
+	accessToken, err := h.Keys.Sign(map[string]interface{}{
+		"iss":       h.Issuer,
+		"sub":       client.ID,
+		"client_id": client.ID,
+		"scope":     scope,
+		"token_use": keyring.ServiceTokenUse,
+		"jti":       jti,
+		"iat":       now.Unix(),
+		"exp":       now.Add(serviceTokenTTL).Unix(),
+	})
+	if err != nil {
+		slog.Error("failed to sign service token", "error", err, "client_id", client.ID)
+		writeOAuthError(w, http.StatusInternalServerError, "server_error", "")
+		return
+	}
+
+	slog.Info("service token issued", "client_id", client.ID, "scope", scope)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"access_token": accessToken,
+		"token_type":   "Bearer",
+		"expires_in":   int(serviceTokenTTL.Seconds()),
+		"scope":        scope,
+	})
+}
+
+// authenticateAssertion identifies a client by a JWT signed with its registered key
+// (private_key_jwt, RFC 7523). Each assertion can only be used once.
+func (h *OIDCHandler) authenticateAssertion(w http.ResponseWriter, r *http.Request) (*storage.OAuthClient, bool) {
+	assertion := r.PostForm.Get("client_assertion")
+
+	unauthorized := func(reason string) (*storage.OAuthClient, bool) {
+		slog.Warn("client assertion rejected", "reason", reason, "ip", clientIP(r))
+		writeOAuthError(w, http.StatusUnauthorized, "invalid_client", "Client authentication failed")
+		return nil, false
+	}
+
+	unverified, _, err := gojwt.NewParser().ParseUnverified(assertion, gojwt.MapClaims{})
+	if err != nil {
+		return unauthorized("malformed assertion")
+	}
+	clientID, _ := unverified.Claims.GetIssuer()
+	if formID := r.PostForm.Get("client_id"); formID != "" && formID != clientID {
+		return unauthorized("client_id does not match the assertion")
+	}
+
+	client, err := h.Clients.GetClient(clientID)
+	if err == sql.ErrNoRows {
+		return unauthorized("unknown client")
+	}
+	if err != nil {
+		slog.Error("failed to load oauth client", "error", err, "client_id", clientID)
+		writeOAuthError(w, http.StatusInternalServerError, "server_error", "")
+		return nil, false
+	}
+	if client.JWTPublicKey == "" {
+		return unauthorized("client has no registered key")
+	}
+
+	claims := gojwt.MapClaims{}
+	_, err = gojwt.ParseWithClaims(assertion, claims, func(*gojwt.Token) (interface{}, error) {
+		return parsePublicKey(client.JWTPublicKey)
+	},
+		gojwt.WithValidMethods([]string{"RS256", "ES256"}),
+		gojwt.WithExpirationRequired(),
+		gojwt.WithIssuer(client.ID),
+		gojwt.WithSubject(client.ID),
+		gojwt.WithAudience(h.Issuer, h.Issuer+"/oauth/token"),
+	)
+	if err != nil {
+		return unauthorized(err.Error())
+	}
+
+	exp, _ := claims.GetExpirationTime()
+	if time.Until(exp.Time) > maxAssertionLifetime {
+		return unauthorized("assertion is valid for too long")
+	}
+
+	jti, _ := claims["jti"].(string)
+	if jti == "" {
+		return unauthorized("assertion has no jti")
+	}
+
+	err = h.Clients.UseClientAssertion(client.ID, jti, exp.Time)
+	if err == sql.ErrNoRows {
+		return unauthorized("assertion was already used")
+	}
+	if err != nil {
+		slog.Error("failed to record client assertion", "error", err, "client_id", client.ID)
+		writeOAuthError(w, http.StatusInternalServerError, "server_error", "")
+		return nil, false
+	}
+
+	return client, true
+}
+
+// parsePublicKey reads a PEM encoded RSA or ECDSA public key
+func parsePublicKey(data string) (interface{}, error) {
+	block, _ := pem.Decode([]byte(data))
+	if block == nil {
+		return nil, errors.New("no PEM block found")
+	}
+	return x509.ParsePKIXPublicKey(block.Bytes)
+}
@@ -0,0 +1,280 @@
+package handlers
+
+import (
+	"crypto/rand"
+	"database/sql"
+	"encoding/json"
+	"log/slog"
+	"math/big"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/ethan-mdev/authentication-server/storage"
+	"github.com/ethan-mdev/central-auth/middleware"
+)
+
+const (
+	deviceGrantType    = "urn:ietf:params:oauth:grant-type:device_code"
+	deviceCodeTTL      = 10 * time.Minute
+	devicePollInterval = 5 // seconds
+	deviceSessionTTL   = 30 * 24 * time.Hour
+	userCodeAttempts   = 5
+
+	// GameScope limits a device grant token to the /game/* routes
+	GameScope = "game"
+)
+
+// Consonants only, so a user code can't spell anything and is easy to type (RFC 8628 section 6.1)
+const userCodeAlphabet = "BCDFGHJKLMNPQRSTVWXZ"
+
+// DeviceAuthorization starts the device flow for a client without a browser, like the game launcher
+// POST /oauth/device_authorization
+func (h *OIDCHandler) DeviceAuthorization() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Cache-Control", "no-store")
+
+		if err := r.ParseForm(); err != nil {
+			writeOAuthError(w, http.StatusBadRequest, "invalid_request", "Invalid form body")
+			return
+		}
+
+		client, ok := h.authenticateClient(w, r)
+		if !ok {
+			return
+		}
+
+		scope := r.PostForm.Get("scope")
+		if scope == "" {
+			scope = GameScope
+		}
+		if scope != GameScope {
+			writeOAuthError(w, http.StatusBadRequest, "invalid_scope", "Only the game scope can be requested")
+			return
+		}
+
+		deviceCode, err := generateApiKey(64)
+		if err != nil {
+			writeOAuthError(w, http.StatusInternalServerError, "server_error", "")
+			return
+		}
+
+		// User codes are short enough to collide now and then; draw another one
+		var userCode string
+		for range userCodeAttempts {
+			userCode, err = generateUserCode()
+			if err != nil {
+				writeOAuthError(w, http.StatusInternalServerError, "server_error", "")
+				return
+			}
+
+			err = h.Clients.CreateDeviceCode(storage.HashToken(deviceCode), userCode, client.ID, scope, devicePollInterval, time.Now().Add(deviceCodeTTL))
+			if err != storage.ErrUserCodeTaken {
+				break
+			}
+		}
+		if err != nil {
+			slog.Error("failed to store device code", "error", err, "client_id", client.ID)
+			writeOAuthError(w, http.StatusInternalServerError, "server_error", "")
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"device_code":               deviceCode,
+			"user_code":                 userCode,
+			"verification_uri":          h.DeviceVerifyURL,
+			"verification_uri_complete": h.DeviceVerifyURL + "?user_code=" + url.QueryEscape(userCode),
+			"expires_in":                int(deviceCodeTTL.Seconds()),
+			"interval":                  devicePollInterval,
+		})
+	}
+}
+
+// GetDeviceRequest shows the signed-in user which app a code they typed belongs to
+// GET /oauth/device/{userCode} (requires auth)
+func (h *OIDCHandler) GetDeviceRequest() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		device, err := h.Clients.GetPendingDeviceCode(normalizeUserCode(r.PathValue("userCode")))
+		if err == sql.ErrNoRows {
+			http.Error(w, "Invalid or expired code", http.StatusNotFound)
+			return
+		}
+		if err != nil {
+			slog.Error("failed to look up device code", "error", err)
+			http.Error(w, "Internal server error", http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(device)
+	}
+}
+
+// ApproveDevice lets the polling device sign in as the current user
+// POST /oauth/device/{userCode}/approve (requires auth)
+func (h *OIDCHandler) ApproveDevice() http.HandlerFunc {
+	return h.decideDevice(true)
+}
+
+// DenyDevice refuses a device request
+// POST /oauth/device/{userCode}/deny (requires auth)
+func (h *OIDCHandler) DenyDevice() http.HandlerFunc {
+	return h.decideDevice(false)
+}
+
+func (h *OIDCHandler) decideDevice(approve bool) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		claims, ok := middleware.GetClaims(r.Context())
+		if !ok {
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+
+		userCode := normalizeUserCode(r.PathValue("userCode"))
+		err := h.Clients.DecideDeviceCode(userCode, claims.UserID, approve)
+		if err == sql.ErrNoRows {
+			http.Error(w, "Invalid or expired code", http.StatusNotFound)
+			return
+		}
+		if err != nil {
+			slog.Error("failed to decide device code", "error", err, "user_id", claims.UserID)
+			http.Error(w, "Internal server error", http.StatusInternalServerError)
+			return
+		}
+
+		slog.Info("device authorization decided", "user_id", claims.UserID, "approved", approve, "ip", clientIP(r))
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+// exchangeDeviceCode answers a device's poll, issuing scoped tokens once the user approved
+func (h *OIDCHandler) exchangeDeviceCode(w http.ResponseWriter, r *http.Request, client *storage.OAuthClient) {
+	device, err := h.Clients.PollDeviceCode(storage.HashToken(r.PostForm.Get("device_code")), client.ID)
+	switch {
+	case err == sql.ErrNoRows:
+		writeOAuthError(w, http.StatusBadRequest, "invalid_grant", "Invalid device code")
+		return
+	case err == storage.ErrDeviceCodeExpired:
+		writeOAuthError(w, http.StatusBadRequest, "expired_token", "The device code expired, start again")
+		return
+	case err != nil:
+		slog.Error("failed to poll device code", "error", err, "client_id", client.ID)
+		writeOAuthError(w, http.StatusInternalServerError, "server_error", "")
+		return
+	}
+
+	switch {
+	case device.SlowDown:
+		writeOAuthError(w, http.StatusBadRequest, "slow_down", "")
+		return
+	case device.Status == storage.DeviceCodePending:
+		writeOAuthError(w, http.StatusBadRequest, "authorization_pending", "")
+		return
+	case device.Status == storage.DeviceCodeDenied:
+		writeOAuthError(w, http.StatusBadRequest, "access_denied", "The user denied the request")
+		return
+	}
+
+	// Approved before the user was banned
+	if _, err := h.Users.ActiveBan(device.UserID); err != sql.ErrNoRows {
+		if err != nil {
+			slog.Error("failed to check ban", "error", err, "user_id", device.UserID)
+			writeOAuthError(w, http.StatusInternalServerError, "server_error", "")
+			return
+		}
+		writeOAuthError(w, http.StatusBadRequest, "access_denied", "The account is banned")
+		return
+	}
+
+	refreshToken, err := generateApiKey(64)
+	if err != nil {
+		writeOAuthError(w, http.StatusInternalServerError, "server_error", "")
+		return
+	}
+
+	err = h.Clients.CreateDeviceSession(device.UserID, client.ID, device.Scope, storage.HashToken(refreshToken), time.Now().Add(deviceSessionTTL))
+	if err != nil {
+		slog.Error("failed to store device session", "error", err, "user_id", device.UserID)
+		writeOAuthError(w, http.StatusInternalServerError, "server_error", "")
+		return
+	}
+
+	slog.Info("device authorized", "client_id", client.ID, "user_id", device.UserID, "scope", device.Scope)
+	h.writeScopedTokens(w, device.UserID, client.ID, device.Scope, refreshToken, "")
+}
+
+// refreshDeviceSession rotates a device refresh token. ok is false when the token isn't
+// a device token, so the caller can try it as a session refresh token instead.
+func (h *OIDCHandler) refreshDeviceSession(w http.ResponseWriter, client *storage.OAuthClient, refreshToken string) (ok bool) {
+	newRefreshToken, err := generateApiKey(64)
+	if err != nil {
+		writeOAuthError(w, http.StatusInternalServerError, "server_error", "")
+		return true
+	}
+
+	session, err := h.Clients.RotateDeviceSession(storage.HashToken(refreshToken), storage.HashToken(newRefreshToken), client.ID)
+	if err == sql.ErrNoRows {
+		return false
+	}
+	if err != nil {
+		slog.Error("failed to rotate device session", "error", err)
+		writeOAuthError(w, http.StatusInternalServerError, "server_error", "")
+		return true
+	}
+
+	h.writeScopedTokens(w, session.UserID, session.ClientID, session.Scope, newRefreshToken, "")
+	return true
+}
+
+// writeScopedTokens signs an access token limited to scope. Only routes behind
+// keyring ScopedAuth accept it.
+func (h *OIDCHandler) writeScopedTokens(w http.ResponseWriter, userID, clientID, scope, refreshToken, idToken string) {
+	jti, err := generateApiKey(32)
+	if err != nil {
+		writeOAuthError(w, http.StatusInternalServerError, "server_error", "")
+		return
+	}
+
+	now := time.Now()
+	accessToken, err := h.Keys.Sign(map[string]interface{}{
+		"iss":       h.Issuer,
+		"sub":       userID,
+		"client_id": clientID,
+		"scope":     scope,
+		"jti":       jti,
+		"iat":       now.Unix(),
+		"exp":       now.Add(h.AccessExpiry).Unix(),
+	})
+	if err != nil {
+		slog.Error("failed to sign scoped access token", "error", err, "user_id", userID)
+		writeOAuthError(w, http.StatusInternalServerError, "server_error", "")
+		return
+	}
+
+	h.writeTokens(w, tokenResponse{AccessToken: accessToken, RefreshToken: refreshToken}, idToken, scope)
+}
+
+// generateUserCode returns a code like "BCDF-GHJK" for the user to type in
+func generateUserCode() (string, error) {
+	code := make([]byte, 8)
+	for i := range code {
+		n, err := rand.Int(rand.Reader, big.NewInt(int64(len(userCodeAlphabet))))
+		if err != nil {
+			return "", err
+		}
+		code[i] = userCodeAlphabet[n.Int64()]
+	}
+	return string(code[:4]) + "-" + string(code[4:]), nil
+}
+
+// normalizeUserCode accepts a typed code in any case, with or without the dash
+func normalizeUserCode(code string) string {
+	code = strings.ToUpper(code)
+	code = strings.NewReplacer("-", "", " ", "").Replace(code)
+	if len(code) != 8 {
+		return code
+	}
+	return code[:4] + "-" + code[4:]
+}
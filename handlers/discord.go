@@ -2,15 +2,21 @@ package handlers
 
 import (
 	"bytes"
+	"context"
 	"crypto/md5"
 	"crypto/rand"
+	"crypto/subtle"
 	"database/sql"
 	"encoding/hex"
 	"encoding/json"
+	"errors"
+	"fmt"
 	"log/slog"
 	"net/http"
 	"time"
 
+	"github.com/ethan-mdev/authentication-server/botsign"
+	"github.com/ethan-mdev/authentication-server/keyring"
 	"github.com/ethan-mdev/authentication-server/storage"
 	"github.com/ethan-mdev/central-auth/middleware"
 )
@@ -18,19 +24,64 @@ import (
 type DiscordHandler struct {
 	userRepo        *storage.ExtendedUserRepository
 	accountDB       *sql.DB
-	botSharedSecret string
+	keys            *keyring.Ring
+	signer          *botsign.Signer // nil when no signing secret is configured
+	botSharedSecret string          // deprecated, empty once the bot uses client credentials
 	botWebhookURL   string
+	audit           *storage.AuditRepository
 }
 
-func NewDiscordHandler(userRepo *storage.ExtendedUserRepository, accountDB *sql.DB, botSharedSecret, botWebhookURL string) *DiscordHandler {
+func NewDiscordHandler(userRepo *storage.ExtendedUserRepository, accountDB *sql.DB, keys *keyring.Ring, signer *botsign.Signer, botSharedSecret, botWebhookURL string, audit *storage.AuditRepository) *DiscordHandler {
 	return &DiscordHandler{
 		userRepo:        userRepo,
 		accountDB:       accountDB,
+		keys:            keys,
+		signer:          signer,
 		botSharedSecret: botSharedSecret,
 		botWebhookURL:   botWebhookURL,
+		audit:           audit,
 	}
 }
 
+// BotAuth lets through service tokens granted scope through client credentials. When a
+// signing secret is configured, every bot request must also carry a valid signature.
+// While BOT_SHARED_SECRET is still configured, a signed request without a token is
+// accepted too, and so is the legacy X-Bot-Secret header from a bot that doesn't sign yet,
+// so the bot can be moved over to client credentials without downtime.
+func (h *DiscordHandler) BotAuth(scope string, next http.Handler) http.Handler {
+	auth := h.keys.ServiceAuth(scope, next)
+	if h.signer != nil {
+		serviceAuth := auth
+		auth = h.signer.Require(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.Header.Get("Authorization") == "" && h.botSharedSecret != "" {
+				slog.Warn("bot authenticated by signature alone, switch it to client credentials", "path", r.URL.Path)
+				next.ServeHTTP(w, r)
+				return
+			}
+			serviceAuth.ServeHTTP(w, r)
+		}))
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		botSecret := r.Header.Get("X-Bot-Secret")
+		if botSecret == "" {
+			auth.ServeHTTP(w, r)
+			return
+		}
+
+		if h.botSharedSecret == "" || subtle.ConstantTimeCompare([]byte(botSecret), []byte(h.botSharedSecret)) != 1 {
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+
+		slog.Warn("bot authenticated with the deprecated shared secret, switch it to client credentials", "path", r.URL.Path)
+		next.ServeHTTP(w, r)
+	})
+}
+
+// A provision still open after this is assumed abandoned; a verification request takes seconds
+const provisionGracePeriod = 15 * time.Minute
+
 type CreateVerificationRequest struct {
 	Token            string `json:"token"`
 	DiscordID        string `json:"discord_id"`
@@ -38,15 +89,8 @@ type CreateVerificationRequest struct {
 	ExpiresInMinutes int    `json:"expires_in_minutes"`
 }
 
-// CreateVerificationToken - called by Discord bot to create verification tokens
+// CreateVerificationToken - called by Discord bot to create verification tokens (behind BotAuth)
 func (h *DiscordHandler) CreateVerificationToken(w http.ResponseWriter, r *http.Request) {
-	// Verify request is from bot
-	botSecret := r.Header.Get("X-Bot-Secret")
-	if botSecret != h.botSharedSecret {
-		http.Error(w, "Unauthorized", http.StatusUnauthorized)
-		return
-	}
-
 	var req CreateVerificationRequest
 	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
 		http.Error(w, "Invalid request body", http.StatusBadRequest)
@@ -77,6 +121,9 @@ func (h *DiscordHandler) CreateVerificationToken(w http.ResponseWriter, r *http.
 	json.NewEncoder(w).Encode(map[string]bool{"success": true})
 }
 
+// CompleteDiscordVerification links the Discord account of a token issued by the bot. The first
+// link creates the game account; after that, verifying again switches Discord accounts.
+// POST /discord/verify?token= (requires auth)
 func (h *DiscordHandler) CompleteDiscordVerification(w http.ResponseWriter, r *http.Request) {
 	token := r.URL.Query().Get("token")
 	if token == "" {
@@ -90,45 +137,34 @@ func (h *DiscordHandler) CompleteDiscordVerification(w http.ResponseWriter, r *h
 		return
 	}
 
-	verification, err := h.userRepo.GetDiscordVerification(token)
+	linked, err := h.userRepo.IsGameLinked(claims.UserID)
 	if err != nil {
-		if err == sql.ErrNoRows {
-			http.Error(w, "Invalid token", http.StatusBadRequest)
-			return
-		}
-		slog.Error("Failed to query discord verification", "error", err)
 		http.Error(w, "Internal server error", http.StatusInternalServerError)
 		return
 	}
 
-	if verification.Used {
-		http.Error(w, "Token already used", http.StatusBadRequest)
+	// Claim the token first, so concurrent requests with it can't both get this far
+	verification, err := h.userRepo.ClaimDiscordVerification(token, claims.UserID)
+	if err == sql.ErrNoRows {
+		h.rejectVerificationToken(w, token)
 		return
 	}
-
-	expiresAt, err := time.Parse(time.RFC3339, verification.ExpiresAt)
 	if err != nil {
-		// Try alternate format for PostgreSQL timestamp
-		expiresAt, err = time.Parse("2006-01-02 15:04:05.999999-07", verification.ExpiresAt)
-		if err != nil {
-			slog.Error("Failed to parse expiry time", "error", err, "value", verification.ExpiresAt)
-			http.Error(w, "Internal server error", http.StatusInternalServerError)
-			return
-		}
-	}
-
-	if time.Now().After(expiresAt) {
-		http.Error(w, "Token expired", http.StatusBadRequest)
+		slog.Error("Failed to claim discord verification", "error", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
 		return
 	}
 
-	linked, err := h.userRepo.IsGameLinked(claims.UserID)
-	if err != nil {
-		http.Error(w, "Internal server error", http.StatusInternalServerError)
-		return
+	// From here on, every failure hands the token back so the user can try again
+	release := func() {
+		if err := h.userRepo.ReleaseDiscordVerification(token, claims.UserID); err != nil {
+			slog.Error("failed to release discord verification", "error", err, "user_id", claims.UserID)
+		}
 	}
+
+	// Users who already have a game account are switching Discord accounts
 	if linked {
-		http.Error(w, "Game account already linked", http.StatusBadRequest)
+		h.relinkDiscord(w, r, claims.UserID, verification, release)
 		return
 	}
 
@@ -137,40 +173,60 @@ func (h *DiscordHandler) CompleteDiscordVerification(w http.ResponseWriter, r *h
 	// Generate API key
 	apiKey, err := generateApiKey(16)
 	if err != nil {
+		release()
 		http.Error(w, "Failed to generate API key", http.StatusInternalServerError)
 		return
 	}
 
 	md5Hash := md5Hash(apiKey)
 
+	provisionID, err := h.userRepo.StartGameAccountProvision(claims.UserID, username)
+	if err != nil {
+		slog.Error("failed to start game account provision", "error", err, "user_id", claims.UserID)
+		release()
+		http.Error(w, "Failed to create game account", http.StatusInternalServerError)
+		return
+	}
+
 	// Create game account
 	var gameAccountID int
 	err = h.accountDB.QueryRow(createAccountSQL, username, md5Hash).Scan(&gameAccountID)
 	if err != nil {
 		slog.Error("failed to create game account", "error", err)
-		http.Error(w, "Failed to create game account: "+err.Error(), http.StatusInternalServerError)
+		// The insert may still have happened (e.g. lost connection); the reconciler checks
+		h.userRepo.FailGameAccountProvision(provisionID, err.Error())
+		release()
+		http.Error(w, "Failed to create game account", http.StatusInternalServerError)
 		return
 	}
 
-	// Link everything in PostgreSQL (including Discord info)
-	err = h.userRepo.LinkDiscordAndGameAccount(claims.UserID, gameAccountID, apiKey, verification.DiscordID, verification.DiscordUsername)
-	if err != nil {
-		slog.Error("failed to link accounts", "error", err)
-		http.Error(w, "Failed to link accounts", http.StatusInternalServerError)
-		return
+	if err := h.userRepo.RecordGameAccountCreated(provisionID, gameAccountID); err != nil {
+		slog.Error("failed to record game account", "error", err, "provision_id", provisionID)
 	}
 
-	// Mark token as used
-	err = h.userRepo.MarkDiscordVerificationUsed(token, claims.UserID)
+	// Link everything in PostgreSQL (including Discord info)
+	err = h.userRepo.LinkDiscordAndGameAccount(claims.UserID, gameAccountID, apiKey, verification.DiscordID, verification.DiscordUsername, provisionID,
+		auditEvent(r, "discord.link", "user", claims.UserID))
 	if err != nil {
-		slog.Error("failed to mark token as used", "error", err)
+		slog.Error("failed to link accounts", "error", err, "user_id", claims.UserID, "game_account_id", gameAccountID)
+		h.removeGameAccount(provisionID, gameAccountID, username, "link failed: "+err.Error())
+
+		switch err {
+		case storage.ErrGameAlreadyLinked:
+			http.Error(w, "Game account already linked", http.StatusBadRequest)
+		case storage.ErrDiscordLinkedElsewhere:
+			release()
+			http.Error(w, "Discord account is linked to another user", http.StatusConflict)
+		default:
+			release()
+			http.Error(w, "Failed to link accounts", http.StatusInternalServerError)
+		}
+		return
 	}
 
 	slog.Info("discord verification complete", "user_id", claims.UserID, "discord_id", verification.DiscordID, "game_account_id", gameAccountID)
 
-	// Notify Discord bot (non-blocking)
-	go h.notifyDiscordBot(verification.DiscordID, username, gameAccountID)
-
+	// The bot is notified through the outbox, queued together with the link
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(map[string]interface{}{
 		"success":         true,
@@ -180,44 +236,180 @@ func (h *DiscordHandler) CompleteDiscordVerification(w http.ResponseWriter, r *h
 	})
 }
 
-func (h *DiscordHandler) notifyDiscordBot(discordID, username string, gameAccountID int) error {
-	if h.botWebhookURL == "" {
-		slog.Warn("bot webhook URL not configured, skipping notification")
-		return nil
+// relinkDiscord moves a user's existing game account over to the Discord account of a
+// verification token. No game account is created.
+func (h *DiscordHandler) relinkDiscord(w http.ResponseWriter, r *http.Request, userID string, verification *storage.DiscordVerification, release func()) {
+	_, err := h.userRepo.RelinkDiscord(userID, verification.DiscordID, verification.DiscordUsername, auditEvent(r, "discord.relink", "user", userID))
+	if err == storage.ErrDiscordLinkedElsewhere {
+		release()
+		http.Error(w, "Discord account is linked to another user", http.StatusConflict)
+		return
+	}
+	if err != nil {
+		slog.Error("failed to relink discord", "error", err, "user_id", userID)
+		release()
+		http.Error(w, "Failed to link accounts", http.StatusInternalServerError)
+		return
 	}
 
-	payload := map[string]interface{}{
-		"discord_id":      discordID,
-		"username":        username,
-		"game_account_id": gameAccountID,
-		"timestamp":       time.Now().Unix(),
+	slog.Info("discord relinked", "user_id", userID, "discord_id", verification.DiscordID)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"success":        true,
+		"message":        "Discord account linked",
+		"discord_linked": true,
+	})
+}
+
+// UnlinkDiscord removes the user's Discord account; the game account stays linked.
+// The bot is told to remove the old Discord user's roles.
+// DELETE /discord/link (requires auth)
+func (h *DiscordHandler) UnlinkDiscord(w http.ResponseWriter, r *http.Request) {
+	claims, ok := keyring.Claims(r.Context())
+	if !ok {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
 	}
 
-	jsonData, _ := json.Marshal(payload)
+	discordID, err := h.userRepo.UnlinkDiscord(claims.UserID, auditEvent(r, "discord.unlink", "user", claims.UserID))
+	if err == storage.ErrDiscordNotLinked {
+		http.Error(w, "No Discord account linked", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		slog.Error("failed to unlink discord", "error", err, "user_id", claims.UserID)
+		http.Error(w, "Failed to unlink Discord account", http.StatusInternalServerError)
+		return
+	}
 
-	req, err := http.NewRequest("POST", h.botWebhookURL, bytes.NewBuffer(jsonData))
+	slog.Info("discord unlinked", "user_id", claims.UserID, "discord_id", discordID)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"success":        true,
+		"message":        "Discord account unlinked",
+		"discord_linked": false,
+	})
+}
+
+// rejectVerificationToken explains why a token couldn't be claimed
+func (h *DiscordHandler) rejectVerificationToken(w http.ResponseWriter, token string) {
+	verification, err := h.userRepo.GetDiscordVerification(token)
+	switch {
+	case err == sql.ErrNoRows:
+		http.Error(w, "Invalid token", http.StatusBadRequest)
+	case err != nil:
+		slog.Error("Failed to query discord verification", "error", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+	case verification.Used:
+		http.Error(w, "Token already used", http.StatusBadRequest)
+	default:
+		http.Error(w, "Token expired", http.StatusBadRequest)
+	}
+}
+
+// removeGameAccount is the compensation for a game account that was created but never linked.
+// If the delete fails, the provision stays open and the reconciler tries again later.
+func (h *DiscordHandler) removeGameAccount(provisionID int64, gameAccountID int, username, reason string) {
+	if _, err := h.accountDB.Exec(deleteAccountSQL, gameAccountID, username); err != nil {
+		slog.Error("failed to remove unlinked game account", "error", err, "game_account_id", gameAccountID)
+		h.userRepo.FailGameAccountProvision(provisionID, reason+"; remove failed: "+err.Error())
+		return
+	}
+
+	if err := h.userRepo.CompensateGameAccountProvision(provisionID, reason); err != nil {
+		slog.Error("failed to close game account provision", "error", err, "provision_id", provisionID)
+	}
+	slog.Warn("removed unlinked game account", "game_account_id", gameAccountID, "provision_id", provisionID, "reason", reason)
+}
+
+// ReconcileGameAccounts settles provisions left open by requests that failed part way or a
+// server stopped mid-request: a tUser row that no user is linked to is removed.
+func (h *DiscordHandler) ReconcileGameAccounts() error {
+	provisions, err := h.userRepo.ListStaleGameAccountProvisions(provisionGracePeriod)
+	if err != nil {
+		return err
+	}
+
+	for _, p := range provisions {
+		gameAccountID := p.GameAccountID
+		if gameAccountID == 0 {
+			// The insert may have happened without being recorded; find it by name. Only rows
+			// created since the provision started count (measured on the game server's clock,
+			// with a minute to spare), so an older account sharing the name is never touched.
+			age := int(time.Since(p.CreatedAt).Seconds()) + 60
+			err := h.accountDB.QueryRow(findAccountSQL, p.GameUsername, age).Scan(&gameAccountID)
+			if err == sql.ErrNoRows {
+				if err := h.userRepo.CompensateGameAccountProvision(p.ID, "game account was never created"); err != nil {
+					slog.Error("failed to close game account provision", "error", err, "provision_id", p.ID)
+				}
+				continue
+			}
+			if err != nil {
+				slog.Error("failed to look up game account", "error", err, "provision_id", p.ID)
+				continue
+			}
+		}
+
+		linked, err := h.userRepo.IsGameAccountLinked(gameAccountID)
+		if err != nil {
+			slog.Error("failed to check game account link", "error", err, "provision_id", p.ID)
+			continue
+		}
+		if linked {
+			// Found by name but belongs to another user: this provision's insert never happened
+			if err := h.userRepo.CompensateGameAccountProvision(p.ID, "game account name belongs to a linked account"); err != nil {
+				slog.Error("failed to close game account provision", "error", err, "provision_id", p.ID)
+			}
+			continue
+		}
+
+		slog.Warn("orphaned game account found", "game_account_id", gameAccountID, "user_id", p.UserID, "provision_id", p.ID)
+		h.removeGameAccount(p.ID, gameAccountID, p.GameUsername, "orphaned, found by reconciler")
+	}
+
+	return nil
+}
+
+// DeliverNotification posts an outbox message to the bot's webhook, signed. The body is the
+// message payload plus the event kind and a delivery_id the bot can use to drop duplicates.
+func (h *DiscordHandler) DeliverNotification(ctx context.Context, msg *storage.OutboxMessage) error {
+	if h.botWebhookURL == "" || h.signer == nil {
+		return errors.New("bot webhook URL or signing secret not configured")
+	}
+
+	payload := map[string]interface{}{}
+	if err := json.Unmarshal(msg.Payload, &payload); err != nil {
+		return err
+	}
+	payload["event"] = msg.Kind
+	payload["delivery_id"] = msg.ID
+
+	jsonData, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, "POST", h.botWebhookURL, bytes.NewReader(jsonData))
 	if err != nil {
-		slog.Error("failed to create bot notification request", "error", err)
 		return err
 	}
 
 	req.Header.Set("Content-Type", "application/json")
-	req.Header.Set("X-Bot-Secret", h.botSharedSecret)
+	if err := h.signer.Sign(req, jsonData); err != nil {
+		return err
+	}
 
-	client := &http.Client{Timeout: 10 * time.Second}
-	resp, err := client.Do(req)
+	resp, err := http.DefaultClient.Do(req)
 	if err != nil {
-		slog.Error("failed to send bot notification", "error", err)
 		return err
 	}
 	defer resp.Body.Close()
 
-	if resp.StatusCode != http.StatusOK {
-		slog.Error("bot notification failed", "status", resp.StatusCode)
-		return nil
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("bot webhook returned %d", resp.StatusCode)
 	}
-
-	slog.Info("bot notified successfully", "discord_id", discordID)
 	return nil
 }
 
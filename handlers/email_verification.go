@@ -0,0 +1,234 @@
+package handlers
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/ethan-mdev/authentication-server/keyring"
+	"github.com/ethan-mdev/authentication-server/mail"
+	"github.com/ethan-mdev/authentication-server/storage"
+	"github.com/ethan-mdev/central-auth/middleware"
+)
+
+const emailVerificationTTL = 48 * time.Hour
+
+var errInvalidVerificationToken = errors.New("invalid verification token")
+
+type EmailVerificationHandler struct {
+	Users     *storage.ExtendedUserRepository
+	Mailer    mail.Mailer
+	Secret    []byte // HMAC key for verification links
+	VerifyURL string // the verification page, receives ?token=
+	Required  bool   // block purchases, vouchers and Discord linking until verified
+}
+
+// Register sends a verification email after a successful registration
+// POST /register
+func (h *EmailVerificationHandler) Register(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		body, err := peekBody(r)
+		if err != nil {
+			http.Error(w, "Invalid request body", http.StatusBadRequest)
+			return
+		}
+
+		resp := newBufferedResponse()
+		next(resp, r)
+
+		if resp.status == http.StatusOK || resp.status == http.StatusCreated {
+			var req struct {
+				Email string `json:"email"`
+			}
+			json.Unmarshal(body, &req)
+
+			if userID, username, err := h.Users.GetUserByEmail(req.Email); err == nil {
+				go h.sendVerificationEmail(userID, username, req.Email)
+			} else {
+				slog.Error("failed to find registered user for verification email", "error", err)
+			}
+		}
+
+		resp.flush(w)
+	}
+}
+
+// ResendVerification sends a fresh verification link to the caller's current email
+// POST /email/verify/resend (requires auth)
+func (h *EmailVerificationHandler) ResendVerification() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		claims, ok := middleware.GetClaims(r.Context())
+		if !ok {
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+
+		email, verified, err := h.Users.GetEmailStatus(claims.UserID)
+		if err != nil {
+			http.Error(w, "User not found", http.StatusNotFound)
+			return
+		}
+
+		if verified {
+			http.Error(w, "Email already verified", http.StatusConflict)
+			return
+		}
+
+		username, err := h.Users.GetUsernameByID(claims.UserID)
+		if err != nil {
+			http.Error(w, "User not found", http.StatusNotFound)
+			return
+		}
+
+		go h.sendVerificationEmail(claims.UserID, username, email)
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]string{
+			"message": "Verification email sent",
+		})
+	}
+}
+
+// VerifyEmail checks a signed link token and marks the address verified
+// POST /email/verify
+func (h *EmailVerificationHandler) VerifyEmail() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var req struct {
+			Token string `json:"token"`
+		}
+
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "Invalid request body", http.StatusBadRequest)
+			return
+		}
+
+		userID, email, err := h.parseToken(req.Token, time.Now())
+		if err != nil {
+			http.Error(w, "Invalid or expired token", http.StatusBadRequest)
+			return
+		}
+
+		err = h.Users.MarkEmailVerified(userID, email)
+		if err == sql.ErrNoRows {
+			// Email changed after the link was sent
+			http.Error(w, "Invalid or expired token", http.StatusBadRequest)
+			return
+		}
+		if err != nil {
+			slog.Error("failed to mark email verified", "error", err, "user_id", userID)
+			http.Error(w, "Failed to verify email", http.StatusInternalServerError)
+			return
+		}
+
+		slog.Info("email verified", "user_id", userID)
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]string{
+			"message": "Email verified successfully",
+		})
+	}
+}
+
+// RequireVerified refuses the route until the caller's email is verified, when Required is set.
+// Must be mounted inside the auth middleware.
+func (h *EmailVerificationHandler) RequireVerified(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !h.Required {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		claims, ok := keyring.Claims(r.Context())
+		if !ok {
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+
+		_, verified, err := h.Users.GetEmailStatus(claims.UserID)
+		if err != nil {
+			slog.Error("failed to check email status", "error", err, "user_id", claims.UserID)
+			http.Error(w, "Internal server error", http.StatusInternalServerError)
+			return
+		}
+
+		if !verified {
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusForbidden)
+			json.NewEncoder(w).Encode(map[string]string{
+				"error":   "email_not_verified",
+				"message": "Please verify your email address first",
+			})
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+func (h *EmailVerificationHandler) sendVerificationEmail(userID, username, email string) {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	token := h.signToken(userID, email, time.Now().Add(emailVerificationTTL))
+	link := h.VerifyURL + "?token=" + url.QueryEscape(token)
+
+	err := h.Mailer.Send(ctx, mail.Message{
+		To:      email,
+		Subject: "Verify your email address",
+		Body: "Hi " + username + ",\n\n" +
+			"Confirm this is your email address by opening the link below. It expires in 48 hours.\n\n" +
+			link + "\n\n" +
+			"If you didn't create an account, you can ignore this email.\n",
+	})
+	if err != nil {
+		slog.Error("failed to send verification email", "error", err, "user_id", userID)
+	}
+}
+
+// signToken builds "<payload>.<signature>" where payload is base64url("userID|email|expiresUnix")
+func (h *EmailVerificationHandler) signToken(userID, email string, expiresAt time.Time) string {
+	payload := base64.RawURLEncoding.EncodeToString([]byte(userID + "|" + email + "|" + strconv.FormatInt(expiresAt.Unix(), 10)))
+	return payload + "." + h.signature(payload)
+}
+
+func (h *EmailVerificationHandler) parseToken(token string, now time.Time) (userID, email string, err error) {
+	payload, sig, ok := strings.Cut(token, ".")
+	if !ok || !hmac.Equal([]byte(sig), []byte(h.signature(payload))) {
+		return "", "", errInvalidVerificationToken
+	}
+
+	data, err := base64.RawURLEncoding.DecodeString(payload)
+	if err != nil {
+		return "", "", errInvalidVerificationToken
+	}
+
+	// The email sits in the middle and may itself contain "|"
+	userID, rest, ok := strings.Cut(string(data), "|")
+	sep := strings.LastIndex(rest, "|")
+	if !ok || sep < 0 {
+		return "", "", errInvalidVerificationToken
+	}
+
+	expires, err := strconv.ParseInt(rest[sep+1:], 10, 64)
+	if err != nil || now.Unix() > expires {
+		return "", "", errInvalidVerificationToken
+	}
+
+	return userID, rest[:sep], nil
+}
+
+func (h *EmailVerificationHandler) signature(payload string) string {
+	mac := hmac.New(sha256.New, h.Secret)
+	mac.Write([]byte("email-verification:" + payload))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
@@ -1,28 +1,50 @@
 package handlers
 
 import (
+	"context"
+	"crypto/subtle"
 	"database/sql"
 	"encoding/json"
+	"errors"
+	"fmt"
 	"log/slog"
 	"net/http"
+	"strconv"
+	"time"
 
+	"github.com/ethan-mdev/authentication-server/keyring"
 	"github.com/ethan-mdev/authentication-server/queries"
 	"github.com/ethan-mdev/authentication-server/storage"
-	"github.com/ethan-mdev/central-auth/middleware"
 )
 
 var (
 	createAccountSQL   = queries.Load("game/create_account.sql")
+	findAccountSQL     = queries.Load("game/find_account.sql")
+	deleteAccountSQL   = queries.Load("game/delete_account.sql")
 	getCharactersSQL   = queries.Load("game/get_characters.sql")
 	unstuckSQL         = queries.Load("game/unstuck.sql")
 	verifyCharacterSQL = queries.Load("game/verify_character.sql")
 	addItemSQL         = queries.Load("game/add_item_to_account.sql")
+	updatePasswordSQL  = queries.Load("game/update_password.sql")
 )
 
+// How long a launcher login ticket stays valid
+const loginTicketTTL = 30 * time.Second
+
+// How long one good may take to reach the game account. Kept well inside the window after which
+// storage treats a delivery as abandoned, so a slow delivery can't be refunded or retried under it.
+const goodsTimeout = time.Minute
+
+// errGoodsRefused is a delivery the game database answered with a failure result, so the good
+// definitely wasn't added. Any other delivery error leaves it unknown whether it was.
+var errGoodsRefused = errors.New("game refused the goods")
+
 type GameHandler struct {
-	userRepo    *storage.ExtendedUserRepository
-	accountDB   *sql.DB
-	characterDB *sql.DB
+	userRepo         *storage.ExtendedUserRepository
+	accountDB        *sql.DB
+	characterDB      *sql.DB
+	gameServerSecret string
+	audit            *storage.AuditRepository
 }
 
 type Character struct {
@@ -42,16 +64,24 @@ type PurchaseItemRequest struct {
 	ItemID int `json:"item_id"`
 }
 
-func NewGameHandler(userRepo *storage.ExtendedUserRepository, accountDB, characterDB *sql.DB) *GameHandler {
+type RedeemLoginTicketRequest struct {
+	Ticket string `json:"ticket"`
+}
+
+func NewGameHandler(userRepo *storage.ExtendedUserRepository, accountDB, characterDB *sql.DB, gameServerSecret string, audit *storage.AuditRepository) *GameHandler {
 	return &GameHandler{
-		userRepo:    userRepo,
-		accountDB:   accountDB,
-		characterDB: characterDB,
+		userRepo:         userRepo,
+		accountDB:        accountDB,
+		characterDB:      characterDB,
+		gameServerSecret: gameServerSecret,
+		audit:            audit,
 	}
 }
 
+// GetCredentials returns the permanent game API key.
+// Kept for older launchers behind LEGACY_GAME_CREDENTIALS; new launchers should use CreateLoginTicket.
 func (h *GameHandler) GetCredentials(w http.ResponseWriter, r *http.Request) {
-	claims, ok := middleware.GetClaims(r.Context())
+	claims, ok := keyring.Claims(r.Context())
 	if !ok {
 		http.Error(w, "Unauthorized", http.StatusUnauthorized)
 		return
@@ -73,6 +103,12 @@ func (h *GameHandler) GetCredentials(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	// Nobody gets the key without a record of it
+	if err := audit(h.audit, r, "game_credentials.read", "user", claims.UserID, nil, map[string]int{"game_account_id": creds.GameAccountID}); err != nil {
+		http.Error(w, "Failed to fetch credentials", http.StatusInternalServerError)
+		return
+	}
+
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(map[string]interface{}{
 		"username":        creds.Username,
@@ -81,8 +117,170 @@ func (h *GameHandler) GetCredentials(w http.ResponseWriter, r *http.Request) {
 	})
 }
 
+// RotateCredentials replaces the caller's game API key, e.g. after it was exposed
+// POST /game/credentials/rotate
+func (h *GameHandler) RotateCredentials(w http.ResponseWriter, r *http.Request) {
+	claims, ok := keyring.Claims(r.Context())
+	if !ok {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	h.writeRotatedCredentials(w, r, claims.UserID)
+}
+
+// AdminRotateCredentials replaces any user's game API key (admin only)
+// POST /admin/users/{userId}/game-credentials/rotate
+func (h *GameHandler) AdminRotateCredentials(w http.ResponseWriter, r *http.Request) {
+	h.writeRotatedCredentials(w, r, r.PathValue("userId"))
+}
+
+func (h *GameHandler) writeRotatedCredentials(w http.ResponseWriter, r *http.Request, userID string) {
+	apiKey, gameAccountID, err := h.rotateApiKey(userID, auditEvent(r, "game_credentials.rotate", "user", userID))
+	if err == sql.ErrNoRows {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusForbidden)
+		json.NewEncoder(w).Encode(map[string]string{
+			"error":   "account_not_linked",
+			"message": "No game account linked",
+		})
+		return
+	}
+	if err != nil {
+		http.Error(w, "Failed to rotate credentials", http.StatusInternalServerError)
+		return
+	}
+
+	slog.Info("game api key rotated", "user_id", userID, "game_account_id", gameAccountID)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"api_key":         apiKey,
+		"game_account_id": gameAccountID,
+	})
+}
+
+// rotateApiKey writes a new key to both databases. The PostgreSQL row is only committed once
+// tUser has the new hash; if that commit then fails, tUser is put back to the old hash.
+func (h *GameHandler) rotateApiKey(userID string, audit *storage.AuditEvent) (apiKey string, gameAccountID int, err error) {
+	apiKey, err = generateApiKey(16)
+	if err != nil {
+		return "", 0, err
+	}
+
+	gameAccountID, oldKey, err := h.userRepo.RotateGameApiKey(userID, apiKey, func(gameAccountID int) error {
+		_, err := h.accountDB.Exec(updatePasswordSQL, md5Hash(apiKey), gameAccountID)
+		return err
+	}, audit)
+	if err == sql.ErrNoRows {
+		return "", 0, err
+	}
+	if err != nil {
+		slog.Error("failed to rotate game api key", "error", err, "user_id", userID)
+
+		// Game side already has the new hash - restore the old one
+		if oldKey != "" {
+			if _, restoreErr := h.accountDB.Exec(updatePasswordSQL, md5Hash(oldKey), gameAccountID); restoreErr != nil {
+				slog.Error("failed to restore game api key, databases out of sync", "error", restoreErr, "user_id", userID, "game_account_id", gameAccountID)
+			}
+		}
+		return "", 0, err
+	}
+
+	return apiKey, gameAccountID, nil
+}
+
+// CreateLoginTicket issues a short-lived, single-use ticket the launcher hands to the game server
+// instead of the permanent API key
+func (h *GameHandler) CreateLoginTicket(w http.ResponseWriter, r *http.Request) {
+	claims, ok := keyring.Claims(r.Context())
+	if !ok {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	creds, err := h.userRepo.GetGameCredentials(claims.UserID)
+	if err != nil {
+		slog.Error("failed to fetch credentials", "error", err, "user_id", claims.UserID)
+		http.Error(w, "Failed to fetch credentials", http.StatusInternalServerError)
+		return
+	}
+
+	if creds == nil {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusForbidden)
+		json.NewEncoder(w).Encode(map[string]string{
+			"error":   "account_not_linked",
+			"message": "Please verify your account to create a game account",
+		})
+		return
+	}
+
+	ticket, err := generateApiKey(64)
+	if err != nil {
+		http.Error(w, "Failed to generate ticket", http.StatusInternalServerError)
+		return
+	}
+
+	expiresAt := time.Now().Add(loginTicketTTL)
+	if err := h.userRepo.CreateGameLoginTicket(storage.HashToken(ticket), claims.UserID, creds.GameAccountID, expiresAt); err != nil {
+		slog.Error("failed to store login ticket", "error", err, "user_id", claims.UserID)
+		http.Error(w, "Failed to create ticket", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"ticket":          ticket,
+		"expires_in":      int(loginTicketTTL.Seconds()),
+		"game_account_id": creds.GameAccountID,
+	})
+}
+
+// RedeemLoginTicket - called by the game server to exchange a launcher ticket for the account it belongs to.
+// Each ticket works exactly once.
+func (h *GameHandler) RedeemLoginTicket(w http.ResponseWriter, r *http.Request) {
+	// Verify request is from the game server
+	secret := r.Header.Get("X-Game-Server-Secret")
+	if h.gameServerSecret == "" || subtle.ConstantTimeCompare([]byte(secret), []byte(h.gameServerSecret)) != 1 {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	var req RedeemLoginTicketRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	if req.Ticket == "" {
+		http.Error(w, "Ticket required", http.StatusBadRequest)
+		return
+	}
+
+	ticket, err := h.userRepo.ConsumeGameLoginTicket(storage.HashToken(req.Ticket))
+	if err == sql.ErrNoRows {
+		http.Error(w, "Invalid or expired ticket", http.StatusUnauthorized)
+		return
+	}
+	if err != nil {
+		slog.Error("failed to redeem login ticket", "error", err)
+		http.Error(w, "Failed to redeem ticket", http.StatusInternalServerError)
+		return
+	}
+
+	slog.Info("login ticket redeemed", "user_id", ticket.UserID, "game_account_id", ticket.GameAccountID)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"user_id":         ticket.UserID,
+		"username":        ticket.Username,
+		"game_account_id": ticket.GameAccountID,
+	})
+}
+
 func (h *GameHandler) GetCharacters(w http.ResponseWriter, r *http.Request) {
-	claims, ok := middleware.GetClaims(r.Context())
+	claims, ok := keyring.Claims(r.Context())
 	if !ok {
 		http.Error(w, "Unauthorized", http.StatusUnauthorized)
 		return
@@ -136,7 +334,7 @@ func (h *GameHandler) GetCharacters(w http.ResponseWriter, r *http.Request) {
 }
 
 func (h *GameHandler) UnstuckCharacter(w http.ResponseWriter, r *http.Request) {
-	claims, ok := middleware.GetClaims(r.Context())
+	claims, ok := keyring.Claims(r.Context())
 	if !ok {
 		http.Error(w, "Unauthorized", http.StatusUnauthorized)
 		return
@@ -191,7 +389,7 @@ func (h *GameHandler) UnstuckCharacter(w http.ResponseWriter, r *http.Request) {
 }
 
 func (h *GameHandler) PurchaseItem(w http.ResponseWriter, r *http.Request) {
-	claims, ok := middleware.GetClaims(r.Context())
+	claims, ok := keyring.Claims(r.Context())
 	if !ok {
 		http.Error(w, "Unauthorized", http.StatusUnauthorized)
 		return
@@ -241,54 +439,208 @@ func (h *GameHandler) PurchaseItem(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// Add all goods to game account
-	for _, content := range contents {
-		goodsNo := content["game_goods_no"]
-		quantity := content["quantity"]
-
-		var result int
-		err = h.accountDB.QueryRow(addItemSQL, creds.GameAccountID, 0, goodsNo, quantity).Scan(&result)
-		if err != nil {
-			slog.Error("failed to add item to game account", "error", err, "user_id", claims.UserID, "goods_no", goodsNo)
-			http.Error(w, "Failed to add item to game account", http.StatusInternalServerError)
-			return
-		}
-
-		if result != 1 {
-			slog.Error("stored procedure failed", "result", result, "goods_no", goodsNo)
-			http.Error(w, "Failed to add item to game account", http.StatusInternalServerError)
-			return
-		}
-	}
-
-	// Purchase item (deduct balance and record purchase)
-	newBalance, err := h.userRepo.PurchaseItem(claims.UserID, req.ItemID, 1)
+	// Reserve the balance and open the order before anything reaches the game account
+	order, newBalance, err := h.userRepo.ReservePurchase(claims.UserID, req.ItemID, 1, auditEvent(r, "item.purchase", "user", claims.UserID))
 	if err == sql.ErrNoRows {
 		http.Error(w, "Insufficient balance", http.StatusPaymentRequired)
 		return
 	}
 	if err != nil {
-		slog.Error("failed to complete purchase", "error", err, "user_id", claims.UserID)
+		slog.Error("failed to reserve purchase", "error", err, "user_id", claims.UserID)
 		http.Error(w, "Failed to complete purchase", http.StatusInternalServerError)
 		return
 	}
 
-	slog.Info("item purchased", "user_id", claims.UserID, "item_id", req.ItemID, "item_name", item["name"], "new_balance", newBalance)
+	if delivered, err := h.deliverOrder(order, contents, creds.GameAccountID); err != nil {
+		h.abortOrder(r, order, delivered, err)
+		http.Error(w, "Failed to add item to game account", http.StatusInternalServerError)
+		return
+	}
+
+	if err := h.userRepo.CompleteOrder(order.ID, order.ClaimID); err != nil {
+		// Goods are delivered and paid for, only the bookkeeping is missing
+		slog.Error("failed to complete order", "error", err, "order_id", order.ID)
+	}
+
+	slog.Info("item purchased", "user_id", claims.UserID, "order_id", order.ID, "item_id", req.ItemID, "item_name", item["name"], "new_balance", newBalance)
 
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(map[string]interface{}{
 		"success":     true,
 		"message":     "Item purchased successfully",
+		"order_id":    order.ID,
 		"new_balance": newBalance,
 	})
 }
 
+// RetryOrder resumes delivery of a failed order from the first good that didn't arrive (admin only)
+// POST /admin/orders/{orderId}/retry
+func (h *GameHandler) RetryOrder(w http.ResponseWriter, r *http.Request) {
+	orderID, err := strconv.Atoi(r.PathValue("orderId"))
+	if err != nil {
+		http.Error(w, "Invalid order ID", http.StatusBadRequest)
+		return
+	}
+
+	order, err := h.userRepo.ClaimOrderForRetry(orderID)
+	if err == sql.ErrNoRows {
+		http.Error(w, "Order not found or not retryable", http.StatusConflict)
+		return
+	}
+	if err != nil {
+		slog.Error("failed to claim order", "error", err, "order_id", orderID)
+		http.Error(w, "Failed to retry order", http.StatusInternalServerError)
+		return
+	}
+
+	creds, err := h.userRepo.GetGameCredentials(order.UserID)
+	if err != nil || creds == nil {
+		h.failOrder(order, order.DeliveredCount, "no game account linked")
+		http.Error(w, "No game account linked", http.StatusConflict)
+		return
+	}
+
+	contents, err := h.userRepo.GetItemContents(order.ItemID)
+	if err != nil {
+		h.failOrder(order, order.DeliveredCount, err.Error())
+		http.Error(w, "Failed to get item contents", http.StatusInternalServerError)
+		return
+	}
+
+	if delivered, err := h.deliverOrder(order, contents, creds.GameAccountID); err != nil {
+		h.failOrder(order, delivered, err.Error())
+		http.Error(w, "Failed to add item to game account", http.StatusBadGateway)
+		return
+	}
+
+	if err := h.userRepo.CompleteOrder(order.ID, order.ClaimID); err != nil {
+		slog.Error("failed to complete order", "error", err, "order_id", order.ID)
+		http.Error(w, "Failed to complete order", http.StatusInternalServerError)
+		return
+	}
+
+	slog.Info("order retried", "order_id", order.ID, "user_id", order.UserID)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"success":  true,
+		"message":  "Order delivered",
+		"order_id": order.ID,
+	})
+}
+
+// deliverOrder sends the order's goods to the game account, starting after the ones already delivered.
+// Returns how many goods are in the game account, see deliverGoods.
+func (h *GameHandler) deliverOrder(order *storage.Order, contents []map[string]int, gameAccountID int) (delivered int, err error) {
+	return h.deliverGoods(contents, order.DeliveredCount, order.ID, gameAccountID, func(delivered int) error {
+		if err := h.userRepo.RecordOrderDelivery(order.ID, order.ClaimID, delivered); err != nil {
+			slog.Error("failed to record order progress", "error", err, "order_id", order.ID)
+			return err
+		}
+		order.DeliveredCount = delivered
+		return nil
+	})
+}
+
+// deliverVoucher sends the redemption's goods to the game account like deliverOrder
+func (h *GameHandler) deliverVoucher(redemption *storage.VoucherRedemption, contents []map[string]int, gameAccountID int) (delivered int, err error) {
+	return h.deliverGoods(contents, redemption.DeliveredCount, 0, gameAccountID, func(delivered int) error {
+		if err := h.userRepo.RecordVoucherDelivery(redemption.ID, redemption.ClaimID, delivered); err != nil {
+			slog.Error("failed to record voucher progress", "error", err, "redemption_id", redemption.ID)
+			return err
+		}
+		redemption.DeliveredCount = delivered
+		return nil
+	})
+}
+
+// deliverGoods sends contents to the game account, skipping the first delivered. record saves
+// progress after every good, before the next one is sent, so a retry never sends one twice.
+// Returns how many goods are in the game account: one more than was recorded if the last one
+// arrived but saving that failed, for the caller to save instead.
+func (h *GameHandler) deliverGoods(contents []map[string]int, delivered, orderNo, gameAccountID int, record func(delivered int) error) (int, error) {
+	if delivered > len(contents) {
+		return delivered, fmt.Errorf("%d goods delivered but there are only %d", delivered, len(contents))
+	}
+
+	for _, content := range contents[delivered:] {
+		goodsNo := content["game_goods_no"]
+
+		if err := h.addGoods(gameAccountID, orderNo, goodsNo, content["quantity"]); err != nil {
+			slog.Error("failed to add item to game account", "error", err, "game_account_id", gameAccountID, "order_no", orderNo, "goods_no", goodsNo)
+			return delivered, err
+		}
+
+		if err := record(delivered + 1); err != nil {
+			return delivered + 1, err
+		}
+		delivered++
+	}
+
+	return delivered, nil
+}
+
+// addGoods adds one good to the game account's item storage. An errGoodsRefused error means it
+// definitely wasn't added; after any other error it may have been.
+func (h *GameHandler) addGoods(gameAccountID, orderNo, goodsNo, quantity int) error {
+	ctx, cancel := context.WithTimeout(context.Background(), goodsTimeout)
+	defer cancel()
+
+	var result int
+	if err := h.accountDB.QueryRowContext(ctx, addItemSQL, gameAccountID, orderNo, goodsNo, quantity).Scan(&result); err != nil {
+		return err
+	}
+	if result != 1 {
+		return fmt.Errorf("%w: usp_Charge_ItemInsert returned %d for goods %d", errGoodsRefused, result, goodsNo)
+	}
+	return nil
+}
+
+// failOrder parks an order for an admin to retry or refund, saving how many goods arrived.
+// Reports whether it did; if not, the order is picked up as abandoned once it goes stale.
+func (h *GameHandler) failOrder(order *storage.Order, delivered int, reason string) bool {
+	err := h.userRepo.FailOrder(order.ID, order.ClaimID, delivered, reason)
+	if err == storage.ErrOrderClaimLost {
+		slog.Warn("order was refunded or retried during delivery", "order_id", order.ID, "delivered", delivered)
+		return false
+	}
+	if err != nil {
+		slog.Error("failed to mark order failed", "error", err, "order_id", order.ID, "delivered", delivered)
+		return false
+	}
+	return true
+}
+
+// abortOrder parks a failed order. The balance is only refunded straight away when the game
+// refused the first good; after a timeout or lost connection the good may have arrived anyway,
+// so like a partial delivery the order waits for an admin to check, then retry or refund it.
+func (h *GameHandler) abortOrder(r *http.Request, order *storage.Order, delivered int, cause error) {
+	if !h.failOrder(order, delivered, cause.Error()) {
+		return
+	}
+
+	if delivered > 0 {
+		slog.Warn("order partially delivered, needs retry or refund", "order_id", order.ID, "delivered", delivered)
+		return
+	}
+	if !errors.Is(cause, errGoodsRefused) {
+		slog.Warn("order delivery outcome unknown, needs retry or refund", "order_id", order.ID, "error", cause)
+		return
+	}
+
+	if _, err := h.userRepo.RefundOrder(order.ID, cause.Error(), "", auditEvent(r, "order.refund", "order", strconv.Itoa(order.ID))); err != nil {
+		slog.Error("failed to refund order", "error", err, "order_id", order.ID)
+		return
+	}
+	slog.Info("order refunded", "order_id", order.ID, "user_id", order.UserID)
+}
+
 type RedeemVoucherRequest struct {
 	Code string `json:"code"`
 }
 
 func (h *GameHandler) RedeemVoucher(w http.ResponseWriter, r *http.Request) {
-	claims, ok := middleware.GetClaims(r.Context())
+	claims, ok := keyring.Claims(r.Context())
 	if !ok {
 		http.Error(w, "Unauthorized", http.StatusUnauthorized)
 		return
@@ -331,15 +683,22 @@ func (h *GameHandler) RedeemVoucher(w http.ResponseWriter, r *http.Request) {
 
 	voucherID := voucher["id"].(int)
 
-	// Check if already redeemed
-	redeemed, err := h.userRepo.IsVoucherRedeemed(claims.UserID, voucherID)
+	// Get voucher contents
+	contents, err := h.userRepo.GetVoucherContents(voucherID)
 	if err != nil {
-		slog.Error("failed to check redemption status", "error", err)
-		http.Error(w, "Failed to check voucher status", http.StatusInternalServerError)
+		slog.Error("failed to get voucher contents", "error", err, "voucher_id", voucherID)
+		http.Error(w, "Failed to get voucher contents", http.StatusInternalServerError)
+		return
+	}
+
+	if len(contents) == 0 {
+		http.Error(w, "Voucher has no contents configured", http.StatusInternalServerError)
 		return
 	}
 
-	if redeemed {
+	// Claim the redemption before delivering anything
+	redemption, err := h.userRepo.ClaimVoucher(claims.UserID, voucherID, auditEvent(r, "voucher.redeem", "user", claims.UserID))
+	if err == storage.ErrVoucherRedeemed {
 		w.Header().Set("Content-Type", "application/json")
 		w.WriteHeader(http.StatusConflict)
 		json.NewEncoder(w).Encode(map[string]string{
@@ -347,73 +706,121 @@ func (h *GameHandler) RedeemVoucher(w http.ResponseWriter, r *http.Request) {
 		})
 		return
 	}
+	if err == storage.ErrVoucherExhausted {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusGone)
+		json.NewEncoder(w).Encode(map[string]string{
+			"error": "Voucher has reached maximum redemptions",
+		})
+		return
+	}
+	if err != nil {
+		slog.Error("failed to claim voucher", "error", err, "user_id", claims.UserID, "voucher_id", voucherID)
+		http.Error(w, "Failed to check voucher availability", http.StatusInternalServerError)
+		return
+	}
 
-	// Check if voucher has reached max total redemptions
-	if maxTotal := voucher["max_total_redemptions"]; maxTotal != nil {
-		maxTotalRedemptions := maxTotal.(int)
-		totalRedemptions, err := h.userRepo.GetTotalRedemptionCount(voucherID)
-		if err != nil {
-			slog.Error("failed to get total redemption count", "error", err)
-			http.Error(w, "Failed to check voucher availability", http.StatusInternalServerError)
-			return
-		}
+	if delivered, err := h.deliverVoucher(redemption, contents, creds.GameAccountID); err != nil {
+		h.abortVoucherRedemption(r, redemption, delivered, err)
+		http.Error(w, "Failed to add voucher items to game account", http.StatusInternalServerError)
+		return
+	}
 
-		if totalRedemptions >= maxTotalRedemptions {
-			w.Header().Set("Content-Type", "application/json")
-			w.WriteHeader(http.StatusGone)
-			json.NewEncoder(w).Encode(map[string]string{
-				"error": "Voucher has reached maximum redemptions",
-			})
-			return
-		}
+	if err := h.userRepo.CompleteVoucherRedemption(redemption.ID, redemption.ClaimID); err != nil {
+		// Goods are delivered, only the bookkeeping is missing
+		slog.Error("failed to complete voucher redemption", "error", err, "redemption_id", redemption.ID)
 	}
 
-	// Get voucher contents
-	contents, err := h.userRepo.GetVoucherContents(voucherID)
+	slog.Info("voucher redeemed", "user_id", claims.UserID, "voucher_code", req.Code, "voucher_id", voucherID)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"success": true,
+		"message": "Voucher redeemed successfully! Items have been added to your account.",
+	})
+}
+
+// failVoucherRedemption parks a redemption for an admin to retry, saving how many goods arrived
+func (h *GameHandler) failVoucherRedemption(redemption *storage.VoucherRedemption, delivered int, reason string) {
+	err := h.userRepo.FailVoucherRedemption(redemption.ID, redemption.ClaimID, delivered, reason)
+	if err == storage.ErrRedemptionClaimLost {
+		slog.Warn("voucher redemption was retried during delivery", "redemption_id", redemption.ID, "delivered", delivered)
+		return
+	}
 	if err != nil {
-		slog.Error("failed to get voucher contents", "error", err, "voucher_id", voucherID)
-		http.Error(w, "Failed to get voucher contents", http.StatusInternalServerError)
+		slog.Error("failed to mark voucher redemption failed", "error", err, "redemption_id", redemption.ID, "delivered", delivered)
+	}
+}
+
+// abortVoucherRedemption gives the redemption back only when the game refused the first good.
+// After a timeout or lost connection the good may have arrived anyway, and redeeming again would
+// deliver it twice, so like a partial delivery the redemption is parked for an admin to retry.
+func (h *GameHandler) abortVoucherRedemption(r *http.Request, redemption *storage.VoucherRedemption, delivered int, cause error) {
+	if delivered > 0 || !errors.Is(cause, errGoodsRefused) {
+		slog.Warn("voucher delivery incomplete, needs retry", "redemption_id", redemption.ID, "user_id", redemption.UserID, "delivered", delivered, "error", cause)
+		h.failVoucherRedemption(redemption, delivered, cause.Error())
 		return
 	}
 
-	if len(contents) == 0 {
-		http.Error(w, "Voucher has no contents configured", http.StatusInternalServerError)
+	if err := h.userRepo.ReleaseVoucherClaim(redemption, auditEvent(r, "voucher.release", "user", redemption.UserID)); err != nil {
+		slog.Error("failed to release voucher claim", "error", err, "redemption_id", redemption.ID)
+		h.failVoucherRedemption(redemption, delivered, cause.Error())
+	}
+}
+
+// RetryVoucherRedemption resumes delivery of a failed voucher redemption from the first good
+// that didn't arrive (admin only)
+// POST /admin/voucher-redemptions/{redemptionId}/retry
+func (h *GameHandler) RetryVoucherRedemption(w http.ResponseWriter, r *http.Request) {
+	redemptionID, err := strconv.Atoi(r.PathValue("redemptionId"))
+	if err != nil {
+		http.Error(w, "Invalid redemption ID", http.StatusBadRequest)
 		return
 	}
 
-	// Add all goods to game account
-	for _, content := range contents {
-		goodsNo := content["game_goods_no"]
-		quantity := content["quantity"]
-
-		var result int
-		err = h.accountDB.QueryRow(addItemSQL, creds.GameAccountID, 0, goodsNo, quantity).Scan(&result)
-		if err != nil {
-			slog.Error("failed to add voucher item to game account", "error", err, "user_id", claims.UserID, "goods_no", goodsNo)
-			http.Error(w, "Failed to add voucher items to game account", http.StatusInternalServerError)
-			return
-		}
+	redemption, err := h.userRepo.ClaimVoucherRedemptionForRetry(redemptionID)
+	if err == sql.ErrNoRows {
+		http.Error(w, "Redemption not found or not retryable", http.StatusConflict)
+		return
+	}
+	if err != nil {
+		slog.Error("failed to claim voucher redemption", "error", err, "redemption_id", redemptionID)
+		http.Error(w, "Failed to retry redemption", http.StatusInternalServerError)
+		return
+	}
 
-		if result != 1 {
-			slog.Error("stored procedure failed", "result", result, "goods_no", goodsNo)
-			http.Error(w, "Failed to add voucher items to game account", http.StatusInternalServerError)
-			return
-		}
+	creds, err := h.userRepo.GetGameCredentials(redemption.UserID)
+	if err != nil || creds == nil {
+		h.failVoucherRedemption(redemption, redemption.DeliveredCount, "no game account linked")
+		http.Error(w, "No game account linked", http.StatusConflict)
+		return
 	}
 
-	// Mark voucher as redeemed
-	err = h.userRepo.MarkVoucherRedeemed(claims.UserID, voucherID)
+	contents, err := h.userRepo.GetVoucherContents(redemption.VoucherID)
 	if err != nil {
-		slog.Error("failed to mark voucher as redeemed", "error", err, "user_id", claims.UserID, "voucher_id", voucherID)
+		h.failVoucherRedemption(redemption, redemption.DeliveredCount, err.Error())
+		http.Error(w, "Failed to get voucher contents", http.StatusInternalServerError)
+		return
+	}
+
+	if delivered, err := h.deliverVoucher(redemption, contents, creds.GameAccountID); err != nil {
+		h.failVoucherRedemption(redemption, delivered, err.Error())
+		http.Error(w, "Failed to add voucher items to game account", http.StatusBadGateway)
+		return
+	}
+
+	if err := h.userRepo.CompleteVoucherRedemption(redemption.ID, redemption.ClaimID); err != nil {
+		slog.Error("failed to complete voucher redemption", "error", err, "redemption_id", redemption.ID)
 		http.Error(w, "Failed to complete redemption", http.StatusInternalServerError)
 		return
 	}
 
-	slog.Info("voucher redeemed", "user_id", claims.UserID, "voucher_code", req.Code, "voucher_id", voucherID)
+	slog.Info("voucher redemption retried", "redemption_id", redemption.ID, "user_id", redemption.UserID)
 
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(map[string]interface{}{
-		"success": true,
-		"message": "Voucher redeemed successfully! Items have been added to your account.",
+		"success":       true,
+		"message":       "Voucher items delivered",
+		"redemption_id": redemption.ID,
 	})
 }
@@ -0,0 +1,162 @@
+package handlers
+
+import (
+	"database/sql"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+
+	"github.com/ethan-mdev/authentication-server/storage"
+)
+
+// Introspect tells a resource server whether an access token is still active (RFC 7662).
+// Only confidential clients may introspect.
+// POST /oauth/introspect
+func (h *OIDCHandler) Introspect() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Cache-Control", "no-store")
+
+		if err := r.ParseForm(); err != nil {
+			writeOAuthError(w, http.StatusBadRequest, "invalid_request", "Invalid form body")
+			return
+		}
+
+		client, ok := h.authenticateClient(w, r)
+		if !ok {
+			return
+		}
+		if client.Public {
+			writeOAuthError(w, http.StatusUnauthorized, "invalid_client", "Public clients can't introspect tokens")
+			return
+		}
+
+		inactive := map[string]interface{}{"active": false}
+		w.Header().Set("Content-Type", "application/json")
+
+		info, err := h.Keys.Verify(r.PostForm.Get("token"))
+		if err != nil {
+			json.NewEncoder(w).Encode(inactive)
+			return
+		}
+
+		var revoked bool
+		if info.Service {
+			revoked, err = h.Sessions.IsTokenIDRevoked(info.ID)
+		} else {
+			revoked, err = h.Sessions.IsAccessTokenRevoked(info.ID, info.UserID, info.IssuedAt)
+		}
+		if err != nil {
+			slog.Error("failed to check token revocation", "error", err, "user_id", info.UserID, "client_id", info.ClientID)
+			writeOAuthError(w, http.StatusInternalServerError, "server_error", "")
+			return
+		}
+		if revoked {
+			json.NewEncoder(w).Encode(inactive)
+			return
+		}
+
+		resp := map[string]interface{}{
+			"active":     true,
+			"sub":        info.UserID,
+			"token_type": "Bearer",
+			"iat":        info.IssuedAt.Unix(),
+			"exp":        info.ExpiresAt.Unix(),
+			"jti":        info.ID,
+		}
+
+		// Service tokens belong to the client itself, which is also their subject
+		if info.Service {
+			resp["sub"] = info.ClientID
+		} else {
+			username, err := h.Users.GetUsernameByID(info.UserID)
+			if err != nil {
+				slog.Error("failed to load user for introspection", "error", err, "user_id", info.UserID)
+				writeOAuthError(w, http.StatusInternalServerError, "server_error", "")
+				return
+			}
+			resp["username"] = username
+		}
+		if info.Scope != "" {
+			resp["scope"] = info.Scope
+		}
+		if info.ClientID != "" {
+			resp["client_id"] = info.ClientID
+		}
+		if h.Issuer != "" {
+			resp["iss"] = h.Issuer
+		}
+
+		json.NewEncoder(w).Encode(resp)
+	}
+}
+
+// Revoke revokes an access or refresh token (RFC 7009). A client may only revoke tokens issued
+// to it; access tokens with no client binding need a confidential client. Unknown tokens and
+// other clients' tokens are not an error, so a client can't use this to probe which tokens exist.
+// POST /oauth/revoke
+func (h *OIDCHandler) Revoke() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if err := r.ParseForm(); err != nil {
+			writeOAuthError(w, http.StatusBadRequest, "invalid_request", "Invalid form body")
+			return
+		}
+
+		client, ok := h.authenticateClient(w, r)
+		if !ok {
+			return
+		}
+
+		token := r.PostForm.Get("token")
+		if token == "" {
+			writeOAuthError(w, http.StatusBadRequest, "invalid_request", "token is required")
+			return
+		}
+
+		var err error
+		if info, verifyErr := h.Keys.Verify(token); verifyErr == nil {
+			if info.ClientID != client.ID && (info.ClientID != "" || client.Public) {
+				slog.Warn("token revocation by another client ignored", "client_id", client.ID, "token_client_id", info.ClientID, "user_id", info.UserID)
+				w.WriteHeader(http.StatusOK)
+				return
+			}
+			err = h.Sessions.RevokeAccessToken(info.ID, info.UserID, info.ExpiresAt)
+			if err == nil {
+				slog.Info("access token revoked", "client_id", client.ID, "user_id", info.UserID, "service", info.Service)
+			}
+		} else {
+			err = h.revokeRefreshToken(token, client.ID)
+		}
+
+		if err != nil {
+			slog.Error("failed to revoke token", "error", err, "client_id", client.ID)
+			writeOAuthError(w, http.StatusServiceUnavailable, "temporarily_unavailable", "")
+			return
+		}
+
+		w.WriteHeader(http.StatusOK)
+	}
+}
+
+// revokeRefreshToken ends the device or login session a refresh token belongs to,
+// if it was issued to clientID
+func (h *OIDCHandler) revokeRefreshToken(token, clientID string) error {
+	hash := storage.HashToken(token)
+
+	if err := h.Clients.RevokeDeviceSession(hash, clientID); err != sql.ErrNoRows {
+		return err
+	}
+
+	rec, err := h.Sessions.GetRefreshToken(hash)
+	if err == sql.ErrNoRows {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if rec.ClientID != clientID {
+		slog.Warn("token revocation by another client ignored", "client_id", clientID, "token_client_id", rec.ClientID, "user_id", rec.UserID)
+		return nil
+	}
+
+	return h.Sessions.RevokeFamily(rec.FamilyID, "revoked by client")
+}
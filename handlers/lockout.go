@@ -0,0 +1,169 @@
+package handlers
+
+import (
+	"encoding/json"
+	"log/slog"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/ethan-mdev/authentication-server/lockout"
+	"github.com/ethan-mdev/authentication-server/storage"
+)
+
+// LoginGuard throttles credential endpoints per client IP and per account
+type LoginGuard struct {
+	Store lockout.Store
+	Audit *storage.AuditRepository // records lockouts cleared by admins
+}
+
+// Login refuses locked IPs and accounts, and counts failed logins against both
+// POST /login
+func (g *LoginGuard) Login(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		body, err := peekBody(r)
+		if err != nil {
+			http.Error(w, "Invalid request body", http.StatusBadRequest)
+			return
+		}
+
+		var req struct {
+			Username string `json:"username"`
+		}
+		json.Unmarshal(body, &req)
+
+		keys := []string{lockout.IPKey(clientIP(r))}
+		policies := []lockout.Policy{lockout.IPPolicy}
+		if username := strings.ToLower(strings.TrimSpace(req.Username)); username != "" {
+			keys = append(keys, lockout.AccountKey(username))
+			policies = append(policies, lockout.AccountPolicy)
+		}
+
+		if g.rejectLocked(w, r, keys...) {
+			return
+		}
+
+		resp := newBufferedResponse()
+		next(resp, r)
+
+		switch {
+		case resp.status == http.StatusUnauthorized:
+			g.fail(r, keys, policies)
+		case resp.status == http.StatusOK && len(keys) > 1:
+			// Correct password clears the account counter; the IP counter decays on its own
+			if err := g.Store.Reset(r.Context(), keys[1]); err != nil {
+				slog.Error("failed to reset login failures", "error", err)
+			}
+		}
+
+		resp.flush(w)
+	}
+}
+
+// ByIP throttles an endpoint per client IP only, for requests that carry no username
+// POST /refresh, POST /login/mfa
+func (g *LoginGuard) ByIP(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		keys := []string{lockout.IPKey(clientIP(r))}
+		if g.rejectLocked(w, r, keys...) {
+			return
+		}
+
+		resp := newBufferedResponse()
+		next(resp, r)
+
+		if resp.status == http.StatusUnauthorized {
+			g.fail(r, keys, []lockout.Policy{lockout.IPPolicy})
+		}
+
+		resp.flush(w)
+	}
+}
+
+// rejectLocked answers 429 with Retry-After if any key is locked
+func (g *LoginGuard) rejectLocked(w http.ResponseWriter, r *http.Request, keys ...string) bool {
+	var wait time.Duration
+	for _, key := range keys {
+		locked, err := g.Store.Locked(r.Context(), key)
+		if err != nil {
+			// Fail open, a broken counter store shouldn't stop everyone logging in
+			slog.Error("failed to check lockout", "error", err, "key", key)
+			continue
+		}
+		wait = max(wait, locked)
+	}
+
+	if wait <= 0 {
+		return false
+	}
+
+	writeTooManyAttempts(w, wait)
+	return true
+}
+
+func (g *LoginGuard) fail(r *http.Request, keys []string, policies []lockout.Policy) {
+	for i, key := range keys {
+		locked, err := g.Store.Fail(r.Context(), key, policies[i])
+		if err != nil {
+			slog.Error("failed to record login failure", "error", err, "key", key)
+			continue
+		}
+		if locked > 0 {
+			slog.Warn("login locked out", "key", key, "locked_for", locked.String(), "ip", clientIP(r))
+		}
+	}
+}
+
+func writeTooManyAttempts(w http.ResponseWriter, wait time.Duration) {
+	w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusTooManyRequests)
+	json.NewEncoder(w).Encode(map[string]string{
+		"error":   "too_many_attempts",
+		"message": "Too many failed attempts, try again later",
+	})
+}
+
+// ListLockouts returns every IP and account currently locked out (admin only)
+// GET /admin/lockouts
+func (g *LoginGuard) ListLockouts() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		entries, err := g.Store.ListLocked(r.Context())
+		if err != nil {
+			slog.Error("failed to list lockouts", "error", err)
+			http.Error(w, "Failed to fetch lockouts", http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(entries)
+	}
+}
+
+// ClearLockout lifts a lockout, e.g. DELETE /admin/lockouts/account:alice or mfa:<user id> (admin only)
+// DELETE /admin/lockouts/{key}
+func (g *LoginGuard) ClearLockout() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		key := r.PathValue("key")
+		if !strings.HasPrefix(key, "ip:") && !strings.HasPrefix(key, "account:") && !strings.HasPrefix(key, "mfa:") {
+			http.Error(w, "Invalid lockout key", http.StatusBadRequest)
+			return
+		}
+
+		if err := g.Store.Reset(r.Context(), key); err != nil {
+			slog.Error("failed to clear lockout", "error", err, "key", key)
+			http.Error(w, "Failed to clear lockout", http.StatusInternalServerError)
+			return
+		}
+
+		slog.Info("lockout cleared", "key", key)
+		audit(g.Audit, r, "lockout.clear", "lockout", key, nil, nil)
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]string{
+			"message": "Lockout cleared",
+		})
+	}
+}
@@ -0,0 +1,479 @@
+package handlers
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/ethan-mdev/authentication-server/keyring"
+	"github.com/ethan-mdev/authentication-server/lockout"
+	"github.com/ethan-mdev/authentication-server/storage"
+	"github.com/ethan-mdev/authentication-server/totp"
+	"github.com/ethan-mdev/central-auth/middleware"
+)
+
+const (
+	mfaChallengeTTL   = 5 * time.Minute
+	mfaStepUpTTL      = 5 * time.Minute
+	recoveryCodeCount = 10
+
+	// A login challenge is dropped after this many wrong codes
+	maxChallengeAttempts = 3
+)
+
+type MFAHandler struct {
+	MFA      *storage.MFARepository
+	Sessions *storage.SessionRepository
+	Users    *storage.ExtendedUserRepository
+	Lockouts lockout.Store // counts wrong codes per user across login and step-up
+	Issuer   string        // shown in authenticator apps
+}
+
+type mfaCodeRequest struct {
+	Code string `json:"code"`
+}
+
+// Enroll starts TOTP enrollment and returns the secret to show as a QR code
+// POST /mfa/totp/enroll (requires auth)
+func (h *MFAHandler) Enroll() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		claims, ok := middleware.GetClaims(r.Context())
+		if !ok {
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+
+		username, err := h.Users.GetUsernameByID(claims.UserID)
+		if err != nil {
+			http.Error(w, "User not found", http.StatusNotFound)
+			return
+		}
+
+		secret, err := totp.GenerateSecret()
+		if err != nil {
+			http.Error(w, "Failed to generate secret", http.StatusInternalServerError)
+			return
+		}
+
+		err = h.MFA.StartTOTPEnrollment(claims.UserID, secret)
+		if err == sql.ErrNoRows {
+			http.Error(w, "Two-factor authentication already enabled", http.StatusConflict)
+			return
+		}
+		if err != nil {
+			slog.Error("failed to start totp enrollment", "error", err, "user_id", claims.UserID)
+			http.Error(w, "Failed to start enrollment", http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]string{
+			"secret":           secret,
+			"provisioning_uri": totp.ProvisioningURI(h.Issuer, username, secret),
+		})
+	}
+}
+
+// Confirm enables TOTP once the user proves their app works, and returns recovery codes (shown once)
+// POST /mfa/totp/confirm (requires auth)
+func (h *MFAHandler) Confirm() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		claims, ok := middleware.GetClaims(r.Context())
+		if !ok {
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+
+		var req mfaCodeRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "Invalid request body", http.StatusBadRequest)
+			return
+		}
+
+		enrollment, err := h.MFA.GetTOTP(claims.UserID)
+		if err == sql.ErrNoRows {
+			http.Error(w, "No enrollment in progress", http.StatusBadRequest)
+			return
+		}
+		if err != nil {
+			http.Error(w, "Internal server error", http.StatusInternalServerError)
+			return
+		}
+
+		if enrollment.Enabled {
+			http.Error(w, "Two-factor authentication already enabled", http.StatusConflict)
+			return
+		}
+
+		step, ok := totp.Validate(enrollment.Secret, req.Code, time.Now())
+		if !ok {
+			http.Error(w, "Invalid code", http.StatusUnauthorized)
+			return
+		}
+
+		codes := make([]string, recoveryCodeCount)
+		hashes := make([]string, recoveryCodeCount)
+		for i := range codes {
+			raw, err := generateApiKey(10)
+			if err != nil {
+				http.Error(w, "Failed to generate recovery codes", http.StatusInternalServerError)
+				return
+			}
+			codes[i] = raw[:5] + "-" + raw[5:]
+			hashes[i] = storage.HashToken(raw)
+		}
+
+		if err := h.MFA.ConfirmTOTP(claims.UserID, step, hashes); err != nil {
+			slog.Error("failed to confirm totp", "error", err, "user_id", claims.UserID)
+			http.Error(w, "Failed to enable two-factor authentication", http.StatusInternalServerError)
+			return
+		}
+
+		slog.Info("totp enabled", "user_id", claims.UserID)
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"message":        "Two-factor authentication enabled",
+			"recovery_codes": codes,
+		})
+	}
+}
+
+// Disable turns TOTP off (mount behind RequireStepUp)
+// DELETE /mfa/totp (requires auth)
+func (h *MFAHandler) Disable() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		claims, ok := middleware.GetClaims(r.Context())
+		if !ok {
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+
+		if err := h.MFA.DisableTOTP(claims.UserID, auditEvent(r, "mfa.disable", "user", claims.UserID)); err != nil {
+			slog.Error("failed to disable totp", "error", err, "user_id", claims.UserID)
+			http.Error(w, "Failed to disable two-factor authentication", http.StatusInternalServerError)
+			return
+		}
+
+		slog.Info("totp disabled", "user_id", claims.UserID)
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]string{
+			"message": "Two-factor authentication disabled",
+		})
+	}
+}
+
+// Login holds back the tokens of users with TOTP enabled. They get an MFA challenge token
+// instead and exchange it plus a code at /login/mfa. The issued tokens are kept encrypted
+// with a key derived from the challenge token, so the database alone can't recover them.
+// POST /login
+func (h *MFAHandler) Login(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		resp := newBufferedResponse()
+		next(resp, r)
+
+		tokens, ok := resp.tokens()
+		if !ok {
+			resp.flush(w)
+			return
+		}
+
+		userID, err := h.Sessions.UserIDForRefreshToken(tokens.RefreshToken)
+		if err != nil {
+			slog.Error("failed to resolve user for login", "error", err)
+			http.Error(w, "Internal server error", http.StatusInternalServerError)
+			return
+		}
+
+		enabled, err := h.MFA.IsTOTPEnabled(userID)
+		if err != nil {
+			slog.Error("failed to check mfa status", "error", err, "user_id", userID)
+			http.Error(w, "Internal server error", http.StatusInternalServerError)
+			return
+		}
+
+		if !enabled {
+			resp.flush(w)
+			return
+		}
+
+		challenge, err := generateApiKey(64)
+		if err != nil {
+			http.Error(w, "Internal server error", http.StatusInternalServerError)
+			return
+		}
+
+		sealed, err := sealWithToken(challenge, resp.body.Bytes())
+		if err != nil {
+			slog.Error("failed to seal login response", "error", err)
+			http.Error(w, "Internal server error", http.StatusInternalServerError)
+			return
+		}
+
+		err = h.MFA.CreateChallenge(storage.HashToken(challenge), userID, sealed, time.Now().Add(mfaChallengeTTL))
+		if err != nil {
+			slog.Error("failed to store mfa challenge", "error", err, "user_id", userID)
+			http.Error(w, "Internal server error", http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"mfa_required": true,
+			"mfa_token":    challenge,
+			"expires_in":   int(mfaChallengeTTL.Seconds()),
+		})
+	}
+}
+
+// CompleteLogin answers an MFA challenge with a TOTP or recovery code and returns the held tokens
+// POST /login/mfa
+func (h *MFAHandler) CompleteLogin() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var req struct {
+			MFAToken string `json:"mfa_token"`
+			Code     string `json:"code"`
+		}
+
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "Invalid request body", http.StatusBadRequest)
+			return
+		}
+
+		challengeHash := storage.HashToken(req.MFAToken)
+		userID, sealed, err := h.MFA.GetChallenge(challengeHash)
+		if err == sql.ErrNoRows {
+			http.Error(w, "Invalid or expired MFA token", http.StatusUnauthorized)
+			return
+		}
+		if err != nil {
+			http.Error(w, "Internal server error", http.StatusInternalServerError)
+			return
+		}
+
+		if !h.checkCode(w, r, userID, req.Code) {
+			if err := h.MFA.FailChallenge(challengeHash, maxChallengeAttempts); err != nil {
+				slog.Error("failed to record mfa challenge failure", "error", err, "user_id", userID)
+			}
+			return
+		}
+
+		// Single use - a concurrent request with the same challenge loses here
+		if err := h.MFA.DeleteChallenge(challengeHash); err != nil {
+			http.Error(w, "Invalid or expired MFA token", http.StatusUnauthorized)
+			return
+		}
+
+		body, err := openWithToken(req.MFAToken, sealed)
+		if err != nil {
+			slog.Error("failed to open sealed login response", "error", err, "user_id", userID)
+			http.Error(w, "Internal server error", http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(body)
+	}
+}
+
+// StepUp exchanges a fresh code for a short-lived token that unlocks sensitive routes
+// POST /mfa/step-up (requires auth, game-scoped device tokens accepted)
+func (h *MFAHandler) StepUp() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		claims, ok := keyring.Claims(r.Context())
+		if !ok {
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+
+		var req mfaCodeRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "Invalid request body", http.StatusBadRequest)
+			return
+		}
+
+		if !h.checkCode(w, r, claims.UserID, req.Code) {
+			return
+		}
+
+		token, err := generateApiKey(64)
+		if err != nil {
+			http.Error(w, "Internal server error", http.StatusInternalServerError)
+			return
+		}
+
+		err = h.MFA.CreateStepUpToken(storage.HashToken(token), claims.UserID, time.Now().Add(mfaStepUpTTL))
+		if err != nil {
+			slog.Error("failed to store step-up token", "error", err, "user_id", claims.UserID)
+			http.Error(w, "Internal server error", http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"step_up_token": token,
+			"expires_in":    int(mfaStepUpTTL.Seconds()),
+		})
+	}
+}
+
+// RequireStepUp guards sensitive routes. Users with TOTP enabled must send a token
+// from /mfa/step-up in the X-MFA-Token header; users without TOTP pass through.
+// Must be mounted inside the auth middleware.
+func (h *MFAHandler) RequireStepUp(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		claims, ok := keyring.Claims(r.Context())
+		if !ok {
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+
+		enabled, err := h.MFA.IsTOTPEnabled(claims.UserID)
+		if err != nil {
+			slog.Error("failed to check mfa status", "error", err, "user_id", claims.UserID)
+			http.Error(w, "Internal server error", http.StatusInternalServerError)
+			return
+		}
+
+		if enabled {
+			token := r.Header.Get("X-MFA-Token")
+			valid := false
+			if token != "" {
+				valid, err = h.MFA.ValidStepUpToken(storage.HashToken(token), claims.UserID)
+				if err != nil {
+					http.Error(w, "Internal server error", http.StatusInternalServerError)
+					return
+				}
+			}
+
+			if !valid {
+				w.Header().Set("Content-Type", "application/json")
+				w.WriteHeader(http.StatusForbidden)
+				json.NewEncoder(w).Encode(map[string]string{
+					"error":   "mfa_step_up_required",
+					"message": "Confirm with your authenticator code via /mfa/step-up",
+				})
+				return
+			}
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+// checkCode verifies a code while the user isn't locked out, counting wrong ones against
+// them. It writes the error response and returns false unless the code is good.
+func (h *MFAHandler) checkCode(w http.ResponseWriter, r *http.Request, userID, code string) bool {
+	key := lockout.MFAKey(userID)
+	locked, err := h.Lockouts.Locked(r.Context(), key)
+	if err != nil {
+		// Fail closed, unlike password logins: the password was already checked and
+		// the second factor is what stands between a leaked token and the account
+		slog.Error("failed to check mfa lockout", "error", err, "user_id", userID)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return false
+	}
+	if locked > 0 {
+		writeTooManyAttempts(w, locked)
+		return false
+	}
+
+	ok, err := h.verifyCode(userID, code)
+	if err != nil {
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return false
+	}
+
+	if !ok {
+		locked, err := h.Lockouts.Fail(r.Context(), key, lockout.MFAPolicy)
+		if err != nil {
+			slog.Error("failed to record mfa failure", "error", err, "user_id", userID)
+		} else if locked > 0 {
+			slog.Warn("mfa locked out", "user_id", userID, "locked_for", locked.String(), "ip", clientIP(r))
+		}
+		http.Error(w, "Invalid code", http.StatusUnauthorized)
+		return false
+	}
+
+	if err := h.Lockouts.Reset(r.Context(), key); err != nil {
+		slog.Error("failed to reset mfa failures", "error", err, "user_id", userID)
+	}
+	return true
+}
+
+// verifyCode accepts a current TOTP code (each one only once) or an unused recovery code
+func (h *MFAHandler) verifyCode(userID, code string) (bool, error) {
+	code = strings.TrimSpace(code)
+
+	enrollment, err := h.MFA.GetTOTP(userID)
+	if err == sql.ErrNoRows {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	if !enrollment.Enabled {
+		return false, nil
+	}
+
+	if step, ok := totp.Validate(enrollment.Secret, code, time.Now()); ok {
+		return h.MFA.UseTOTPStep(userID, step)
+	}
+
+	recovery := strings.ToLower(strings.ReplaceAll(code, "-", ""))
+	used, err := h.MFA.UseRecoveryCode(userID, storage.HashToken(recovery))
+	if used {
+		slog.Info("mfa recovery code used", "user_id", userID)
+	}
+	return used, err
+}
+
+// sealWithToken encrypts data with AES-256-GCM under a key derived from a random token
+func sealWithToken(token string, data []byte) ([]byte, error) {
+	key := sha256.Sum256([]byte(token))
+	block, err := aes.NewCipher(key[:])
+	if err != nil {
+		return nil, err
+	}
+
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+
+	return gcm.Seal(nonce, nonce, data, nil), nil
+}
+
+func openWithToken(token string, sealed []byte) ([]byte, error) {
+	key := sha256.Sum256([]byte(token))
+	block, err := aes.NewCipher(key[:])
+	if err != nil {
+		return nil, err
+	}
+
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(sealed) < gcm.NonceSize() {
+		return nil, errors.New("sealed data too short")
+	}
+
+	nonce, ciphertext := sealed[:gcm.NonceSize()], sealed[gcm.NonceSize():]
+	return gcm.Open(nil, nonce, ciphertext, nil)
+}
@@ -0,0 +1,816 @@
+package handlers
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"crypto/subtle"
+	"database/sql"
+	"encoding/base64"
+	"encoding/json"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/ethan-mdev/authentication-server/keyring"
+	"github.com/ethan-mdev/authentication-server/storage"
+	"github.com/ethan-mdev/authentication-server/templates"
+)
+
+const authorizationCodeTTL = time.Minute
+
+// csrfCookie holds the token the sign-in form has to post back. It's SameSite=Strict, so a
+// form posted from another site arrives without it and can't sign the browser in.
+const csrfCookie = "oauth_csrf"
+
+var supportedScopes = map[string]bool{"openid": true, "profile": true, "email": true}
+
+var authorizePage = templates.Load("authorize.html")
+
+// OIDCHandler is an OpenID Connect provider (authorization code flow with PKCE) for
+// first-party apps. The sign-in page runs the same /login and /login/mfa handler chains
+// as the JSON API, so lockout, MFA and bans apply unchanged. The session that login starts
+// is only proof of sign-in and is ended straight away; the client gets access tokens limited
+// to the scopes it asked for in exchange for the authorization code.
+type OIDCHandler struct {
+	Clients       *storage.OAuthRepository
+	Users         *storage.ExtendedUserRepository
+	Sessions      *storage.SessionRepository
+	Keys          *keyring.Ring
+	Issuer        string           // public base URL, no trailing slash
+	AccessExpiry  time.Duration    // lifetime of access and ID tokens
+	Login         http.HandlerFunc // the POST /login chain
+	CompleteLogin http.HandlerFunc // the POST /login/mfa chain
+	Refresh       http.HandlerFunc // the POST /refresh chain
+
+	DeviceVerifyURL string // portal page where users enter a device grant's user code
+}
+
+// authorizeRequest holds the validated parameters of an authorization request
+type authorizeRequest struct {
+	client        *storage.OAuthClient
+	redirectURI   string
+	state         string
+	nonce         string
+	codeChallenge string
+	scopes        []string
+}
+
+type authorizePageData struct {
+	Client    *storage.OAuthClient
+	Scopes    []string
+	Params    map[string]string
+	Action    string
+	CSRFToken string
+	Username  string
+	MFAToken  string
+	Error     string
+}
+
+// Discovery publishes the provider metadata
+// GET /.well-known/openid-configuration
+func (h *OIDCHandler) Discovery() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"issuer":                                           h.Issuer,
+			"authorization_endpoint":                           h.Issuer + "/oauth/authorize",
+			"token_endpoint":                                   h.Issuer + "/oauth/token",
+			"device_authorization_endpoint":                    h.Issuer + "/oauth/device_authorization",
+			"userinfo_endpoint":                                h.Issuer + "/userinfo",
+			"introspection_endpoint":                           h.Issuer + "/oauth/introspect",
+			"revocation_endpoint":                              h.Issuer + "/oauth/revoke",
+			"jwks_uri":                                         h.Issuer + "/.well-known/jwks.json",
+			"response_types_supported":                         []string{"code"},
+			"grant_types_supported":                            []string{"authorization_code", deviceGrantType, "refresh_token", "client_credentials"},
+			"subject_types_supported":                          []string{"public"},
+			"id_token_signing_alg_values_supported":            []string{"RS256"},
+			"scopes_supported":                                 []string{"openid", "profile", "email", GameScope, BotVerifyScope, GameDeliverScope},
+			"token_endpoint_auth_methods_supported":            []string{"client_secret_basic", "client_secret_post", "private_key_jwt", "none"},
+			"token_endpoint_auth_signing_alg_values_supported": []string{"RS256", "ES256"},
+			"code_challenge_methods_supported":                 []string{"S256"},
+			"claims_supported": []string{
+				"sub", "iss", "aud", "exp", "iat", "auth_time", "nonce",
+				"name", "preferred_username", "email", "email_verified",
+			},
+			"authorization_response_iss_parameter_supported": true,
+		})
+	}
+}
+
+// Authorize shows the sign-in and consent page for an authorization request
+// GET /oauth/authorize
+func (h *OIDCHandler) Authorize() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		req, ok := h.parseAuthorizeRequest(w, r, r.URL.Query())
+		if !ok {
+			return
+		}
+
+		csrfToken, err := h.setCSRFCookie(w, r)
+		if err != nil {
+			h.render(w, http.StatusInternalServerError, authorizePageData{Error: "Something went wrong, please try again"})
+			return
+		}
+
+		page := h.pageData(r, req)
+		page.CSRFToken = csrfToken
+		h.render(w, http.StatusOK, page)
+	}
+}
+
+// setCSRFCookie gives the browser a CSRF token for the sign-in form, keeping the one it has
+// so several open sign-in tabs keep working
+func (h *OIDCHandler) setCSRFCookie(w http.ResponseWriter, r *http.Request) (string, error) {
+	if cookie, err := r.Cookie(csrfCookie); err == nil && len(cookie.Value) == 64 {
+		return cookie.Value, nil
+	}
+
+	token, err := generateApiKey(64)
+	if err != nil {
+		return "", err
+	}
+
+	http.SetCookie(w, &http.Cookie{
+		Name:     csrfCookie,
+		Value:    token,
+		Path:     r.URL.Path,
+		HttpOnly: true,
+		Secure:   strings.HasPrefix(h.Issuer, "https://"),
+		SameSite: http.SameSiteStrictMode,
+	})
+	return token, nil
+}
+
+// checkCSRF reports whether a sign-in form post carries the token of the browser's CSRF cookie
+func checkCSRF(r *http.Request) bool {
+	cookie, err := r.Cookie(csrfCookie)
+	if err != nil || cookie.Value == "" {
+		return false
+	}
+	return subtle.ConstantTimeCompare([]byte(cookie.Value), []byte(r.PostForm.Get("csrf_token"))) == 1
+}
+
+// SubmitAuthorize signs the user in from the page and redirects back to the client with a code
+// POST /oauth/authorize
+func (h *OIDCHandler) SubmitAuthorize() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if err := r.ParseForm(); err != nil {
+			h.render(w, http.StatusBadRequest, authorizePageData{Error: "Invalid request"})
+			return
+		}
+
+		if !checkCSRF(r) {
+			slog.Warn("security event", "event", "authorize_csrf_mismatch", "client_id", r.PostForm.Get("client_id"), "ip", clientIP(r))
+			h.render(w, http.StatusForbidden, authorizePageData{Error: "Your sign-in expired, please go back to the application and try again"})
+			return
+		}
+
+		req, ok := h.parseAuthorizeRequest(w, r, r.PostForm)
+		if !ok {
+			return
+		}
+
+		if r.PostForm.Get("action") == "deny" {
+			h.redirect(w, r, req, url.Values{"error": {"access_denied"}})
+			return
+		}
+
+		page := h.pageData(r, req)
+		page.CSRFToken = r.PostForm.Get("csrf_token")
+		var resp *bufferedResponse
+		if mfaToken := r.PostForm.Get("mfa_token"); mfaToken != "" {
+			page.MFAToken = mfaToken
+			resp = callJSON(h.CompleteLogin, r, map[string]string{
+				"mfa_token": mfaToken,
+				"code":      strings.TrimSpace(r.PostForm.Get("code")),
+			})
+		} else {
+			page.Username = r.PostForm.Get("username")
+			resp = callJSON(h.Login, r, map[string]string{
+				"username": page.Username,
+				"password": r.PostForm.Get("password"),
+			})
+		}
+
+		tokens, ok := resp.tokens()
+		if !ok {
+			h.renderLoginFailure(w, resp, page)
+			return
+		}
+
+		userID, err := h.Sessions.UserIDForRefreshToken(tokens.RefreshToken)
+		if err != nil {
+			slog.Error("failed to resolve user for authorization", "error", err)
+			h.render(w, http.StatusInternalServerError, authorizePageData{Error: "Something went wrong, please try again"})
+			return
+		}
+
+		// The client gets scoped tokens of its own, nobody gets these
+		h.discardSession(tokens.RefreshToken, userID, "signed in for oauth client")
+
+		code, err := generateApiKey(64)
+		if err != nil {
+			h.render(w, http.StatusInternalServerError, authorizePageData{Error: "Something went wrong, please try again"})
+			return
+		}
+
+		err = h.Clients.CreateAuthorizationCode(storage.HashToken(code), &storage.AuthorizationCode{
+			ClientID:      req.client.ID,
+			UserID:        userID,
+			RedirectURI:   req.redirectURI,
+			Scope:         strings.Join(req.scopes, " "),
+			Nonce:         req.nonce,
+			CodeChallenge: req.codeChallenge,
+		}, time.Now().Add(authorizationCodeTTL))
+		if err != nil {
+			slog.Error("failed to store authorization code", "error", err, "client_id", req.client.ID)
+			h.render(w, http.StatusInternalServerError, authorizePageData{Error: "Something went wrong, please try again"})
+			return
+		}
+
+		slog.Info("authorization code issued", "client_id", req.client.ID, "user_id", userID)
+		h.redirect(w, r, req, url.Values{"code": {code}})
+	}
+}
+
+// renderLoginFailure shows the page again after the login chain refused or challenged the user
+func (h *OIDCHandler) renderLoginFailure(w http.ResponseWriter, resp *bufferedResponse, page authorizePageData) {
+	switch {
+	case resp.status == http.StatusOK:
+		// MFA challenge instead of tokens - ask for the code next
+		var challenge struct {
+			MFAToken string `json:"mfa_token"`
+		}
+		if err := json.Unmarshal(resp.body.Bytes(), &challenge); err != nil || challenge.MFAToken == "" {
+			h.render(w, http.StatusInternalServerError, authorizePageData{Error: "Something went wrong, please try again"})
+			return
+		}
+		page.MFAToken = challenge.MFAToken
+		h.render(w, http.StatusOK, page)
+
+	case resp.status == http.StatusTooManyRequests:
+		if retryAfter := resp.header.Get("Retry-After"); retryAfter != "" {
+			w.Header().Set("Retry-After", retryAfter)
+		}
+		page.Error = "Too many attempts, please try again later"
+		h.render(w, http.StatusTooManyRequests, page)
+
+	case resp.status >= http.StatusInternalServerError:
+		page.Error = "Something went wrong, please try again"
+		h.render(w, http.StatusInternalServerError, page)
+
+	case resp.status == http.StatusForbidden:
+		page.MFAToken = ""
+		page.Error = "This account is banned"
+		h.render(w, http.StatusForbidden, page)
+
+	case page.MFAToken != "":
+		// A wrong code keeps the challenge; anything else means it's gone and the password is needed again
+		page.Error = "Invalid code"
+		if strings.TrimSpace(resp.body.String()) != "Invalid code" {
+			page.MFAToken = ""
+			page.Error = "Your sign-in expired, please sign in again"
+		}
+		h.render(w, http.StatusUnauthorized, page)
+
+	default:
+		page.Error = "Invalid username or password"
+		h.render(w, http.StatusUnauthorized, page)
+	}
+}
+
+// Token exchanges an authorization code, device code, refresh token or client credentials for tokens
+// POST /oauth/token
+func (h *OIDCHandler) Token() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Cache-Control", "no-store")
+
+		if err := r.ParseForm(); err != nil {
+			writeOAuthError(w, http.StatusBadRequest, "invalid_request", "Invalid form body")
+			return
+		}
+
+		client, ok := h.authenticateClient(w, r)
+		if !ok {
+			return
+		}
+
+		switch r.PostForm.Get("grant_type") {
+		case "authorization_code":
+			h.exchangeCode(w, r, client)
+		case deviceGrantType:
+			h.exchangeDeviceCode(w, r, client)
+		case "refresh_token":
+			h.refreshToken(w, r, client)
+		case "client_credentials":
+			h.clientCredentials(w, r, client)
+		default:
+			writeOAuthError(w, http.StatusBadRequest, "unsupported_grant_type", "Supported grants are authorization_code, device_code, refresh_token and client_credentials")
+		}
+	}
+}
+
+func (h *OIDCHandler) exchangeCode(w http.ResponseWriter, r *http.Request, client *storage.OAuthClient) {
+	code := r.PostForm.Get("code")
+	grant, err := h.Clients.ConsumeAuthorizationCode(storage.HashToken(code))
+	if err == sql.ErrNoRows {
+		writeOAuthError(w, http.StatusBadRequest, "invalid_grant", "Invalid or expired authorization code")
+		return
+	}
+	if err != nil {
+		slog.Error("failed to consume authorization code", "error", err)
+		writeOAuthError(w, http.StatusInternalServerError, "server_error", "")
+		return
+	}
+
+	verifier := r.PostForm.Get("code_verifier")
+	challenge := sha256.Sum256([]byte(verifier))
+	if grant.ClientID != client.ID ||
+		grant.RedirectURI != r.PostForm.Get("redirect_uri") ||
+		subtle.ConstantTimeCompare([]byte(base64.RawURLEncoding.EncodeToString(challenge[:])), []byte(grant.CodeChallenge)) != 1 {
+		// The code is burned either way
+		slog.Warn("security event", "event", "authorization_code_misuse", "client_id", client.ID, "user_id", grant.UserID, "ip", clientIP(r))
+		writeOAuthError(w, http.StatusBadRequest, "invalid_grant", "Authorization code does not match this request")
+		return
+	}
+
+	refreshToken, err := generateApiKey(64)
+	if err != nil {
+		writeOAuthError(w, http.StatusInternalServerError, "server_error", "")
+		return
+	}
+
+	err = h.Clients.CreateDeviceSession(grant.UserID, client.ID, grant.Scope, storage.HashToken(refreshToken), time.Now().Add(deviceSessionTTL))
+	if err != nil {
+		slog.Error("failed to store oauth client session", "error", err, "client_id", client.ID, "user_id", grant.UserID)
+		writeOAuthError(w, http.StatusInternalServerError, "server_error", "")
+		return
+	}
+
+	idToken, err := h.idToken(grant, client.ID)
+	if err != nil {
+		slog.Error("failed to issue id token", "error", err, "user_id", grant.UserID)
+		writeOAuthError(w, http.StatusInternalServerError, "server_error", "")
+		return
+	}
+
+	h.writeScopedTokens(w, grant.UserID, client.ID, grant.Scope, refreshToken, idToken)
+}
+
+func (h *OIDCHandler) refreshToken(w http.ResponseWriter, r *http.Request, client *storage.OAuthClient) {
+	if h.refreshDeviceSession(w, client, r.PostForm.Get("refresh_token")) {
+		return
+	}
+
+	// Sessions from authorization codes redeemed before codes issued scoped tokens. Only the
+	// client a session was issued to may refresh it here. First-party login sessions, and
+	// untracked tokens from before families existed, have no client.
+	rec, err := h.Sessions.GetRefreshToken(storage.HashToken(r.PostForm.Get("refresh_token")))
+	if err != nil && err != sql.ErrNoRows {
+		slog.Error("failed to look up refresh token", "error", err, "client_id", client.ID)
+		writeOAuthError(w, http.StatusInternalServerError, "server_error", "")
+		return
+	}
+	if err == sql.ErrNoRows || rec.ClientID != client.ID {
+		if rec != nil {
+			slog.Warn("security event", "event", "refresh_token_client_mismatch", "client_id", client.ID, "user_id", rec.UserID, "ip", clientIP(r))
+		}
+		writeOAuthError(w, http.StatusBadRequest, "invalid_grant", "Invalid or expired refresh token")
+		return
+	}
+
+	resp := callJSON(h.Refresh, r, map[string]string{"refresh_token": r.PostForm.Get("refresh_token")})
+
+	tokens, ok := resp.tokens()
+	switch {
+	case ok:
+		h.writeTokens(w, tokens, "", "")
+	case resp.status == http.StatusTooManyRequests:
+		if retryAfter := resp.header.Get("Retry-After"); retryAfter != "" {
+			w.Header().Set("Retry-After", retryAfter)
+		}
+		writeOAuthError(w, http.StatusTooManyRequests, "invalid_request", "Too many attempts")
+	case resp.status >= http.StatusInternalServerError:
+		writeOAuthError(w, http.StatusInternalServerError, "server_error", "")
+	default:
+		writeOAuthError(w, http.StatusBadRequest, "invalid_grant", "Invalid or expired refresh token")
+	}
+}
+
+// discardSession revokes the session a refresh token belongs to
+func (h *OIDCHandler) discardSession(refreshToken, userID, reason string) {
+	rec, err := h.Sessions.GetRefreshToken(storage.HashToken(refreshToken))
+	if err == nil {
+		err = h.Sessions.RevokeFamily(rec.FamilyID, reason)
+	}
+	if err != nil {
+		slog.Error("failed to revoke session", "error", err, "user_id", userID, "reason", reason)
+	}
+}
+
+// authenticateClient identifies the client from HTTP Basic auth, the form body or a client assertion.
+// Confidential clients must present their secret or a signed assertion; public clients rely on PKCE.
+func (h *OIDCHandler) authenticateClient(w http.ResponseWriter, r *http.Request) (*storage.OAuthClient, bool) {
+	if r.PostForm.Get("client_assertion_type") == clientAssertionType {
+		return h.authenticateAssertion(w, r)
+	}
+
+	clientID, secret, basic := r.BasicAuth()
+	if basic {
+		clientID, _ = url.QueryUnescape(clientID)
+		secret, _ = url.QueryUnescape(secret)
+	} else {
+		clientID = r.PostForm.Get("client_id")
+		secret = r.PostForm.Get("client_secret")
+	}
+
+	unauthorized := func() (*storage.OAuthClient, bool) {
+		if basic {
+			w.Header().Set("WWW-Authenticate", `Basic realm="oauth"`)
+		}
+		writeOAuthError(w, http.StatusUnauthorized, "invalid_client", "Client authentication failed")
+		return nil, false
+	}
+
+	client, err := h.Clients.GetClient(clientID)
+	if err == sql.ErrNoRows {
+		return unauthorized()
+	}
+	if err != nil {
+		slog.Error("failed to load oauth client", "error", err, "client_id", clientID)
+		writeOAuthError(w, http.StatusInternalServerError, "server_error", "")
+		return nil, false
+	}
+
+	if !client.Public && subtle.ConstantTimeCompare([]byte(storage.HashToken(secret)), []byte(client.SecretHash)) != 1 {
+		return unauthorized()
+	}
+
+	return client, true
+}
+
+// idToken signs the ID token for a redeemed authorization code
+func (h *OIDCHandler) idToken(grant *storage.AuthorizationCode, clientID string) (string, error) {
+	now := time.Now()
+	claims := map[string]interface{}{
+		"iss":       h.Issuer,
+		"sub":       grant.UserID,
+		"aud":       clientID,
+		"iat":       now.Unix(),
+		"exp":       now.Add(h.AccessExpiry).Unix(),
+		"auth_time": grant.AuthTime.Unix(),
+	}
+	if grant.Nonce != "" {
+		claims["nonce"] = grant.Nonce
+	}
+
+	if err := h.addUserClaims(claims, grant.UserID, strings.Fields(grant.Scope)); err != nil {
+		return "", err
+	}
+
+	return h.Keys.Sign(claims)
+}
+
+// addUserClaims adds the profile and email claims the given scopes allow
+func (h *OIDCHandler) addUserClaims(claims map[string]interface{}, userID string, scopes []string) error {
+	for _, scope := range scopes {
+		switch scope {
+		case "profile":
+			username, err := h.Users.GetUsernameByID(userID)
+			if err != nil {
+				return err
+			}
+			claims["name"] = username
+			claims["preferred_username"] = username
+		case "email":
+			email, verified, err := h.Users.GetEmailStatus(userID)
+			if err != nil {
+				return err
+			}
+			claims["email"] = email
+			claims["email_verified"] = verified
+		}
+	}
+	return nil
+}
+
+func (h *OIDCHandler) writeTokens(w http.ResponseWriter, tokens tokenResponse, idToken, scope string) {
+	resp := map[string]interface{}{
+		"access_token":  tokens.AccessToken,
+		"refresh_token": tokens.RefreshToken,
+		"token_type":    "Bearer",
+		"expires_in":    int(h.AccessExpiry.Seconds()),
+	}
+	if idToken != "" {
+		resp["id_token"] = idToken
+	}
+	if scope != "" {
+		resp["scope"] = scope
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(resp)
+}
+
+// UserInfo returns the signed-in user's claims, only those its scopes allow for a client's token
+// GET /userinfo (requires auth, mount behind keyring ScopedAuth with the openid scope)
+func (h *OIDCHandler) UserInfo() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		claims, ok := keyring.Claims(r.Context())
+		if !ok {
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+
+		scopes := []string{"profile", "email"}
+		if info, err := h.Keys.Verify(strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")); err == nil && info.Scope != "" {
+			scopes = strings.Fields(info.Scope)
+		}
+
+		info := map[string]interface{}{"sub": claims.UserID}
+		if err := h.addUserClaims(info, claims.UserID, scopes); err != nil {
+			slog.Error("failed to load userinfo", "error", err, "user_id", claims.UserID)
+			http.Error(w, "Internal server error", http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(info)
+	}
+}
+
+// ListClients returns the registered OpenID Connect clients
+// GET /admin/oauth/clients
+func (h *OIDCHandler) ListClients() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		clients, err := h.Clients.ListClients()
+		if err != nil {
+			slog.Error("failed to list oauth clients", "error", err)
+			http.Error(w, "Failed to fetch clients", http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(clients)
+	}
+}
+
+// RegisterClient registers a client. The secret of a confidential client is only shown here;
+// a client registered with a public key authenticates with signed assertions instead.
+// POST /admin/oauth/clients
+func (h *OIDCHandler) RegisterClient() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var req struct {
+			Name         string   `json:"name"`
+			RedirectURIs []string `json:"redirect_uris"`
+			Public       bool     `json:"public"` // launcher and SPAs, which can't keep a secret
+			Scopes       []string `json:"scopes"` // service scopes for client credentials
+			JWTPublicKey string   `json:"jwt_public_key"`
+		}
+
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "Invalid request body", http.StatusBadRequest)
+			return
+		}
+
+		// Clients without redirect URIs can only use the device grant
+		if strings.TrimSpace(req.Name) == "" {
+			http.Error(w, "Name is required", http.StatusBadRequest)
+			return
+		}
+		if req.RedirectURIs == nil {
+			req.RedirectURIs = []string{}
+		}
+		if req.Scopes == nil {
+			req.Scopes = []string{}
+		}
+
+		for _, scope := range req.Scopes {
+			if !serviceScopes[scope] {
+				http.Error(w, "Unknown scope: "+scope, http.StatusBadRequest)
+				return
+			}
+		}
+		if req.Public && (len(req.Scopes) > 0 || req.JWTPublicKey != "") {
+			http.Error(w, "Public clients can't have scopes or a public key", http.StatusBadRequest)
+			return
+		}
+		if req.JWTPublicKey != "" {
+			if _, err := parsePublicKey(req.JWTPublicKey); err != nil {
+				http.Error(w, "jwt_public_key must be a PEM encoded RSA or ECDSA public key", http.StatusBadRequest)
+				return
+			}
+		}
+
+		for _, uri := range req.RedirectURIs {
+			parsed, err := url.Parse(uri)
+			if err != nil || !parsed.IsAbs() || parsed.Fragment != "" {
+				http.Error(w, "Redirect URIs must be absolute and have no fragment", http.StatusBadRequest)
+				return
+			}
+		}
+
+		clientID, err := generateApiKey(32)
+		if err != nil {
+			http.Error(w, "Internal server error", http.StatusInternalServerError)
+			return
+		}
+
+		var secret, secretHash string
+		if !req.Public && req.JWTPublicKey == "" {
+			secret, err = generateApiKey(64)
+			if err != nil {
+				http.Error(w, "Internal server error", http.StatusInternalServerError)
+				return
+			}
+			secretHash = storage.HashToken(secret)
+		}
+
+		err = h.Clients.CreateClient(&storage.OAuthClient{
+			ID:           clientID,
+			Name:         req.Name,
+			SecretHash:   secretHash,
+			JWTPublicKey: req.JWTPublicKey,
+			RedirectURIs: req.RedirectURIs,
+			Scopes:       req.Scopes,
+		})
+		if err != nil {
+			slog.Error("failed to register oauth client", "error", err)
+			http.Error(w, "Failed to register client", http.StatusInternalServerError)
+			return
+		}
+
+		slog.Info("oauth client registered", "client_id", clientID, "name", req.Name, "public", req.Public, "scopes", req.Scopes)
+
+		resp := map[string]interface{}{
+			"client_id":     clientID,
+			"name":          req.Name,
+			"redirect_uris": req.RedirectURIs,
+			"scopes":        req.Scopes,
+			"public":        req.Public,
+		}
+		if secret != "" {
+			resp["client_secret"] = secret
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(resp)
+	}
+}
+
+// DeleteClient removes a client. Tokens it already obtained stay valid until they expire.
+// DELETE /admin/oauth/clients/{clientId}
+func (h *OIDCHandler) DeleteClient() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		clientID := r.PathValue("clientId")
+
+		err := h.Clients.DeleteClient(clientID)
+		if err == sql.ErrNoRows {
+			http.Error(w, "Client not found", http.StatusNotFound)
+			return
+		}
+		if err != nil {
+			slog.Error("failed to delete oauth client", "error", err, "client_id", clientID)
+			http.Error(w, "Failed to delete client", http.StatusInternalServerError)
+			return
+		}
+
+		slog.Info("oauth client deleted", "client_id", clientID)
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+// parseAuthorizeRequest validates an authorization request. An unknown client or redirect URI
+// is shown to the user; anything else is reported back to the client's redirect URI.
+func (h *OIDCHandler) parseAuthorizeRequest(w http.ResponseWriter, r *http.Request, v url.Values) (*authorizeRequest, bool) {
+	client, err := h.Clients.GetClient(v.Get("client_id"))
+	if err == sql.ErrNoRows {
+		h.render(w, http.StatusBadRequest, authorizePageData{Error: "Unknown application"})
+		return nil, false
+	}
+	if err != nil {
+		slog.Error("failed to load oauth client", "error", err)
+		h.render(w, http.StatusInternalServerError, authorizePageData{Error: "Something went wrong, please try again"})
+		return nil, false
+	}
+
+	req := &authorizeRequest{
+		client:        client,
+		redirectURI:   v.Get("redirect_uri"),
+		state:         v.Get("state"),
+		nonce:         v.Get("nonce"),
+		codeChallenge: v.Get("code_challenge"),
+	}
+
+	if !client.AllowsRedirect(req.redirectURI) {
+		h.render(w, http.StatusBadRequest, authorizePageData{Error: "The application sent an invalid redirect URI"})
+		return nil, false
+	}
+
+	fail := func(code, description string) (*authorizeRequest, bool) {
+		h.redirect(w, r, req, url.Values{"error": {code}, "error_description": {description}})
+		return nil, false
+	}
+
+	if v.Get("response_type") != "code" {
+		return fail("unsupported_response_type", "Only the authorization code flow is supported")
+	}
+
+	if v.Get("code_challenge_method") != "S256" || len(req.codeChallenge) < 43 || len(req.codeChallenge) > 128 {
+		return fail("invalid_request", "PKCE with code_challenge_method S256 is required")
+	}
+
+	seen := map[string]bool{}
+	for _, scope := range strings.Fields(v.Get("scope")) {
+		if !supportedScopes[scope] {
+			return fail("invalid_scope", "Unsupported scope: "+scope)
+		}
+		if !seen[scope] {
+			seen[scope] = true
+			req.scopes = append(req.scopes, scope)
+		}
+	}
+	if !seen["openid"] {
+		return fail("invalid_scope", "The openid scope is required")
+	}
+
+	return req, true
+}
+
+func (h *OIDCHandler) pageData(r *http.Request, req *authorizeRequest) authorizePageData {
+	return authorizePageData{
+		Client: req.client,
+		Scopes: req.scopes,
+		Action: r.URL.Path,
+		Params: map[string]string{
+			"client_id":             req.client.ID,
+			"redirect_uri":          req.redirectURI,
+			"response_type":         "code",
+			"scope":                 strings.Join(req.scopes, " "),
+			"state":                 req.state,
+			"nonce":                 req.nonce,
+			"code_challenge":        req.codeChallenge,
+			"code_challenge_method": "S256",
+		},
+	}
+}
+
+// redirect sends the browser back to the client with params, state and our issuer (RFC 9207)
+func (h *OIDCHandler) redirect(w http.ResponseWriter, r *http.Request, req *authorizeRequest, params url.Values) {
+	// Registered redirect URIs are validated when the client is created
+	target, _ := url.Parse(req.redirectURI)
+	query := target.Query()
+	for k, v := range params {
+		query[k] = v
+	}
+	if req.state != "" {
+		query.Set("state", req.state)
+	}
+	query.Set("iss", h.Issuer)
+	target.RawQuery = query.Encode()
+
+	http.Redirect(w, r, target.String(), http.StatusSeeOther)
+}
+
+func (h *OIDCHandler) render(w http.ResponseWriter, status int, data authorizePageData) {
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-store")
+	w.Header().Set("X-Frame-Options", "DENY")
+	w.Header().Set("Content-Security-Policy", "default-src 'none'; style-src 'unsafe-inline'; frame-ancestors 'none'")
+	w.WriteHeader(status)
+
+	if err := authorizePage.Execute(w, data); err != nil {
+		slog.Error("failed to render authorize page", "error", err)
+	}
+}
+
+// callJSON runs one of the JSON auth handlers on behalf of a form post. The original
+// request is cloned so lockout and session tracking see the real client.
+func callJSON(next http.HandlerFunc, r *http.Request, body map[string]string) *bufferedResponse {
+	data, _ := json.Marshal(body)
+
+	inner := r.Clone(r.Context())
+	inner.Body = io.NopCloser(bytes.NewReader(data))
+	inner.ContentLength = int64(len(data))
+	inner.Header.Set("Content-Type", "application/json")
+	inner.Header.Del("Authorization")
+
+	resp := newBufferedResponse()
+	next(resp, inner)
+	return resp
+}
+
+func writeOAuthError(w http.ResponseWriter, status int, code, description string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+
+	body := map[string]string{"error": code}
+	if description != "" {
+		body["error_description"] = description
+	}
+	json.NewEncoder(w).Encode(body)
+}
@@ -0,0 +1,150 @@
+package handlers
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/ethan-mdev/authentication-server/mail"
+	"github.com/ethan-mdev/authentication-server/storage"
+)
+
+const (
+	passwordResetTTL  = 30 * time.Minute
+	minPasswordLength = 8
+)
+
+// passwordHasher is the part of central-auth's password hasher used here
+type passwordHasher interface {
+	Hash(password string) (string, error)
+}
+
+type PasswordHandler struct {
+	Users    *storage.ExtendedUserRepository
+	Sessions *storage.SessionRepository
+	Mailer   mail.Mailer
+	Hash     passwordHasher
+	ResetURL string // the reset page, receives ?token=
+}
+
+// ForgotPassword emails a single-use reset link. The response is the same whether or
+// not the address exists so it can't be used to find accounts.
+// POST /password/forgot
+func (h *PasswordHandler) ForgotPassword() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var req struct {
+			Email string `json:"email"`
+		}
+
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Email == "" {
+			http.Error(w, "Invalid request body", http.StatusBadRequest)
+			return
+		}
+
+		userID, username, err := h.Users.GetUserByEmail(req.Email)
+		if err != nil && err != sql.ErrNoRows {
+			slog.Error("failed to look up user by email", "error", err)
+			http.Error(w, "Internal server error", http.StatusInternalServerError)
+			return
+		}
+
+		if err == nil {
+			token, err := generateApiKey(64)
+			if err != nil {
+				http.Error(w, "Internal server error", http.StatusInternalServerError)
+				return
+			}
+
+			if err := h.Users.CreatePasswordResetToken(storage.HashToken(token), userID, time.Now().Add(passwordResetTTL)); err != nil {
+				slog.Error("failed to store password reset token", "error", err, "user_id", userID)
+				http.Error(w, "Internal server error", http.StatusInternalServerError)
+				return
+			}
+
+			// Sent in the background so response time doesn't reveal whether the account exists
+			go h.sendResetEmail(req.Email, username, token)
+			slog.Info("password reset requested", "user_id", userID)
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]string{
+			"message": "If that email is registered, a reset link has been sent",
+		})
+	}
+}
+
+func (h *PasswordHandler) sendResetEmail(to, username, token string) {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	link := h.ResetURL + "?token=" + url.QueryEscape(token)
+	err := h.Mailer.Send(ctx, mail.Message{
+		To:      to,
+		Subject: "Reset your password",
+		Body: "Hi " + username + ",\n\n" +
+			"Use the link below to choose a new password. It expires in 30 minutes and works once.\n\n" +
+			link + "\n\n" +
+			"If you didn't ask for this, you can ignore this email.\n",
+	})
+	if err != nil {
+		slog.Error("failed to send password reset email", "error", err)
+	}
+}
+
+// ResetPassword sets a new password with an emailed token and logs the user out everywhere
+// POST /password/reset
+func (h *PasswordHandler) ResetPassword() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var req struct {
+			Token       string `json:"token"`
+			NewPassword string `json:"new_password"`
+		}
+
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "Invalid request body", http.StatusBadRequest)
+			return
+		}
+
+		if req.Token == "" {
+			http.Error(w, "Token required", http.StatusBadRequest)
+			return
+		}
+
+		if len(req.NewPassword) < minPasswordLength {
+			http.Error(w, "Password must be at least 8 characters", http.StatusBadRequest)
+			return
+		}
+
+		passwordHash, err := h.Hash.Hash(req.NewPassword)
+		if err != nil {
+			http.Error(w, "Failed to hash password", http.StatusInternalServerError)
+			return
+		}
+
+		userID, err := h.Users.ResetPassword(storage.HashToken(req.Token), passwordHash, auditEvent(r, "user.password_reset", "user", ""))
+		if err == sql.ErrNoRows {
+			http.Error(w, "Invalid or expired token", http.StatusBadRequest)
+			return
+		}
+		if err != nil {
+			slog.Error("failed to reset password", "error", err)
+			http.Error(w, "Failed to reset password", http.StatusInternalServerError)
+			return
+		}
+
+		if _, err := h.Sessions.RevokeAllSessions(userID, "password reset", nil); err != nil {
+			slog.Error("failed to revoke sessions after password reset", "error", err, "user_id", userID)
+		}
+
+		slog.Info("password reset", "user_id", userID)
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]string{
+			"message": "Password reset successfully",
+		})
+	}
+}
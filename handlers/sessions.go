@@ -0,0 +1,263 @@
+package handlers
+
+import (
+	"database/sql"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+
+	"github.com/ethan-mdev/authentication-server/storage"
+	"github.com/ethan-mdev/central-auth/middleware"
+)
+
+// SessionHandler wraps the central-auth token endpoints to track refresh token families
+type SessionHandler struct {
+	Sessions *storage.SessionRepository
+}
+
+func clientMeta(r *http.Request) storage.ClientMeta {
+	return storage.ClientMeta{
+		UserAgent: r.UserAgent(),
+		IPAddress: clientIP(r),
+	}
+}
+
+// Login starts a new refresh token family for every successful login. The tokens are withheld
+// if that fails, since a session outside any family can't be listed or revoked.
+// POST /login
+func (h *SessionHandler) Login(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		resp := newBufferedResponse()
+		next(resp, r)
+
+		if tokens, ok := resp.tokens(); ok {
+			if _, err := h.Sessions.StartFamily(tokens.RefreshToken, "", clientMeta(r)); err != nil {
+				slog.Error("failed to start refresh token family", "error", err)
+				http.Error(w, "Internal server error", http.StatusInternalServerError)
+				return
+			}
+		}
+
+		resp.flush(w)
+	}
+}
+
+// Refresh rejects refresh tokens that were already rotated. A reused token means it leaked,
+// so the whole family is revoked and the legitimate client has to log in again.
+// POST /refresh
+func (h *SessionHandler) Refresh(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		body, err := peekBody(r)
+		if err != nil {
+			http.Error(w, "Invalid request body", http.StatusBadRequest)
+			return
+		}
+
+		var req struct {
+			RefreshToken string `json:"refresh_token"`
+		}
+		json.Unmarshal(body, &req)
+		if req.RefreshToken == "" {
+			next(w, r)
+			return
+		}
+
+		presentedHash := storage.HashToken(req.RefreshToken)
+		record, err := h.Sessions.GetRefreshToken(presentedHash)
+		if err != nil && err != sql.ErrNoRows {
+			slog.Error("failed to look up refresh token", "error", err)
+			http.Error(w, "Internal server error", http.StatusInternalServerError)
+			return
+		}
+
+		if record != nil && record.FamilyRevoked {
+			http.Error(w, "Invalid refresh token", http.StatusUnauthorized)
+			return
+		}
+
+		// Sessions handed to an OAuth client are refreshed at /oauth/token, where the client authenticates
+		if record != nil && record.ClientID != "" {
+			slog.Warn("security event: oauth refresh token presented at /refresh",
+				"event", "refresh_token_client_mismatch",
+				"user_id", record.UserID,
+				"family_id", record.FamilyID,
+				"client_id", record.ClientID,
+				"ip", clientIP(r),
+			)
+			http.Error(w, "Invalid refresh token", http.StatusUnauthorized)
+			return
+		}
+
+		if record != nil && record.Rotated {
+			h.revokeReusedFamily(r, record.FamilyID, record.UserID)
+			http.Error(w, "Invalid refresh token", http.StatusUnauthorized)
+			return
+		}
+
+		resp := newBufferedResponse()
+		next(resp, r)
+
+		if tokens, ok := resp.tokens(); ok {
+			if record == nil {
+				// Token predates family tracking - adopt it into a new family
+				_, err = h.Sessions.StartFamily(tokens.RefreshToken, presentedHash, clientMeta(r))
+			} else {
+				err = h.Sessions.RecordRotation(presentedHash, tokens.RefreshToken, clientMeta(r))
+			}
+
+			if err == storage.ErrRefreshTokenReused {
+				// Lost a race with another request presenting the same token
+				h.revokeReusedFamily(r, record.FamilyID, record.UserID)
+				http.Error(w, "Invalid refresh token", http.StatusUnauthorized)
+				return
+			}
+			if err != nil {
+				slog.Error("failed to record refresh token rotation", "error", err)
+			}
+		}
+
+		resp.flush(w)
+	}
+}
+
+func (h *SessionHandler) revokeReusedFamily(r *http.Request, familyID, userID string) {
+	slog.Warn("security event: refresh token reuse detected, revoking family",
+		"event", "refresh_token_reuse",
+		"user_id", userID,
+		"family_id", familyID,
+		"ip", clientIP(r),
+		"user_agent", r.UserAgent(),
+	)
+
+	if err := h.Sessions.RevokeFamily(familyID, "refresh token reuse"); err != nil {
+		slog.Error("failed to revoke refresh token family", "error", err, "family_id", familyID)
+	}
+}
+
+// userIDFunc picks whose sessions a request is about
+type userIDFunc func(r *http.Request) (string, bool)
+
+// ownUserID is the authenticated user
+func ownUserID(r *http.Request) (string, bool) {
+	claims, ok := middleware.GetClaims(r.Context())
+	if !ok {
+		return "", false
+	}
+	return claims.UserID, true
+}
+
+// pathUserID is the {userId} in an admin route
+func pathUserID(r *http.Request) (string, bool) {
+	userID := r.PathValue("userId")
+	return userID, userID != ""
+}
+
+// ListSessions returns the caller's active logins
+// GET /sessions (requires auth)
+func (h *SessionHandler) ListSessions() http.HandlerFunc {
+	return h.listSessions(ownUserID)
+}
+
+// AdminListSessions returns any user's active logins (admin only)
+// GET /admin/users/{userId}/sessions
+func (h *SessionHandler) AdminListSessions() http.HandlerFunc {
+	return h.listSessions(pathUserID)
+}
+
+func (h *SessionHandler) listSessions(userIDFor userIDFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		userID, ok := userIDFor(r)
+		if !ok {
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+
+		sessions, err := h.Sessions.ListActiveSessions(userID)
+		if err != nil {
+			slog.Error("failed to list sessions", "error", err, "user_id", userID)
+			http.Error(w, "Failed to fetch sessions", http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(sessions)
+	}
+}
+
+// RevokeSession logs out one of the caller's sessions. Its access token stays valid until it expires.
+// DELETE /sessions/{id} (requires auth)
+func (h *SessionHandler) RevokeSession() http.HandlerFunc {
+	return h.revokeSession(ownUserID, "session.revoke", "revoked by user")
+}
+
+// AdminRevokeSession logs out one of any user's sessions (admin only)
+// DELETE /admin/users/{userId}/sessions/{id}
+func (h *SessionHandler) AdminRevokeSession() http.HandlerFunc {
+	return h.revokeSession(pathUserID, "session.admin_revoke", "revoked by admin")
+}
+
+func (h *SessionHandler) revokeSession(userIDFor userIDFunc, action, reason string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		userID, ok := userIDFor(r)
+		if !ok {
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+
+		sessionID := r.PathValue("id")
+		err := h.Sessions.RevokeSession(userID, sessionID, reason, auditEvent(r, action, "user", userID))
+		if err == sql.ErrNoRows {
+			http.Error(w, "Session not found", http.StatusNotFound)
+			return
+		}
+		if err != nil {
+			slog.Error("failed to revoke session", "error", err, "user_id", userID, "session_id", sessionID)
+			http.Error(w, "Failed to revoke session", http.StatusInternalServerError)
+			return
+		}
+
+		slog.Info("session revoked", "user_id", userID, "session_id", sessionID, "reason", reason)
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]string{
+			"message": "Session revoked successfully",
+		})
+	}
+}
+
+// LogoutAll revokes every refresh token the caller holds (forum, portal and launcher)
+// POST /logout-all (requires auth)
+func (h *SessionHandler) LogoutAll() http.HandlerFunc {
+	return h.logoutAll(ownUserID, "session.logout_all", "logout all by user")
+}
+
+// AdminLogoutAll locks a compromised account out of every service (admin only)
+// POST /admin/users/{userId}/logout-all
+func (h *SessionHandler) AdminLogoutAll() http.HandlerFunc {
+	return h.logoutAll(pathUserID, "session.admin_logout_all", "logout all by admin")
+}
+
+func (h *SessionHandler) logoutAll(userIDFor userIDFunc, action, reason string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		userID, ok := userIDFor(r)
+		if !ok {
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+
+		revoked, err := h.Sessions.RevokeAllSessions(userID, reason, auditEvent(r, action, "user", userID))
+		if err != nil {
+			slog.Error("failed to revoke sessions", "error", err, "user_id", userID)
+			http.Error(w, "Failed to revoke sessions", http.StatusInternalServerError)
+			return
+		}
+
+		slog.Info("all sessions revoked", "user_id", userID, "revoked", revoked, "reason", reason)
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"message": "Logged out of all sessions",
+			"revoked": revoked,
+		})
+	}
+}
@@ -0,0 +1,84 @@
+package handlers
+
+import (
+	"database/sql"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/ethan-mdev/authentication-server/storage"
+	_ "github.com/lib/pq"
+)
+
+// openTestDB connects to the database in TEST_DATABASE_URL, which must have schema/init.sql applied
+func openTestDB(t *testing.T) *sql.DB {
+	t.Helper()
+
+	url := os.Getenv("TEST_DATABASE_URL")
+	if url == "" {
+		t.Skip("TEST_DATABASE_URL not set")
+	}
+
+	db, err := sql.Open("postgres", url)
+	if err != nil {
+		t.Fatalf("open database: %v", err)
+	}
+	if err := db.Ping(); err != nil {
+		t.Fatalf("ping database: %v", err)
+	}
+	t.Cleanup(func() { db.Close() })
+	return db
+}
+
+func TestRefreshRejectsOAuthClientSessions(t *testing.T) {
+	db := openTestDB(t)
+	sessions := storage.NewSessionRepository(db)
+
+	userID := fmt.Sprintf("refreshtest-%d", os.Getpid())
+	token := userID + "-token"
+	t.Cleanup(func() {
+		db.Exec(`DELETE FROM public.refresh_token_lineage WHERE user_id = $1`, userID)
+		db.Exec(`DELETE FROM public.refresh_token_families WHERE user_id = $1`, userID)
+		db.Exec(`DELETE FROM public.users WHERE id = $1`, userID)
+	})
+
+	_, err := db.Exec(`
+		INSERT INTO public.users (id, username, email, password)
+		VALUES ($1, $1, $1 || '@example.com', 'x')
+	`, userID)
+	if err != nil {
+		t.Fatalf("create user: %v", err)
+	}
+	_, err = db.Exec(`
+		INSERT INTO public.refresh_tokens (token, user_id, expires_at)
+		VALUES ($1, $2, $3)
+	`, token, userID, time.Now().Add(time.Hour))
+	if err != nil {
+		t.Fatalf("create refresh token: %v", err)
+	}
+
+	familyID, err := sessions.StartFamily(token, "", storage.ClientMeta{})
+	if err != nil {
+		t.Fatalf("start family: %v", err)
+	}
+	if err := sessions.BindFamilyClient(familyID, "refreshtest-client"); err != nil {
+		t.Fatalf("bind family: %v", err)
+	}
+
+	h := &SessionHandler{Sessions: sessions}
+	refresh := h.Refresh(func(w http.ResponseWriter, r *http.Request) {
+		t.Error("token of an OAuth client session was passed on to /refresh")
+	})
+
+	req := httptest.NewRequest(http.MethodPost, "/refresh", strings.NewReader(`{"refresh_token":"`+token+`"}`))
+	rec := httptest.NewRecorder()
+	refresh(rec, req)
+
+	if rec.Code != http.StatusUnauthorized {
+		t.Fatalf("got status %d, want %d", rec.Code, http.StatusUnauthorized)
+	}
+}
@@ -0,0 +1,212 @@
+package handlers
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/ethan-mdev/authentication-server/storage"
+	"github.com/ethan-mdev/central-auth/middleware"
+)
+
+const maxAdjustmentReasonLength = 500
+
+// WalletHandler shows users where their balance came from
+type WalletHandler struct {
+	Users *storage.ExtendedUserRepository
+}
+
+// ListTransactions returns the caller's balance ledger, newest first.
+// Query: limit, cursor (next_cursor of the previous page)
+// GET /wallet/transactions
+func (h *WalletHandler) ListTransactions() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		claims, ok := middleware.GetClaims(r.Context())
+		if !ok {
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+
+		writeLedgerPage(w, r, h.Users, claims.UserID)
+	}
+}
+
+// ListTransactions returns a user's balance ledger, newest first (admin only).
+// Query: limit, cursor (next_cursor of the previous page)
+// GET /admin/users/{userId}/transactions
+func (h *AdminHandler) ListTransactions() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		writeLedgerPage(w, r, h.Users, r.PathValue("userId"))
+	}
+}
+
+func writeLedgerPage(w http.ResponseWriter, r *http.Request, users *storage.ExtendedUserRepository, userID string) {
+	limit := 50
+	if v := r.URL.Query().Get("limit"); v != "" {
+		var err error
+		limit, err = strconv.Atoi(v)
+		if err != nil || limit < 1 || limit > 200 {
+			http.Error(w, "Invalid limit", http.StatusBadRequest)
+			return
+		}
+	}
+
+	page, err := users.ListLedger(userID, r.URL.Query().Get("cursor"), limit)
+	if errors.Is(err, storage.ErrInvalidCursor) {
+		http.Error(w, "Invalid cursor", http.StatusBadRequest)
+		return
+	}
+	if err != nil {
+		slog.Error("failed to list ledger entries", "error", err, "user_id", userID)
+		http.Error(w, "Failed to fetch transactions", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(page)
+}
+
+// AdjustBalance grants (positive amount) or deducts (negative amount) credits (admin only)
+// POST /admin/users/{userId}/balance
+func (h *AdminHandler) AdjustBalance() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		claims, ok := middleware.GetClaims(r.Context())
+		if !ok {
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+
+		var req struct {
+			Amount int    `json:"amount"`
+			Reason string `json:"reason"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "Invalid request body", http.StatusBadRequest)
+			return
+		}
+
+		if req.Amount == 0 {
+			http.Error(w, "amount must not be zero", http.StatusBadRequest)
+			return
+		}
+		req.Reason = strings.TrimSpace(req.Reason)
+		if req.Reason == "" || len(req.Reason) > maxAdjustmentReasonLength {
+			http.Error(w, "A reason of up to 500 characters is required", http.StatusBadRequest)
+			return
+		}
+
+		userID := r.PathValue("userId")
+		entry, err := h.Users.AdjustBalance(userID, req.Amount, req.Reason, claims.UserID, auditEvent(r, "user.balance_adjust", "user", userID))
+		if err == sql.ErrNoRows {
+			http.Error(w, "User not found", http.StatusNotFound)
+			return
+		}
+		if errors.Is(err, storage.ErrInsufficientBalance) {
+			http.Error(w, "Deduction exceeds the user's balance", http.StatusConflict)
+			return
+		}
+		if err != nil {
+			slog.Error("failed to adjust balance", "error", err, "user_id", userID)
+			http.Error(w, "Failed to adjust balance", http.StatusInternalServerError)
+			return
+		}
+
+		slog.Info("balance adjusted", "user_id", userID, "admin_id", claims.UserID, "amount", entry.Amount, "new_balance", entry.BalanceAfter)
+
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(entry)
+	}
+}
+
+// maxBalanceDrift is how many drifted balances ListBalanceDrift and CheckBalanceDrift report
+const maxBalanceDrift = 500
+
+// ListBalanceDrift returns users whose balance differs from their ledger (admin only)
+// GET /admin/balances/drift
+func (h *AdminHandler) ListBalanceDrift() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		drifts, err := h.Users.ListBalanceDrift(maxBalanceDrift)
+		if err != nil {
+			slog.Error("failed to list balance drift", "error", err)
+			http.Error(w, "Failed to fetch balance drift", http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(drifts)
+	}
+}
+
+// ResolveBalanceDrift settles a user's balance drift (admin only). "accept" keeps the balance
+// and books the difference in the ledger, "revert" puts the balance back to the ledger's sum.
+// POST /admin/users/{userId}/balance/drift
+func (h *AdminHandler) ResolveBalanceDrift() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		claims, ok := middleware.GetClaims(r.Context())
+		if !ok {
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+
+		var req struct {
+			Action string `json:"action"`
+			Reason string `json:"reason"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "Invalid request body", http.StatusBadRequest)
+			return
+		}
+
+		if req.Action != "accept" && req.Action != "revert" {
+			http.Error(w, `action must be "accept" or "revert"`, http.StatusBadRequest)
+			return
+		}
+		req.Reason = strings.TrimSpace(req.Reason)
+		if req.Reason == "" || len(req.Reason) > maxAdjustmentReasonLength {
+			http.Error(w, "A reason of up to 500 characters is required", http.StatusBadRequest)
+			return
+		}
+
+		userID := r.PathValue("userId")
+		drift, err := h.Users.ResolveBalanceDrift(userID, req.Action == "accept", req.Reason, claims.UserID,
+			auditEvent(r, "user.balance_drift_"+req.Action, "user", userID))
+		if err == sql.ErrNoRows {
+			http.Error(w, "User not found", http.StatusNotFound)
+			return
+		}
+		if errors.Is(err, storage.ErrNoBalanceDrift) {
+			http.Error(w, "Balance matches the ledger", http.StatusConflict)
+			return
+		}
+		if err != nil {
+			slog.Error("failed to resolve balance drift", "error", err, "user_id", userID)
+			http.Error(w, "Failed to resolve balance drift", http.StatusInternalServerError)
+			return
+		}
+
+		slog.Info("balance drift resolved", "user_id", userID, "admin_id", claims.UserID, "action", req.Action, "difference", drift.Difference)
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(drift)
+	}
+}
+
+// CheckBalanceDrift alerts on balances changed without a ledger entry. Nothing in this service
+// should do that, so the change may be unauthorized; it's left for an admin to resolve rather
+// than booked automatically. Run periodically.
+func (h *AdminHandler) CheckBalanceDrift() error {
+	drifts, err := h.Users.ListBalanceDrift(maxBalanceDrift)
+	if err != nil {
+		return err
+	}
+	for _, d := range drifts {
+		slog.Error("security event: balance differs from ledger", "event", "balance_drift",
+			"user_id", d.UserID, "balance", d.Balance, "ledger_balance", d.LedgerBalance, "difference", d.Difference)
+	}
+	return nil
+}
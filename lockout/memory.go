@@ -0,0 +1,91 @@
+package lockout
+
+import (
+	"context"
+	"sort"
+	"sync"
+	"time"
+)
+
+type memoryEntry struct {
+	failures    int
+	lastFailure time.Time
+	lockedUntil time.Time
+}
+
+// MemoryStore keeps counters in process memory
+type MemoryStore struct {
+	mu      sync.Mutex
+	entries map[string]*memoryEntry
+}
+
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{entries: map[string]*memoryEntry{}}
+}
+
+func (s *MemoryStore) Locked(ctx context.Context, key string) (time.Duration, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	e, ok := s.entries[key]
+	if !ok {
+		return 0, nil
+	}
+	return max(time.Until(e.lockedUntil), 0), nil
+}
+
+func (s *MemoryStore) Fail(ctx context.Context, key string, policy Policy) (time.Duration, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now()
+	e, ok := s.entries[key]
+	if !ok || now.Sub(e.lastFailure) > policy.Window {
+		e = &memoryEntry{}
+		s.entries[key] = e
+	}
+
+	e.failures++
+	e.lastFailure = now
+
+	lock := policy.LockFor(e.failures)
+	if lock > 0 {
+		e.lockedUntil = now.Add(lock)
+	}
+
+	s.prune(now, policy.Window)
+	return lock, nil
+}
+
+func (s *MemoryStore) Reset(ctx context.Context, key string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	delete(s.entries, key)
+	return nil
+}
+
+func (s *MemoryStore) ListLocked(ctx context.Context) ([]Entry, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now()
+	entries := []Entry{}
+	for key, e := range s.entries {
+		if e.lockedUntil.After(now) {
+			entries = append(entries, Entry{Key: key, Failures: e.failures, LockedUntil: e.lockedUntil})
+		}
+	}
+
+	sort.Slice(entries, func(i, j int) bool { return entries[i].LockedUntil.After(entries[j].LockedUntil) })
+	return entries, nil
+}
+
+// prune drops idle, unlocked entries so memory doesn't grow forever
+func (s *MemoryStore) prune(now time.Time, window time.Duration) {
+	for key, e := range s.entries {
+		if now.Sub(e.lastFailure) > window && now.After(e.lockedUntil) {
+			delete(s.entries, key)
+		}
+	}
+}
@@ -0,0 +1,114 @@
+package lockout
+
+import (
+	"context"
+	"database/sql"
+	"time"
+)
+
+// PostgresStore keeps counters in public.login_failures so every replica sees the same lockouts
+type PostgresStore struct {
+	db *sql.DB
+}
+
+func NewPostgresStore(db *sql.DB) *PostgresStore {
+	return &PostgresStore{db: db}
+}
+
+func (s *PostgresStore) Locked(ctx context.Context, key string) (time.Duration, error) {
+	var seconds float64
+	err := s.db.QueryRowContext(ctx, `
+		SELECT EXTRACT(EPOCH FROM locked_until - NOW())
+		FROM public.login_failures
+		WHERE key = $1 AND locked_until > NOW()
+	`, key).Scan(&seconds)
+	if err == sql.ErrNoRows {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	return time.Duration(seconds * float64(time.Second)), nil
+}
+
+func (s *PostgresStore) Fail(ctx context.Context, key string, policy Policy) (time.Duration, error) {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	// Counter restarts when the last failure is older than the window
+	var failures int
+	err = tx.QueryRowContext(ctx, `
+		INSERT INTO public.login_failures (key, failures, last_failure_at)
+		VALUES ($1, 1, NOW())
+		ON CONFLICT (key) DO UPDATE
+		SET failures = CASE
+				WHEN public.login_failures.last_failure_at < NOW() - make_interval(secs => $2) THEN 1
+				ELSE public.login_failures.failures + 1
+			END,
+			last_failure_at = NOW()
+		RETURNING failures
+	`, key, policy.Window.Seconds()).Scan(&failures)
+	if err != nil {
+		return 0, err
+	}
+
+	lock := policy.LockFor(failures)
+	if lock > 0 {
+		_, err = tx.ExecContext(ctx, `
+			UPDATE public.login_failures
+			SET locked_until = NOW() + make_interval(secs => $1)
+			WHERE key = $2
+		`, lock.Seconds(), key)
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	return lock, tx.Commit()
+}
+
+func (s *PostgresStore) Reset(ctx context.Context, key string) error {
+	_, err := s.db.ExecContext(ctx, `DELETE FROM public.login_failures WHERE key = $1`, key)
+	return err
+}
+
+// Purge removes idle, unlocked counters like MemoryStore's prune. window should be the longest
+// policy Window, after which a counter would restart anyway.
+func (s *PostgresStore) Purge(ctx context.Context, window time.Duration) (int64, error) {
+	result, err := s.db.ExecContext(ctx, `
+		DELETE FROM public.login_failures
+		WHERE last_failure_at < NOW() - make_interval(secs => $1)
+		  AND (locked_until IS NULL OR locked_until <= NOW())
+	`, window.Seconds())
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected()
+}
+
+func (s *PostgresStore) ListLocked(ctx context.Context) ([]Entry, error) {
+	rows, err := s.db.QueryContext(ctx, `
+		SELECT key, failures, locked_until
+		FROM public.login_failures
+		WHERE locked_until > NOW()
+		ORDER BY locked_until DESC
+	`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	entries := []Entry{}
+	for rows.Next() {
+		var e Entry
+		if err := rows.Scan(&e.Key, &e.Failures, &e.LockedUntil); err != nil {
+			return nil, err
+		}
+		entries = append(entries, e)
+	}
+
+	return entries, rows.Err()
+}
@@ -0,0 +1,99 @@
+// Package mail sends transactional email (password resets, verification links)
+package mail
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/smtp"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+type Message struct {
+	To      string
+	Subject string
+	Body    string // plain text
+}
+
+// Mailer delivers a message
+type Mailer interface {
+	Send(ctx context.Context, msg Message) error
+}
+
+// SMTPMailer sends through an SMTP server using PLAIN auth when a username is set
+type SMTPMailer struct {
+	Host     string
+	Port     string
+	Username string
+	Password string
+	From     string
+}
+
+func (m *SMTPMailer) Send(ctx context.Context, msg Message) error {
+	var auth smtp.Auth
+	if m.Username != "" {
+		auth = smtp.PlainAuth("", m.Username, m.Password, m.Host)
+	}
+
+	var b strings.Builder
+	fmt.Fprintf(&b, "From: %s\r\n", m.From)
+	fmt.Fprintf(&b, "To: %s\r\n", msg.To)
+	fmt.Fprintf(&b, "Subject: %s\r\n", msg.Subject)
+	fmt.Fprintf(&b, "Date: %s\r\n", time.Now().Format(time.RFC1123Z))
+	b.WriteString("MIME-Version: 1.0\r\n")
+	b.WriteString("Content-Type: text/plain; charset=UTF-8\r\n\r\n")
+	b.WriteString(strings.ReplaceAll(msg.Body, "\n", "\r\n"))
+
+	done := make(chan error, 1)
+	go func() {
+		done <- smtp.SendMail(m.Host+":"+m.Port, auth, m.From, []string{msg.To}, []byte(b.String()))
+	}()
+
+	select {
+	case err := <-done:
+		return err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// LogMailer doesn't send anything. Messages are appended as JSON lines to Path. When Path is
+// empty only the recipient and subject are logged, since bodies hold reset and verification links.
+// For local development and tests.
+type LogMailer struct {
+	Path string
+	mu   sync.Mutex
+}
+
+func (m *LogMailer) Send(ctx context.Context, msg Message) error {
+	if m.Path == "" {
+		slog.Info("mail (not sent)", "to", msg.To, "subject", msg.Subject)
+		return nil
+	}
+
+	line, err := json.Marshal(map[string]string{
+		"to":      msg.To,
+		"subject": msg.Subject,
+		"body":    msg.Body,
+		"sent_at": time.Now().Format(time.RFC3339),
+	})
+	if err != nil {
+		return err
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	f, err := os.OpenFile(m.Path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	_, err = f.Write(append(line, '\n'))
+	return err
+}
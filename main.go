@@ -10,8 +10,15 @@ import (
 	"syscall"
 	"time"
 
+	"github.com/ethan-mdev/authentication-server/botsign"
 	"github.com/ethan-mdev/authentication-server/config"
 	"github.com/ethan-mdev/authentication-server/handlers"
+	"github.com/ethan-mdev/authentication-server/keyring"
+	"github.com/ethan-mdev/authentication-server/lockout"
+	"github.com/ethan-mdev/authentication-server/mail"
+	"github.com/ethan-mdev/authentication-server/outbox"
+	"github.com/ethan-mdev/authentication-server/ratelimit"
+	"github.com/ethan-mdev/authentication-server/scheduler"
 	localstore "github.com/ethan-mdev/authentication-server/storage"
 
 	_ "github.com/lib/pq"
@@ -19,13 +26,14 @@ import (
 	"github.com/rs/cors"
 
 	authhttp "github.com/ethan-mdev/central-auth/http"
-	"github.com/ethan-mdev/central-auth/jwt"
 	"github.com/ethan-mdev/central-auth/middleware"
 	"github.com/ethan-mdev/central-auth/password"
 	"github.com/ethan-mdev/central-auth/storage"
 	"github.com/ethan-mdev/central-auth/tokens"
 )
 
+const accessExpiry = 15 * time.Minute
+
 func main() {
 	// Setup structured logging
 	logger := slog.New(slog.NewJSONHandler(os.Stdout, nil))
@@ -83,85 +91,465 @@ func main() {
 	baseUsers := storage.NewPostgresUserRepository(db)
 	users := localstore.NewExtendedUserRepository(baseUsers, db)
 	refreshTokens := tokens.NewPostgresRefreshRepository(db)
+	sessions := localstore.NewSessionRepository(db)
+	mfa, err := localstore.NewMFARepository(db, cfg.MFASecretKey)
+	if err != nil {
+		slog.Error("MFA_SECRET_KEY is required to encrypt TOTP secrets", "error", err)
+		os.Exit(1)
+	}
+	if n, err := mfa.EncryptStoredTOTPSecrets(); err != nil {
+		slog.Error("failed to encrypt stored TOTP secrets", "error", err)
+		os.Exit(1)
+	} else if n > 0 {
+		slog.Info("encrypted stored TOTP secrets", "count", n)
+	}
+	oauthClients := localstore.NewOAuthRepository(db)
+	auditLog := localstore.NewAuditRepository(db)
+
+	var lockouts lockout.Store
+	switch cfg.LockoutStore {
+	case "postgres":
+		lockouts = lockout.NewPostgresStore(db)
+	case "memory":
+		lockouts = lockout.NewMemoryStore()
+	default:
+		slog.Error("unknown lockout store", "store", cfg.LockoutStore)
+		os.Exit(1)
+	}
 
-	// JWT
-	privateKey, err := jwt.LoadPrivateKey([]byte(cfg.JWTPrivateKey))
+	// JWT signing keys
+	if cfg.JWTKeyRotationInterval > 0 && cfg.JWTKeysDir == "" {
+		slog.Error("JWT_KEY_ROTATION_INTERVAL requires JWT_KEYS_DIR")
+		os.Exit(1)
+	}
+	keys, err := keyring.New(cfg.JWTKeysDir, cfg.JWTPrivateKey, accessExpiry)
 	if err != nil {
-		slog.Error("failed to load private key", "error", err)
+		slog.Error("failed to load signing keys", "error", err)
+		os.Exit(1)
+	}
+	slog.Info("loaded signing keys", "count", len(keys.Keys()), "current_kid", keys.Current().ID)
+	keys.Revocations = sessions
+
+	// Rate limits per route group
+	var limiterStore ratelimit.Store
+	switch cfg.RateLimitStore {
+	case "postgres":
+		limiterStore = ratelimit.NewPostgresStore(db)
+	case "memory":
+		limiterStore = ratelimit.NewMemoryStore()
+	default:
+		slog.Error("unknown rate limit store", "store", cfg.RateLimitStore)
 		os.Exit(1)
 	}
 
-	jwtManager, err := jwt.NewManager(jwt.Config{
-		Algorithm:  "RS256",
-		PrivateKey: privateKey,
-		KeyID:      "key-1",
-	})
+	// Nonces of signed bot requests
+	var botNonces botsign.NonceStore
+	switch cfg.BotNonceStore {
+	case "postgres":
+		botNonces = botsign.NewPostgresStore(db)
+	case "memory":
+		botNonces = botsign.NewMemoryStore()
+	default:
+		slog.Error("unknown bot nonce store", "store", cfg.BotNonceStore)
+		os.Exit(1)
+	}
+	botSigner := botsign.New(botNonces, cfg.BotSigningSecret, cfg.BotSigningSecretOld)
+	switch {
+	case cfg.BotSigningSecret != "" && cfg.BotSigningSecret == cfg.BotSharedSecret:
+		// BOT_SHARED_SECRET went over the wire in X-Bot-Secret, so it can't serve as a signing key
+		slog.Error("BOT_SIGNING_SECRET must be a new secret, not BOT_SHARED_SECRET")
+		os.Exit(1)
+	case botSigner == nil && cfg.BotSharedSecret != "":
+		slog.Error("BOT_SIGNING_SECRET not set, bot notifications are disabled; generate a new secret, BOT_SHARED_SECRET is not used for signing")
+	case botSigner == nil:
+		slog.Warn("BOT_SIGNING_SECRET not set, bot requests need a service token and bot notifications are disabled")
+	}
+
+	rateLimits := map[string]ratelimit.Limit{
+		"login":    {Requests: 10, Period: time.Minute},
+		"register": {Requests: 5, Period: time.Hour},
+		"password": {Requests: 5, Period: time.Hour},
+		"email":    {Requests: 5, Period: time.Hour},
+		"bot":      {Requests: 60, Period: time.Minute},
+		"ticket":   {Requests: 30, Period: time.Minute},
+		"voucher":  {Requests: 10, Period: 10 * time.Minute},
+		"unstuck":  {Requests: 3, Period: 10 * time.Minute},
+		"device":   {Requests: 10, Period: time.Minute},
+	}
+	overrides, err := ratelimit.ParseLimits(cfg.RateLimits)
 	if err != nil {
-		slog.Error("failed to create jwt manager", "error", err)
+		slog.Error("invalid RATE_LIMITS", "error", err)
+		os.Exit(1)
+	}
+	for name, limit := range overrides {
+		rateLimits[name] = limit
+	}
+
+	limit := func(name string, key ratelimit.KeyFunc) *ratelimit.Limiter {
+		return &ratelimit.Limiter{Store: limiterStore, Name: name, Limit: rateLimits[name], Key: key}
+	}
+	loginLimit := limit("login", ratelimit.ByIP)
+	registerLimit := limit("register", ratelimit.ByIP)
+	passwordLimit := limit("password", ratelimit.ByIP)
+	emailLimit := limit("email", ratelimit.ByUser)
+	botLimit := limit("bot", ratelimit.ByBot)
+	ticketLimit := limit("ticket", ratelimit.ByUser)
+	voucherLimit := limit("voucher", ratelimit.ByUser)
+	unstuckLimit := limit("unstuck", ratelimit.ByUser)
+	deviceLimit := limit("device", ratelimit.ByUser)
+
+	// Mail
+	var mailer mail.Mailer
+	switch cfg.MailDriver {
+	case "smtp":
+		mailer = &mail.SMTPMailer{
+			Host:     cfg.SMTPHost,
+			Port:     cfg.SMTPPort,
+			Username: cfg.SMTPUsername,
+			Password: cfg.SMTPPassword,
+			From:     cfg.MailFrom,
+		}
+	case "log":
+		if cfg.MailLogFile == "" {
+			slog.Error("MAIL_LOG_FILE is required with MAIL_DRIVER=log")
+			os.Exit(1)
+		}
+		mailer = &mail.LogMailer{Path: cfg.MailLogFile}
+	case "":
+		slog.Warn("MAIL_DRIVER not set, password reset and email verification are disabled")
+	default:
+		slog.Error("unknown mail driver", "driver", cfg.MailDriver)
 		os.Exit(1)
 	}
 
 	// Handlers
+	passwordHasher := password.Default()
+
 	authHandler := &authhttp.AuthHandler{
 		Users:         baseUsers,
 		RefreshTokens: refreshTokens,
-		Hash:          password.Default(),
-		JWT:           jwtManager,
-		AccessExpiry:  15 * time.Minute,
+		Hash:          passwordHasher,
+		JWT:           keys.Manager(),
+		AccessExpiry:  accessExpiry,
 		RefreshExpiry: 7 * 24 * time.Hour,
 	}
 
+	loginGuard := &handlers.LoginGuard{
+		Store: lockouts,
+		Audit: auditLog,
+	}
+
+	sessionHandler := &handlers.SessionHandler{
+		Sessions: sessions,
+	}
+
+	mfaHandler := &handlers.MFAHandler{
+		MFA:      mfa,
+		Sessions: sessions,
+		Users:    users,
+		Lockouts: lockouts,
+		Issuer:   cfg.MFAIssuer,
+	}
+
+	passwordHandler := &handlers.PasswordHandler{
+		Users:    users,
+		Sessions: sessions,
+		Mailer:   mailer,
+		Hash:     passwordHasher,
+		ResetURL: cfg.PasswordResetURL,
+	}
+
+	// Email verification needs a link signing key. Without one it stays off, unless
+	// something depends on it.
+	emailVerification := cfg.EmailVerifySecret != ""
+	if emailVerification && mailer == nil {
+		slog.Error("EMAIL_VERIFY_SECRET needs a MAIL_DRIVER to send verification links")
+		os.Exit(1)
+	}
+	if !emailVerification {
+		if cfg.RequireVerifiedEmail || cfg.MailDriver == "smtp" {
+			slog.Error("EMAIL_VERIFY_SECRET is required with REQUIRE_VERIFIED_EMAIL or MAIL_DRIVER=smtp")
+			os.Exit(1)
+		}
+		slog.Warn("EMAIL_VERIFY_SECRET not set, email verification is disabled")
+	}
+
+	emailHandler := &handlers.EmailVerificationHandler{
+		Users:     users,
+		Mailer:    mailer,
+		Secret:    []byte(cfg.EmailVerifySecret),
+		VerifyURL: cfg.EmailVerifyURL,
+		Required:  cfg.RequireVerifiedEmail,
+	}
+
 	profileHandler := &handlers.ProfileHandler{
 		Users: users,
 	}
 
-	gameHandler := handlers.NewGameHandler(users, gameAccountDB, gameCharacterDB)
+	walletHandler := &handlers.WalletHandler{
+		Users: users,
+	}
+
+	gameHandler := handlers.NewGameHandler(users, gameAccountDB, gameCharacterDB, cfg.GameServerSecret, auditLog)
 
-	discordHandler := handlers.NewDiscordHandler(users, gameAccountDB, cfg.BotSharedSecret, cfg.BotWebhookURL)
+	discordHandler := handlers.NewDiscordHandler(users, gameAccountDB, keys, botSigner, cfg.BotSharedSecret, cfg.BotWebhookURL, auditLog)
 
 	adminHandler := &handlers.AdminHandler{
-		Users: users,
+		Users:    users,
+		Sessions: sessions,
+		Keys:     keys,
+		Audit:    auditLog,
+	}
+	if cfg.GameBlockBanned {
+		adminHandler.GameDB = gameAccountDB
+	}
+
+	banGuard := &handlers.BanGuard{
+		Users:    users,
+		Sessions: sessions,
+	}
+
+	// Login chains, shared by the JSON API and the OpenID Connect sign-in page
+	login := loginGuard.Login(sessionHandler.Login(mfaHandler.Login(banGuard.Check(keys.Handler(authHandler, (*authhttp.AuthHandler).Login)))))
+	completeMFALogin := loginGuard.ByIP(sessionHandler.Login(banGuard.Check(mfaHandler.CompleteLogin())))
+	refresh := loginGuard.ByIP(sessionHandler.Refresh(banGuard.Check(keys.Handler(authHandler, (*authhttp.AuthHandler).RefreshToken))))
+
+	oidcHandler := &handlers.OIDCHandler{
+		Clients:       oauthClients,
+		Users:         users,
+		Sessions:      sessions,
+		Keys:          keys,
+		Issuer:        cfg.OIDCIssuer,
+		AccessExpiry:  accessExpiry,
+		Login:         login,
+		CompleteLogin: completeMFALogin,
+		Refresh:       refresh,
+
+		DeviceVerifyURL: cfg.DeviceVerifyURL,
 	}
 
 	mux := http.NewServeMux()
 
 	// Public routes
-	mux.HandleFunc("POST /register", authHandler.Register())
-	mux.HandleFunc("POST /login", authHandler.Login())
-	mux.HandleFunc("POST /refresh", authHandler.RefreshToken())
-	mux.HandleFunc("POST /logout", authHandler.Logout())
+	register := keys.Handler(authHandler, (*authhttp.AuthHandler).Register)
+	if emailVerification {
+		register = emailHandler.Register(register)
+		mux.HandleFunc("POST /email/verify", emailHandler.VerifyEmail())
+	}
+	mux.HandleFunc("POST /register", registerLimit.WrapFunc(register))
+	mux.HandleFunc("POST /login", loginLimit.WrapFunc(login))
+	mux.HandleFunc("POST /login/mfa", loginLimit.WrapFunc(completeMFALogin))
+	mux.HandleFunc("POST /refresh", refresh)
+	mux.HandleFunc("POST /logout", keys.Handler(authHandler, (*authhttp.AuthHandler).Logout))
+	if mailer != nil {
+		mux.HandleFunc("POST /password/forgot", passwordLimit.WrapFunc(passwordHandler.ForgotPassword()))
+		mux.HandleFunc("POST /password/reset", passwordLimit.WrapFunc(passwordHandler.ResetPassword()))
+	}
 	mux.HandleFunc("GET /profile/{userId}", profileHandler.GetProfile())
 
 	// Protected routes
-	mux.Handle("POST /change-password", middleware.Auth(jwtManager, authHandler.ChangePassword()))
-	mux.Handle("PUT /profile", middleware.Auth(jwtManager, profileHandler.UpdateProfile()))
+	mux.Handle("POST /change-password", keys.Auth(mfaHandler.RequireStepUp(keys.Handler(authHandler, (*authhttp.AuthHandler).ChangePassword))))
+	mux.Handle("PUT /profile", keys.Auth(profileHandler.UpdateProfile()))
+	mux.Handle("GET /sessions", keys.Auth(sessionHandler.ListSessions()))
+	mux.Handle("DELETE /sessions/{id}", keys.Auth(sessionHandler.RevokeSession()))
+	mux.Handle("POST /logout-all", keys.Auth(sessionHandler.LogoutAll()))
+	if emailVerification {
+		mux.Handle("POST /email/verify/resend", keys.Auth(emailLimit.Wrap(emailHandler.ResendVerification())))
+	}
+	mux.Handle("GET /wallet/transactions", keys.Auth(walletHandler.ListTransactions()))
+
+	// Two-factor authentication
+	mux.Handle("POST /mfa/totp/enroll", keys.Auth(mfaHandler.Enroll()))
+	mux.Handle("POST /mfa/totp/confirm", keys.Auth(mfaHandler.Confirm()))
+	mux.Handle("DELETE /mfa/totp", keys.Auth(mfaHandler.RequireStepUp(mfaHandler.Disable())))
+	// Game-scoped device tokens too, since the launcher's game routes require step-up
+	mux.Handle("POST /mfa/step-up", keys.ScopedAuth(handlers.GameScope, mfaHandler.StepUp()))
+
+	// OpenID Connect provider
+	if cfg.OIDCIssuer != "" {
+		mux.HandleFunc("GET /.well-known/openid-configuration", oidcHandler.Discovery())
+		mux.HandleFunc("GET /oauth/authorize", oidcHandler.Authorize())
+		mux.HandleFunc("POST /oauth/authorize", loginLimit.WrapFunc(oidcHandler.SubmitAuthorize()))
+		mux.HandleFunc("POST /oauth/token", oidcHandler.Token())
+		mux.HandleFunc("POST /oauth/introspect", oidcHandler.Introspect())
+		mux.HandleFunc("POST /oauth/revoke", oidcHandler.Revoke())
+		mux.Handle("GET /userinfo", keys.ScopedAuth("openid", oidcHandler.UserInfo()))
+
+		// Device authorization grant (launcher), approved from the portal
+		mux.HandleFunc("POST /oauth/device_authorization", oidcHandler.DeviceAuthorization())
+		mux.Handle("GET /oauth/device/{userCode}", keys.Auth(deviceLimit.Wrap(oidcHandler.GetDeviceRequest())))
+		mux.Handle("POST /oauth/device/{userCode}/approve", keys.Auth(deviceLimit.Wrap(oidcHandler.ApproveDevice())))
+		mux.Handle("POST /oauth/device/{userCode}/deny", keys.Auth(deviceLimit.Wrap(oidcHandler.DenyDevice())))
+	} else {
+		slog.Warn("OIDC_ISSUER not set, OpenID Connect provider disabled")
+	}
 
-	// Game routes
-	mux.Handle("GET /game/credentials", middleware.Auth(jwtManager, http.HandlerFunc(gameHandler.GetCredentials)))
-	mux.Handle("GET /game/characters", middleware.Auth(jwtManager, http.HandlerFunc(gameHandler.GetCharacters)))
-	mux.Handle("POST /game/unstuck", middleware.Auth(jwtManager, http.HandlerFunc(gameHandler.UnstuckCharacter)))
-	mux.Handle("POST /game/purchase", middleware.Auth(jwtManager, http.HandlerFunc(gameHandler.PurchaseItem)))
-	mux.Handle("POST /game/voucher/redeem", middleware.Auth(jwtManager, http.HandlerFunc(gameHandler.RedeemVoucher)))
+	// Game routes (device grant tokens scoped to "game" are accepted here)
+	gameAuth := func(h http.Handler) http.Handler { return keys.ScopedAuth(handlers.GameScope, h) }
+	if cfg.LegacyGameCredentials {
+		// Hands out the permanent key, so device tokens can't use it; launchers with those use tickets
+		mux.Handle("GET /game/credentials", keys.Auth(mfaHandler.RequireStepUp(http.HandlerFunc(gameHandler.GetCredentials))))
+	}
+	mux.Handle("POST /game/credentials/rotate", gameAuth(mfaHandler.RequireStepUp(http.HandlerFunc(gameHandler.RotateCredentials))))
+	mux.Handle("POST /game/ticket", gameAuth(ticketLimit.Wrap(http.HandlerFunc(gameHandler.CreateLoginTicket))))
+	mux.HandleFunc("POST /game/ticket/redeem", gameHandler.RedeemLoginTicket)
+	mux.Handle("GET /game/characters", gameAuth(http.HandlerFunc(gameHandler.GetCharacters)))
+	mux.Handle("POST /game/unstuck", gameAuth(unstuckLimit.Wrap(http.HandlerFunc(gameHandler.UnstuckCharacter))))
+	mux.Handle("POST /game/purchase", gameAuth(emailHandler.RequireVerified(mfaHandler.RequireStepUp(http.HandlerFunc(gameHandler.PurchaseItem)))))
+	mux.Handle("POST /game/voucher/redeem", gameAuth(voucherLimit.Wrap(emailHandler.RequireVerified(http.HandlerFunc(gameHandler.RedeemVoucher)))))
 
 	// Discord routes
-	mux.HandleFunc("POST /bot/create-verification", discordHandler.CreateVerificationToken)
-	mux.Handle("POST /discord/verify", middleware.Auth(jwtManager, http.HandlerFunc(discordHandler.CompleteDiscordVerification)))
+	mux.Handle("POST /bot/create-verification", discordHandler.BotAuth(handlers.BotVerifyScope, botLimit.WrapFunc(discordHandler.CreateVerificationToken)))
+	mux.Handle("POST /discord/verify", keys.Auth(emailHandler.RequireVerified(http.HandlerFunc(discordHandler.CompleteDiscordVerification))))
+	mux.Handle("DELETE /discord/link", keys.Auth(mfaHandler.RequireStepUp(http.HandlerFunc(discordHandler.UnlinkDiscord))))
 
 	// Admin routes
 	mux.Handle("GET /admin/users",
-		middleware.Auth(jwtManager,
+		keys.Auth(
 			middleware.RequireRole("admin")(adminHandler.ListUsers()),
 		),
 	)
 	mux.Handle("PUT /admin/users/{userId}/role",
-		middleware.Auth(jwtManager,
+		keys.Auth(
 			middleware.RequireRole("admin")(adminHandler.UpdateUserRole()),
 		),
 	)
 
-	// JWKS endpoint
+	mux.Handle("POST /admin/users/{userId}/ban",
+		keys.Auth(
+			middleware.RequireRole("admin")(adminHandler.BanUser()),
+		),
+	)
+	mux.Handle("DELETE /admin/users/{userId}/ban",
+		keys.Auth(
+			middleware.RequireRole("admin")(adminHandler.LiftBan()),
+		),
+	)
+	mux.Handle("GET /admin/users/{userId}/bans",
+		keys.Auth(
+			middleware.RequireRole("admin")(adminHandler.ListBans()),
+		),
+	)
+	mux.Handle("POST /admin/users/{userId}/balance",
+		keys.Auth(
+			middleware.RequireRole("admin")(adminHandler.AdjustBalance()),
+		),
+	)
+	mux.Handle("POST /admin/users/{userId}/balance/drift",
+		keys.Auth(
+			middleware.RequireRole("admin")(adminHandler.ResolveBalanceDrift()),
+		),
+	)
+	mux.Handle("GET /admin/balances/drift",
+		keys.Auth(
+			middleware.RequireRole("admin")(adminHandler.ListBalanceDrift()),
+		),
+	)
+	mux.Handle("GET /admin/users/{userId}/transactions",
+		keys.Auth(
+			middleware.RequireRole("admin")(adminHandler.ListTransactions()),
+		),
+	)
+
+	mux.Handle("GET /admin/users/{userId}/sessions",
+		keys.Auth(
+			middleware.RequireRole("admin")(sessionHandler.AdminListSessions()),
+		),
+	)
+	mux.Handle("DELETE /admin/users/{userId}/sessions/{id}",
+		keys.Auth(
+			middleware.RequireRole("admin")(sessionHandler.AdminRevokeSession()),
+		),
+	)
+	mux.Handle("POST /admin/users/{userId}/logout-all",
+		keys.Auth(
+			middleware.RequireRole("admin")(sessionHandler.AdminLogoutAll()),
+		),
+	)
+	mux.Handle("POST /admin/users/{userId}/game-credentials/rotate",
+		keys.Auth(
+			middleware.RequireRole("admin")(http.HandlerFunc(gameHandler.AdminRotateCredentials)),
+		),
+	)
+	mux.Handle("GET /admin/audit",
+		keys.Auth(
+			middleware.RequireRole("admin")(adminHandler.ListAudit()),
+		),
+	)
+	mux.Handle("GET /admin/audit/verify",
+		keys.Auth(
+			middleware.RequireRole("admin")(adminHandler.VerifyAudit()),
+		),
+	)
+	mux.Handle("GET /admin/orders",
+		keys.Auth(
+			middleware.RequireRole("admin")(adminHandler.ListOrders()),
+		),
+	)
+	mux.Handle("POST /admin/orders/{orderId}/retry",
+		keys.Auth(
+			middleware.RequireRole("admin")(http.HandlerFunc(gameHandler.RetryOrder)),
+		),
+	)
+	mux.Handle("POST /admin/orders/{orderId}/refund",
+		keys.Auth(
+			middleware.RequireRole("admin")(adminHandler.RefundOrder()),
+		),
+	)
+	mux.Handle("GET /admin/voucher-redemptions",
+		keys.Auth(
+			middleware.RequireRole("admin")(adminHandler.ListVoucherRedemptions()),
+		),
+	)
+	mux.Handle("POST /admin/voucher-redemptions/{redemptionId}/retry",
+		keys.Auth(
+			middleware.RequireRole("admin")(http.HandlerFunc(gameHandler.RetryVoucherRedemption)),
+		),
+	)
+	mux.Handle("GET /admin/outbox",
+		keys.Auth(
+			middleware.RequireRole("admin")(adminHandler.ListOutbox()),
+		),
+	)
+	mux.Handle("POST /admin/outbox/{id}/replay",
+		keys.Auth(
+			middleware.RequireRole("admin")(adminHandler.ReplayOutbox()),
+		),
+	)
+	mux.Handle("GET /admin/lockouts",
+		keys.Auth(
+			middleware.RequireRole("admin")(loginGuard.ListLockouts()),
+		),
+	)
+	mux.Handle("DELETE /admin/lockouts/{key}",
+		keys.Auth(
+			middleware.RequireRole("admin")(loginGuard.ClearLockout()),
+		),
+	)
+	mux.Handle("GET /admin/oauth/clients",
+		keys.Auth(
+			middleware.RequireRole("admin")(oidcHandler.ListClients()),
+		),
+	)
+	mux.Handle("POST /admin/oauth/clients",
+		keys.Auth(
+			middleware.RequireRole("admin")(oidcHandler.RegisterClient()),
+		),
+	)
+	mux.Handle("DELETE /admin/oauth/clients/{clientId}",
+		keys.Auth(
+			middleware.RequireRole("admin")(oidcHandler.DeleteClient()),
+		),
+	)
+	mux.Handle("POST /admin/keys/rotate",
+		keys.Auth(
+			middleware.RequireRole("admin")(adminHandler.RotateSigningKey()),
+		),
+	)
+
+	// JWKS endpoint (every key that may still have live tokens)
 	mux.HandleFunc("GET /.well-known/jwks.json", func(w http.ResponseWriter, r *http.Request) {
-		jwks, _ := jwtManager.JWKS()
+		jwks, _ := keys.JWKS()
 		w.Header().Set("Content-Type", "application/json")
 		w.Write(jwks)
 	})
@@ -175,18 +563,121 @@ func main() {
 	c := cors.New(cors.Options{
 		AllowedOrigins:   cfg.AllowedOrigins,
 		AllowedMethods:   []string{"GET", "POST", "PUT", "DELETE", "OPTIONS"},
-		AllowedHeaders:   []string{"Authorization", "Content-Type"},
+		AllowedHeaders:   []string{"Authorization", "Content-Type", "X-MFA-Token"},
+		ExposedHeaders:   []string{"X-Request-ID", "Retry-After", "RateLimit-Policy", "RateLimit-Limit", "RateLimit-Remaining", "RateLimit-Reset"},
 		AllowCredentials: true,
 	})
 
 	server := &http.Server{
 		Addr:         ":" + cfg.Port,
-		Handler:      c.Handler(mux),
+		Handler:      c.Handler(handlers.RequestID(mux)),
 		ReadTimeout:  15 * time.Second,
 		WriteTimeout: 15 * time.Second,
 		IdleTimeout:  60 * time.Second,
 	}
 
+	backgroundCtx, stopBackground := context.WithCancel(context.Background())
+	defer stopBackground()
+
+	// Maintenance jobs; each runs on one replica at a time
+	jobs := scheduler.New(db)
+	purgeJob := func(name string, interval time.Duration, purges ...func() (int64, error)) {
+		jobs.Add(scheduler.Job{Name: name, Interval: interval, Run: func(ctx context.Context) error {
+			var total int64
+			for _, purge := range purges {
+				if ctx.Err() != nil {
+					return ctx.Err()
+				}
+				n, err := purge()
+				total += n
+				if err != nil {
+					return err
+				}
+			}
+			if total > 0 {
+				slog.Info("purged expired rows", "job", name, "rows", total)
+			}
+			return nil
+		}})
+	}
+
+	purgeJob("purge-refresh-tokens", time.Hour, sessions.PurgeExpiredRefreshTokens)
+	purgeJob("purge-discord-verifications", time.Hour, func() (int64, error) {
+		return users.PurgeStaleDiscordVerifications(7 * 24 * time.Hour)
+	})
+	purgeJob("purge-expired-tokens", time.Hour,
+		sessions.PurgeExpiredAccessTokenRevocations,
+		mfa.PurgeExpiredMFATokens,
+		oauthClients.PurgeExpiredGrants,
+		users.PurgeExpiredPasswordResetTokens,
+		users.PurgeExpiredGameLoginTickets,
+	)
+	purgeJob("purge-ended-sessions", 24*time.Hour, func() (int64, error) {
+		return sessions.PurgeEndedSessions(90 * 24 * time.Hour)
+	})
+	purgeJob("purge-delivered-outbox", 24*time.Hour, func() (int64, error) {
+		return users.PurgeDeliveredOutbox(30 * 24 * time.Hour)
+	})
+	if nonces, ok := botNonces.(*botsign.PostgresStore); ok {
+		purgeJob("purge-bot-nonces", time.Hour, func() (int64, error) {
+			return nonces.Purge(backgroundCtx)
+		})
+	}
+	if failures, ok := lockouts.(*lockout.PostgresStore); ok {
+		window := max(lockout.AccountPolicy.Window, lockout.IPPolicy.Window, lockout.MFAPolicy.Window)
+		purgeJob("purge-login-failures", time.Hour, func() (int64, error) {
+			return failures.Purge(backgroundCtx, window)
+		})
+	}
+	if buckets, ok := limiterStore.(*ratelimit.PostgresStore); ok {
+		var longestPeriod time.Duration
+		for _, limit := range rateLimits {
+			longestPeriod = max(longestPeriod, limit.Period)
+		}
+		purgeJob("purge-rate-limit-buckets", time.Hour, func() (int64, error) {
+			return buckets.Purge(backgroundCtx, longestPeriod)
+		})
+	}
+
+	// Remove game accounts left behind by Discord verifications that failed part way
+	jobs.Add(scheduler.Job{Name: "reconcile-game-accounts", Interval: 10 * time.Minute, Run: func(ctx context.Context) error {
+		return discordHandler.ReconcileGameAccounts()
+	}})
+
+	// Alert on balance changes that bypassed the ledger
+	jobs.Add(scheduler.Job{Name: "check-balance-drift", Interval: time.Hour, Run: func(ctx context.Context) error {
+		return adminHandler.CheckBalanceDrift()
+	}})
+
+	// Unblock game accounts of expired bans
+	if cfg.GameBlockBanned {
+		jobs.Add(scheduler.Job{Name: "unblock-expired-bans", Interval: 5 * time.Minute, Run: func(ctx context.Context) error {
+			return adminHandler.UnblockExpiredBans()
+		}})
+	}
+
+	// Scheduled key rotation: one replica writes the new key, every replica picks it up.
+	// Keys rotated by an admin on another replica are picked up the same way.
+	if cfg.JWTKeyRotationInterval > 0 {
+		jobs.Add(scheduler.Job{Name: "rotate-signing-key", Interval: 5 * time.Minute, Run: func(ctx context.Context) error {
+			return keys.RotateIfDue(cfg.JWTKeyRotationInterval)
+		}})
+	}
+	if cfg.JWTKeysDir != "" {
+		jobs.Add(scheduler.Job{Name: "reload-signing-keys", Interval: 5 * time.Minute, PerReplica: true, Run: func(ctx context.Context) error {
+			return keys.Reload()
+		}})
+	}
+
+	jobs.Start(backgroundCtx)
+
+	// Bot notifications queue up in the outbox until a webhook is configured
+	if cfg.BotWebhookURL != "" && botSigner != nil {
+		go outbox.NewDispatcher(users, discordHandler.DeliverNotification).Run(backgroundCtx)
+	} else {
+		slog.Warn("bot webhook not configured, bot notifications stay queued in the outbox")
+	}
+
 	go func() {
 		slog.Info("server running", "port", cfg.Port)
 		if err := server.ListenAndServe(); err != nil && err != http.ErrServerClosed {
@@ -200,6 +691,7 @@ func main() {
 	<-quit
 
 	slog.Info("shutting down server")
+	stopBackground()
 
 	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
 	defer cancel()
@@ -209,5 +701,9 @@ func main() {
 		os.Exit(1)
 	}
 
+	if !jobs.Wait(ctx) {
+		slog.Warn("scheduled jobs still running at shutdown")
+	}
+
 	slog.Info("server exited")
 }
@@ -0,0 +1,128 @@
+// Package outbox delivers the Discord bot notifications queued in public.bot_outbox.
+// Delivery is at least once: the bot should ignore a delivery_id it has already seen.
+package outbox
+
+import (
+	"context"
+	"log/slog"
+	"math/rand/v2"
+	"time"
+
+	"github.com/ethan-mdev/authentication-server/storage"
+)
+
+// DeliverFunc sends one message; an error means it should be retried
+type DeliverFunc func(ctx context.Context, msg *storage.OutboxMessage) error
+
+// Dispatcher polls for due messages and delivers them, retrying failures with
+// exponential backoff until MaxAttempts, after which a message is dead-lettered.
+// Several replicas can run one each; a message is only claimed by one at a time.
+type Dispatcher struct {
+	Repo    *storage.ExtendedUserRepository
+	Deliver DeliverFunc
+
+	Interval    time.Duration // between polls
+	BatchSize   int
+	MaxAttempts int
+	BaseDelay   time.Duration // before the first retry, doubled for every further one
+	MaxDelay    time.Duration
+}
+
+// NewDispatcher returns a Dispatcher with the default schedule: retries after 30s, 1m,
+// 2m ... up to an hour apart, giving up after 12 attempts (about 5 hours)
+func NewDispatcher(repo *storage.ExtendedUserRepository, deliver DeliverFunc) *Dispatcher {
+	return &Dispatcher{
+		Repo:        repo,
+		Deliver:     deliver,
+		Interval:    5 * time.Second,
+		BatchSize:   20,
+		MaxAttempts: 12,
+		BaseDelay:   30 * time.Second,
+		MaxDelay:    time.Hour,
+	}
+}
+
+// deliveryTimeout bounds one delivery. A batch is leased for BatchSize deliveries plus
+// claimMargin for the bookkeeping around them, so no message of a slow batch is picked up
+// by another dispatcher while this one may still deliver it.
+const (
+	deliveryTimeout = 10 * time.Second
+	claimMargin     = 30 * time.Second
+)
+
+// Run dispatches until ctx is cancelled
+func (d *Dispatcher) Run(ctx context.Context) {
+	ticker := time.NewTicker(d.Interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			d.dispatch(ctx)
+		}
+	}
+}
+
+// dispatch delivers one batch of due messages
+func (d *Dispatcher) dispatch(ctx context.Context) {
+	lease := time.Duration(d.BatchSize)*deliveryTimeout + claimMargin
+	// The last moment a delivery can start and still finish inside the lease
+	deadline := time.Now().Add(lease - deliveryTimeout)
+
+	messages, err := d.Repo.ClaimOutbox(d.BatchSize, lease)
+	if err != nil {
+		slog.Error("failed to claim outbox messages", "error", err)
+		return
+	}
+
+	for _, msg := range messages {
+		// Claimed messages left over are picked up again once their lease ends
+		if ctx.Err() != nil || time.Now().After(deadline) {
+			return
+		}
+		d.deliver(ctx, msg)
+	}
+}
+
+func (d *Dispatcher) deliver(ctx context.Context, msg *storage.OutboxMessage) {
+	deliverCtx, cancel := context.WithTimeout(ctx, deliveryTimeout)
+	err := d.Deliver(deliverCtx, msg)
+	cancel()
+
+	switch {
+	case err == nil:
+		if err := d.Repo.MarkOutboxDelivered(msg.ID); err != nil {
+			slog.Error("failed to mark outbox message delivered", "error", err, "id", msg.ID)
+			return
+		}
+		slog.Info("outbox message delivered", "id", msg.ID, "kind", msg.Kind, "attempts", msg.Attempts)
+
+	case msg.Attempts >= d.MaxAttempts:
+		if err := d.Repo.DeadLetterOutbox(msg.ID, err.Error()); err != nil {
+			slog.Error("failed to dead-letter outbox message", "error", err, "id", msg.ID)
+			return
+		}
+		slog.Error("outbox message dead-lettered", "id", msg.ID, "kind", msg.Kind, "attempts", msg.Attempts, "error", err)
+
+	default:
+		retryAt := time.Now().Add(d.Backoff(msg.Attempts))
+		if err := d.Repo.RetryOutboxLater(msg.ID, err.Error(), retryAt); err != nil {
+			slog.Error("failed to reschedule outbox message", "error", err, "id", msg.ID)
+			return
+		}
+		slog.Warn("outbox delivery failed, will retry", "id", msg.ID, "kind", msg.Kind, "attempts", msg.Attempts, "retry_at", retryAt, "error", err)
+	}
+}
+
+// Backoff returns the delay after the given number of failed attempts, with up to
+// 10% jitter so messages that failed together don't all retry together
+func (d *Dispatcher) Backoff(attempts int) time.Duration {
+	delay := d.BaseDelay
+	for i := 1; i < attempts && delay < d.MaxDelay; i++ {
+		delay *= 2
+	}
+	delay = min(delay, d.MaxDelay)
+	return delay + time.Duration(rand.Int64N(int64(delay)/10+1))
+}
@@ -0,0 +1,2 @@
+DELETE FROM tUser
+WHERE nUserNo = @p1 AND sUserID = @p2
@@ -0,0 +1,3 @@
+SELECT nUserNo
+FROM tUser
+WHERE sUserID = @p1 AND dDate >= DATEADD(second, -@p2, GETDATE())
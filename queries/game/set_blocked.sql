@@ -0,0 +1,3 @@
+UPDATE tUser
+SET bIsBlock = @p1
+WHERE nUserNo = @p2
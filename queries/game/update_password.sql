@@ -0,0 +1,3 @@
+UPDATE tUser
+SET sUserPW = @p1
+WHERE nUserNo = @p2
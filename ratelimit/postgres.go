@@ -0,0 +1,71 @@
+package ratelimit
+
+import (
+	"context"
+	"database/sql"
+	"time"
+)
+
+// PostgresStore keeps buckets in public.rate_limit_buckets so replicas share limits
+type PostgresStore struct {
+	db *sql.DB
+}
+
+func NewPostgresStore(db *sql.DB) *PostgresStore {
+	return &PostgresStore{db: db}
+}
+
+func (s *PostgresStore) Take(ctx context.Context, key string, limit Limit) (Result, error) {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return Result{}, err
+	}
+	defer tx.Rollback()
+
+	// New keys start with a full bucket
+	_, err = tx.ExecContext(ctx, `
+		INSERT INTO public.rate_limit_buckets (key, tokens, updated_at)
+		VALUES ($1, $2, NOW())
+		ON CONFLICT (key) DO NOTHING
+	`, key, limit.Requests)
+	if err != nil {
+		return Result{}, err
+	}
+
+	var tokens, elapsed float64
+	err = tx.QueryRowContext(ctx, `
+		SELECT tokens, GREATEST(EXTRACT(EPOCH FROM NOW() - updated_at), 0)
+		FROM public.rate_limit_buckets
+		WHERE key = $1
+		FOR UPDATE
+	`, key).Scan(&tokens, &elapsed)
+	if err != nil {
+		return Result{}, err
+	}
+
+	tokens, res := refill(tokens, time.Duration(elapsed*float64(time.Second)), limit)
+
+	_, err = tx.ExecContext(ctx, `
+		UPDATE public.rate_limit_buckets
+		SET tokens = $1, updated_at = NOW()
+		WHERE key = $2
+	`, tokens, key)
+	if err != nil {
+		return Result{}, err
+	}
+
+	return res, tx.Commit()
+}
+
+// Purge removes buckets untouched for longer than idle. Given the longest limit period, a
+// purged bucket had refilled anyway and is no different from the new one that replaces it.
+func (s *PostgresStore) Purge(ctx context.Context, idle time.Duration) (int64, error) {
+	result, err := s.db.ExecContext(ctx, `
+		DELETE FROM public.rate_limit_buckets
+		WHERE updated_at < NOW() - make_interval(secs => $1)
+	`, idle.Seconds())
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected()
+}
@@ -0,0 +1,170 @@
+// Package ratelimit is a token-bucket rate limiter for the HTTP routes in main.go.
+// Bucket state lives behind Store so replicas can share it through PostgreSQL.
+package ratelimit
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/ethan-mdev/authentication-server/keyring"
+)
+
+// Limit allows Requests per Period, refilled continuously. Bursts up to Requests are allowed.
+type Limit struct {
+	Requests int
+	Period   time.Duration
+}
+
+// rate is tokens refilled per second
+func (l Limit) rate() float64 {
+	return float64(l.Requests) / l.Period.Seconds()
+}
+
+type Result struct {
+	Allowed   bool
+	Remaining int
+	Reset     time.Duration // until the bucket is full again
+	// RetryAfter is how long until the next request would be allowed, when refused
+	RetryAfter time.Duration
+}
+
+// Store takes one token from a key's bucket
+type Store interface {
+	Take(ctx context.Context, key string, limit Limit) (Result, error)
+}
+
+// refill is the bucket arithmetic shared by the stores: given the tokens left after the
+// last request and the time since, it takes one token if available.
+func refill(tokens float64, elapsed time.Duration, limit Limit) (float64, Result) {
+	capacity := float64(limit.Requests)
+	tokens = math.Min(capacity, tokens+elapsed.Seconds()*limit.rate())
+
+	res := Result{}
+	if tokens >= 1 {
+		tokens--
+		res.Allowed = true
+	} else {
+		res.RetryAfter = time.Duration((1 - tokens) / limit.rate() * float64(time.Second))
+	}
+
+	res.Remaining = int(tokens)
+	res.Reset = time.Duration((capacity - tokens) / limit.rate() * float64(time.Second))
+	return tokens, res
+}
+
+// KeyFunc identifies who a request is counted against
+type KeyFunc func(r *http.Request) string
+
+// ByIP counts requests per client address
+func ByIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return "ip:" + r.RemoteAddr
+	}
+	return "ip:" + host
+}
+
+// ByUser counts requests per authenticated user, falling back to the client address.
+// Must be mounted inside keyring Auth or ScopedAuth.
+func ByUser(r *http.Request) string {
+	if claims, ok := keyring.Claims(r.Context()); ok {
+		return "user:" + claims.UserID
+	}
+	return ByIP(r)
+}
+
+// ByBot counts requests per service client, falling back to the client address for
+// requests authenticated by signature alone. Must be mounted inside the bot authentication.
+func ByBot(r *http.Request) string {
+	if clientID, ok := keyring.ServiceClient(r.Context()); ok {
+		return "client:" + clientID
+	}
+	return ByIP(r)
+}
+
+// Limiter applies one named limit to the routes it wraps
+type Limiter struct {
+	Store Store
+	Name  string
+	Limit Limit
+	Key   KeyFunc
+}
+
+// Wrap refuses requests over the limit with 429, and sets RateLimit-* headers on every response
+func (l *Limiter) Wrap(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		res, err := l.Store.Take(r.Context(), l.Name+":"+l.Key(r), l.Limit)
+		if err != nil {
+			// Fail open, a broken limiter store shouldn't take the API down
+			slog.Error("rate limiter unavailable", "error", err, "limit", l.Name)
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		h := w.Header()
+		h.Set("RateLimit-Policy", fmt.Sprintf("%d;w=%d", l.Limit.Requests, int(l.Limit.Period.Seconds())))
+		h.Set("RateLimit-Limit", strconv.Itoa(l.Limit.Requests))
+		h.Set("RateLimit-Remaining", strconv.Itoa(res.Remaining))
+		h.Set("RateLimit-Reset", strconv.Itoa(int(math.Ceil(res.Reset.Seconds()))))
+
+		if !res.Allowed {
+			h.Set("Retry-After", strconv.Itoa(int(math.Ceil(res.RetryAfter.Seconds()))))
+			h.Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusTooManyRequests)
+			json.NewEncoder(w).Encode(map[string]string{
+				"error":   "rate_limited",
+				"message": "Too many requests, slow down",
+			})
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+// WrapFunc is Wrap for handler functions
+func (l *Limiter) WrapFunc(next http.HandlerFunc) http.HandlerFunc {
+	return l.Wrap(next).ServeHTTP
+}
+
+// ParseLimits reads overrides like "login=10/1m,voucher=5/10m" into limits by name
+func ParseLimits(spec string) (map[string]Limit, error) {
+	limits := map[string]Limit{}
+	for _, part := range strings.Split(spec, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+
+		name, value, ok := strings.Cut(part, "=")
+		if !ok {
+			return nil, fmt.Errorf("rate limit %q: want name=requests/period", part)
+		}
+
+		requests, period, ok := strings.Cut(value, "/")
+		if !ok {
+			return nil, fmt.Errorf("rate limit %q: want name=requests/period", part)
+		}
+
+		n, err := strconv.Atoi(requests)
+		if err != nil || n <= 0 {
+			return nil, fmt.Errorf("rate limit %q: invalid request count", part)
+		}
+
+		d, err := time.ParseDuration(period)
+		if err != nil || d <= 0 {
+			return nil, fmt.Errorf("rate limit %q: invalid period", part)
+		}
+
+		limits[strings.TrimSpace(name)] = Limit{Requests: n, Period: d}
+	}
+	return limits, nil
+}
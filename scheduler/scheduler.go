@@ -0,0 +1,164 @@
+// Package scheduler runs periodic maintenance jobs. A run holds a Postgres advisory lock
+// named after its job and is recorded in public.scheduler_runs, so however many replicas
+// are running, each job runs on one of them at a time and about once per interval.
+package scheduler
+
+import (
+	"context"
+	"database/sql"
+	"hash/fnv"
+	"log/slog"
+	"sync"
+	"time"
+)
+
+// Job is a named task run every Interval
+type Job struct {
+	Name     string
+	Interval time.Duration
+	Run      func(ctx context.Context) error
+
+	// PerReplica jobs run on every replica without the lock, for work on local state
+	PerReplica bool
+}
+
+// Scheduler runs jobs until the context given to Start is cancelled
+type Scheduler struct {
+	db   *sql.DB
+	jobs []Job
+	wg   sync.WaitGroup
+}
+
+func New(db *sql.DB) *Scheduler {
+	return &Scheduler{db: db}
+}
+
+// Add registers a job. Jobs added after Start aren't run.
+func (s *Scheduler) Add(job Job) {
+	s.jobs = append(s.jobs, job)
+}
+
+// Start runs every job in its own goroutine, first shortly after start and then every interval
+func (s *Scheduler) Start(ctx context.Context) {
+	for _, job := range s.jobs {
+		s.wg.Add(1)
+		go func() {
+			defer s.wg.Done()
+			s.loop(ctx, job)
+		}()
+	}
+	slog.Info("scheduler started", "jobs", len(s.jobs))
+}
+
+// Wait blocks until every job has returned after the context was cancelled,
+// or until ctx is done. Returns false if jobs were still running.
+func (s *Scheduler) Wait(ctx context.Context) bool {
+	done := make(chan struct{})
+	go func() {
+		s.wg.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
+
+// startDelay lets the server finish starting before the first runs
+const startDelay = 30 * time.Second
+
+func (s *Scheduler) loop(ctx context.Context, job Job) {
+	timer := time.NewTimer(startDelay)
+	defer timer.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-timer.C:
+			s.run(ctx, job)
+			timer.Reset(job.Interval)
+		}
+	}
+}
+
+// run runs a job once unless another replica holds its lock or ran it less than an interval ago
+func (s *Scheduler) run(ctx context.Context, job Job) {
+	if job.PerReplica {
+		if err := job.Run(ctx); err != nil && ctx.Err() == nil {
+			slog.Error("scheduled job failed", "job", job.Name, "error", err)
+		}
+		return
+	}
+
+	// Advisory locks belong to a session, so the lock and unlock need the same connection
+	conn, err := s.db.Conn(ctx)
+	if err != nil {
+		slog.Error("scheduler failed to get a connection", "job", job.Name, "error", err)
+		return
+	}
+	defer conn.Close()
+
+	key := lockKey(job.Name)
+	var locked bool
+	if err := conn.QueryRowContext(ctx, `SELECT pg_try_advisory_lock($1)`, key).Scan(&locked); err != nil {
+		slog.Error("scheduler failed to take job lock", "job", job.Name, "error", err)
+		return
+	}
+	if !locked {
+		return // running on another replica
+	}
+	defer func() {
+		// Unlock even after shutdown began; otherwise the lock lasts as long as the pooled connection
+		if _, err := conn.ExecContext(context.Background(), `SELECT pg_advisory_unlock($1)`, key); err != nil {
+			slog.Error("scheduler failed to release job lock", "job", job.Name, "error", err)
+		}
+	}()
+
+	// Replicas' timers drift apart, so a run counts if it started within 90% of an interval
+	result, err := conn.ExecContext(ctx, `
+		INSERT INTO public.scheduler_runs (job, last_started_at)
+		VALUES ($1, NOW())
+		ON CONFLICT (job) DO UPDATE SET last_started_at = NOW(), last_finished_at = NULL, last_error = NULL
+		WHERE scheduler_runs.last_started_at < NOW() - make_interval(secs => $2)
+	`, job.Name, job.Interval.Seconds()*0.9)
+	if err != nil {
+		slog.Error("scheduler failed to record job start", "job", job.Name, "error", err)
+		return
+	}
+	if n, err := result.RowsAffected(); err != nil || n == 0 {
+		return // another replica ran it recently
+	}
+
+	start := time.Now()
+	runErr := job.Run(ctx)
+
+	var lastError sql.NullString
+	if runErr != nil {
+		lastError = sql.NullString{String: runErr.Error(), Valid: true}
+		if ctx.Err() == nil {
+			slog.Error("scheduled job failed", "job", job.Name, "error", runErr)
+		}
+	} else {
+		slog.Debug("scheduled job finished", "job", job.Name, "duration", time.Since(start))
+	}
+
+	_, err = conn.ExecContext(context.Background(), `
+		UPDATE public.scheduler_runs
+		SET last_finished_at = NOW(), last_error = $1
+		WHERE job = $2
+	`, lastError, job.Name)
+	if err != nil {
+		slog.Error("scheduler failed to record job result", "job", job.Name, "error", err)
+	}
+}
+
+// lockKey maps a job name to an advisory lock key
+func lockKey(name string) int64 {
+	h := fnv.New64a()
+	h.Write([]byte("scheduler:" + name))
+	return int64(h.Sum64())
+}
@@ -24,13 +24,85 @@ CREATE TABLE IF NOT EXISTS public.users (
     game_api_key TEXT DEFAULT NULL,
     -- Discord account linking (NULL = unverified)
     discord_id VARCHAR(255) DEFAULT NULL,
-    discord_username VARCHAR(255) DEFAULT NULL
+    discord_username VARCHAR(255) DEFAULT NULL,
+    -- Email verification (NULL = unverified)
+    email_verified_at TIMESTAMP DEFAULT NULL,
+    -- Access tokens issued at or before this are inactive (logout everywhere)
+    access_tokens_revoked_at TIMESTAMPTZ DEFAULT NULL
 );
 
+-- Columns added after the initial release
+ALTER TABLE public.users ADD COLUMN IF NOT EXISTS email_verified_at TIMESTAMP DEFAULT NULL;
+ALTER TABLE public.users ADD COLUMN IF NOT EXISTS access_tokens_revoked_at TIMESTAMPTZ DEFAULT NULL;
+
 CREATE INDEX IF NOT EXISTS idx_users_username ON public.users(username);
 CREATE INDEX IF NOT EXISTS idx_users_email ON public.users(email);
 CREATE INDEX IF NOT EXISTS idx_users_game_account ON public.users(game_account_id);
-CREATE INDEX IF NOT EXISTS idx_users_discord_id ON public.users(discord_id);
+-- A Discord account links to one user at most; concurrent links lose on this index
+DROP INDEX IF EXISTS public.idx_users_discord_id;
+CREATE UNIQUE INDEX IF NOT EXISTS idx_users_discord_id_unique ON public.users(discord_id) WHERE discord_id IS NOT NULL;
+-- Keyset pagination in the admin user list
+CREATE INDEX IF NOT EXISTS idx_users_created_id ON public.users(created_at, id);
+
+-- Suspensions: permanent when expires_at is NULL, lifted early when lifted_at is set.
+-- game_blocked = tUser.bIsBlock was set for the ban and hasn't been cleared yet.
+CREATE TABLE IF NOT EXISTS public.user_bans (
+    id BIGSERIAL PRIMARY KEY,
+    user_id VARCHAR(36) NOT NULL,
+    reason TEXT NOT NULL,
+    banned_by VARCHAR(36) NOT NULL,
+    created_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+    expires_at TIMESTAMPTZ DEFAULT NULL,
+    lifted_at TIMESTAMPTZ DEFAULT NULL,
+    lifted_by VARCHAR(36) DEFAULT NULL,
+    game_blocked BOOLEAN NOT NULL DEFAULT false,
+    FOREIGN KEY (user_id) REFERENCES public.users(id) ON DELETE CASCADE
+);
+
+CREATE INDEX IF NOT EXISTS idx_user_bans_active ON public.user_bans(user_id) WHERE lifted_at IS NULL;
+CREATE INDEX IF NOT EXISTS idx_user_bans_game_blocked ON public.user_bans(id) WHERE game_blocked;
+
+-- Append-only audit log of privileged and financial actions. Each row's hash covers the row
+-- and the previous row's hash, so an edited or deleted row breaks the chain after it.
+CREATE TABLE IF NOT EXISTS public.audit_events (
+    id BIGSERIAL PRIMARY KEY,
+    occurred_at TIMESTAMPTZ NOT NULL,
+    actor_type TEXT NOT NULL CHECK (actor_type IN ('user', 'service', 'system')),
+    actor_id VARCHAR(64) DEFAULT NULL,
+    action TEXT NOT NULL,
+    target_type TEXT NOT NULL,
+    target_id TEXT NOT NULL,
+    before JSONB DEFAULT NULL,
+    after JSONB DEFAULT NULL,
+    ip_address VARCHAR(45) DEFAULT NULL,
+    request_id VARCHAR(64) DEFAULT NULL,
+    prev_hash VARCHAR(64) NOT NULL,
+    hash VARCHAR(64) NOT NULL
+);
+
+CREATE INDEX IF NOT EXISTS idx_audit_events_actor ON public.audit_events(actor_id, id);
+CREATE INDEX IF NOT EXISTS idx_audit_events_target ON public.audit_events(target_type, target_id, id);
+CREATE INDEX IF NOT EXISTS idx_audit_events_action ON public.audit_events(action, id);
+
+CREATE OR REPLACE FUNCTION public.audit_events_append_only()
+RETURNS TRIGGER AS $$
+BEGIN
+    RAISE EXCEPTION 'audit_events is append-only';
+END;
+$$ LANGUAGE plpgsql;
+
+DROP TRIGGER IF EXISTS audit_events_no_update ON public.audit_events;
+CREATE TRIGGER audit_events_no_update
+BEFORE UPDATE OR DELETE ON public.audit_events
+FOR EACH ROW
+EXECUTE FUNCTION public.audit_events_append_only();
+
+DROP TRIGGER IF EXISTS audit_events_no_truncate ON public.audit_events;
+CREATE TRIGGER audit_events_no_truncate
+BEFORE TRUNCATE ON public.audit_events
+FOR EACH STATEMENT
+EXECUTE FUNCTION public.audit_events_append_only();
+
 CREATE TABLE IF NOT EXISTS public.refresh_tokens (
     token VARCHAR(255) PRIMARY KEY,
     user_id VARCHAR(36) NOT NULL,
@@ -41,6 +113,230 @@ CREATE TABLE IF NOT EXISTS public.refresh_tokens (
 CREATE INDEX IF NOT EXISTS idx_refresh_tokens_user ON public.refresh_tokens(user_id);
 CREATE INDEX IF NOT EXISTS idx_refresh_tokens_expires ON public.refresh_tokens(expires_at);
 
+-- SHA-256 of the token, as in refresh_token_lineage. central-auth writes these rows, so a
+-- trigger keeps the hash up to date.
+ALTER TABLE public.refresh_tokens ADD COLUMN IF NOT EXISTS token_hash VARCHAR(64) DEFAULT NULL;
+
+CREATE OR REPLACE FUNCTION public.refresh_tokens_set_hash()
+RETURNS TRIGGER AS $$
+BEGIN
+    NEW.token_hash = encode(sha256(convert_to(NEW.token, 'UTF8')), 'hex');
+    RETURN NEW;
+END;
+$$ LANGUAGE plpgsql;
+
+DROP TRIGGER IF EXISTS refresh_tokens_set_hash ON public.refresh_tokens;
+CREATE TRIGGER refresh_tokens_set_hash
+BEFORE INSERT OR UPDATE OF token ON public.refresh_tokens
+FOR EACH ROW
+EXECUTE FUNCTION public.refresh_tokens_set_hash();
+
+UPDATE public.refresh_tokens
+SET token_hash = encode(sha256(convert_to(token, 'UTF8')), 'hex')
+WHERE token_hash IS NULL;
+
+CREATE INDEX IF NOT EXISTS idx_refresh_tokens_hash ON public.refresh_tokens(token_hash);
+
+-- Refresh token families: one per login, every rotation adds a child token.
+-- Presenting a token that was already rotated revokes the whole family.
+CREATE TABLE IF NOT EXISTS public.refresh_token_families (
+    id VARCHAR(36) PRIMARY KEY DEFAULT gen_random_uuid()::TEXT,
+    user_id VARCHAR(36) NOT NULL,
+    created_at TIMESTAMP NOT NULL DEFAULT NOW(),
+    revoked_at TIMESTAMP DEFAULT NULL,
+    revoked_reason TEXT DEFAULT NULL,
+    FOREIGN KEY (user_id) REFERENCES public.users(id) ON DELETE CASCADE
+);
+
+-- The OAuth client a session was issued to through /oauth/token, NULL for first-party logins
+ALTER TABLE public.refresh_token_families ADD COLUMN IF NOT EXISTS client_id TEXT DEFAULT NULL;
+
+-- Every refresh token issued, by SHA-256 hash (refresh_tokens only keeps the live ones)
+CREATE TABLE IF NOT EXISTS public.refresh_token_lineage (
+    token_hash VARCHAR(64) PRIMARY KEY,
+    family_id VARCHAR(36) NOT NULL,
+    parent_hash VARCHAR(64) DEFAULT NULL,
+    user_id VARCHAR(36) NOT NULL,
+    issued_at TIMESTAMP NOT NULL DEFAULT NOW(),
+    rotated_at TIMESTAMP DEFAULT NULL,
+    user_agent TEXT DEFAULT NULL,
+    ip_address VARCHAR(45) DEFAULT NULL,
+    FOREIGN KEY (family_id) REFERENCES public.refresh_token_families(id) ON DELETE CASCADE,
+    FOREIGN KEY (user_id) REFERENCES public.users(id) ON DELETE CASCADE
+);
+
+-- Access tokens revoked before they expired, by jti (or SHA-256 of the token when it has none).
+-- user_id is NULL for service client tokens.
+CREATE TABLE IF NOT EXISTS public.revoked_access_tokens (
+    token_id VARCHAR(128) PRIMARY KEY,
+    user_id VARCHAR(36) DEFAULT NULL,
+    expires_at TIMESTAMPTZ NOT NULL,
+    revoked_at TIMESTAMPTZ NOT NULL DEFAULT NOW()
+);
+ALTER TABLE public.revoked_access_tokens ALTER COLUMN user_id DROP NOT NULL;
+CREATE INDEX IF NOT EXISTS idx_revoked_access_tokens_expires ON public.revoked_access_tokens(expires_at);
+
+CREATE INDEX IF NOT EXISTS idx_refresh_token_families_user ON public.refresh_token_families(user_id);
+CREATE INDEX IF NOT EXISTS idx_refresh_token_lineage_family ON public.refresh_token_lineage(family_id);
+
+-- TOTP two-factor authentication (enabled_at NULL = enrollment not confirmed yet).
+-- totp_secret is encrypted with MFA_SECRET_KEY.
+CREATE TABLE IF NOT EXISTS public.user_mfa (
+    user_id VARCHAR(36) PRIMARY KEY,
+    totp_secret TEXT NOT NULL,
+    enabled_at TIMESTAMP DEFAULT NULL,
+    last_used_step BIGINT NOT NULL DEFAULT 0,
+    created_at TIMESTAMP NOT NULL DEFAULT NOW(),
+    FOREIGN KEY (user_id) REFERENCES public.users(id) ON DELETE CASCADE
+);
+
+CREATE TABLE IF NOT EXISTS public.mfa_recovery_codes (
+    id SERIAL PRIMARY KEY,
+    user_id VARCHAR(36) NOT NULL,
+    code_hash VARCHAR(64) NOT NULL,
+    used_at TIMESTAMP DEFAULT NULL,
+    FOREIGN KEY (user_id) REFERENCES public.users(id) ON DELETE CASCADE
+);
+
+-- Pending second login step: the issued tokens, encrypted with a key derived from the challenge token
+CREATE TABLE IF NOT EXISTS public.mfa_challenges (
+    challenge_hash VARCHAR(64) PRIMARY KEY,
+    user_id VARCHAR(36) NOT NULL,
+    sealed_response BYTEA NOT NULL,
+    expires_at TIMESTAMP NOT NULL,
+    FOREIGN KEY (user_id) REFERENCES public.users(id) ON DELETE CASCADE
+);
+
+-- Short-lived proof of a recent MFA check, required by sensitive routes
+CREATE TABLE IF NOT EXISTS public.mfa_step_up_tokens (
+    token_hash VARCHAR(64) PRIMARY KEY,
+    user_id VARCHAR(36) NOT NULL,
+    expires_at TIMESTAMP NOT NULL,
+    FOREIGN KEY (user_id) REFERENCES public.users(id) ON DELETE CASCADE
+);
+
+CREATE INDEX IF NOT EXISTS idx_mfa_recovery_codes_user ON public.mfa_recovery_codes(user_id);
+-- Wrong codes answered to a challenge; it is deleted after a few
+ALTER TABLE public.mfa_challenges ADD COLUMN IF NOT EXISTS attempts INTEGER NOT NULL DEFAULT 0;
+
+CREATE INDEX IF NOT EXISTS idx_mfa_challenges_expires ON public.mfa_challenges(expires_at);
+CREATE INDEX IF NOT EXISTS idx_mfa_step_up_tokens_expires ON public.mfa_step_up_tokens(expires_at);
+
+-- Forgotten password flow (only the SHA-256 of the emailed token is stored)
+CREATE TABLE IF NOT EXISTS public.password_reset_tokens (
+    token_hash VARCHAR(64) PRIMARY KEY,
+    user_id VARCHAR(36) NOT NULL,
+    created_at TIMESTAMP NOT NULL DEFAULT NOW(),
+    expires_at TIMESTAMP NOT NULL,
+    used_at TIMESTAMP DEFAULT NULL,
+    FOREIGN KEY (user_id) REFERENCES public.users(id) ON DELETE CASCADE
+);
+
+CREATE INDEX IF NOT EXISTS idx_password_reset_tokens_user ON public.password_reset_tokens(user_id);
+CREATE INDEX IF NOT EXISTS idx_password_reset_tokens_expires ON public.password_reset_tokens(expires_at);
+
+-- Failed login counters for brute-force lockout, keyed by "ip:<addr>" or "account:<username>"
+CREATE TABLE IF NOT EXISTS public.login_failures (
+    key VARCHAR(320) PRIMARY KEY,
+    failures INTEGER NOT NULL DEFAULT 0,
+    last_failure_at TIMESTAMP NOT NULL DEFAULT NOW(),
+    locked_until TIMESTAMP DEFAULT NULL
+);
+
+CREATE INDEX IF NOT EXISTS idx_login_failures_locked ON public.login_failures(locked_until);
+CREATE INDEX IF NOT EXISTS idx_login_failures_last_failure ON public.login_failures(last_failure_at);
+
+-- Token buckets for the HTTP rate limiter, keyed by "<limit>:<ip|user|bot>:<id>"
+CREATE TABLE IF NOT EXISTS public.rate_limit_buckets (
+    key VARCHAR(320) PRIMARY KEY,
+    tokens DOUBLE PRECISION NOT NULL,
+    updated_at TIMESTAMPTZ NOT NULL DEFAULT NOW()
+);
+
+CREATE INDEX IF NOT EXISTS idx_rate_limit_buckets_updated ON public.rate_limit_buckets(updated_at);
+
+-- Nonces of signed Discord bot requests, kept until the request's timestamp leaves the allowed window
+CREATE TABLE IF NOT EXISTS public.bot_request_nonces (
+    nonce VARCHAR(64) PRIMARY KEY,
+    expires_at TIMESTAMPTZ NOT NULL
+);
+CREATE INDEX IF NOT EXISTS idx_bot_request_nonces_expires ON public.bot_request_nonces(expires_at);
+
+-- OAuth clients: apps signing users in, and services using client credentials.
+-- No secret_hash and no jwt_public_key = public client (PKCE only).
+CREATE TABLE IF NOT EXISTS public.oauth_clients (
+    client_id VARCHAR(64) PRIMARY KEY,
+    name VARCHAR(100) NOT NULL,
+    secret_hash VARCHAR(64) DEFAULT NULL,
+    jwt_public_key TEXT DEFAULT NULL,
+    redirect_uris TEXT[] NOT NULL,
+    scopes TEXT[] NOT NULL DEFAULT '{}',
+    created_at TIMESTAMP NOT NULL DEFAULT NOW()
+);
+ALTER TABLE public.oauth_clients ADD COLUMN IF NOT EXISTS jwt_public_key TEXT DEFAULT NULL;
+ALTER TABLE public.oauth_clients ADD COLUMN IF NOT EXISTS scopes TEXT[] NOT NULL DEFAULT '{}';
+
+-- Client assertion jti values seen (private_key_jwt), kept until the assertion expires to refuse replays
+CREATE TABLE IF NOT EXISTS public.oauth_client_assertions (
+    client_id VARCHAR(64) NOT NULL,
+    jti VARCHAR(128) NOT NULL,
+    expires_at TIMESTAMPTZ NOT NULL,
+    PRIMARY KEY (client_id, jti),
+    FOREIGN KEY (client_id) REFERENCES public.oauth_clients(client_id) ON DELETE CASCADE
+);
+CREATE INDEX IF NOT EXISTS idx_oauth_client_assertions_expires ON public.oauth_client_assertions(expires_at);
+
+-- Pending authorization codes (only the SHA-256 of the code is stored)
+CREATE TABLE IF NOT EXISTS public.oauth_authorization_codes (
+    code_hash VARCHAR(64) PRIMARY KEY,
+    client_id VARCHAR(64) NOT NULL,
+    user_id VARCHAR(36) NOT NULL,
+    redirect_uri TEXT NOT NULL,
+    scope TEXT NOT NULL,
+    nonce TEXT NOT NULL DEFAULT '',
+    code_challenge VARCHAR(128) NOT NULL,
+    auth_time TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+    expires_at TIMESTAMP NOT NULL,
+    FOREIGN KEY (client_id) REFERENCES public.oauth_clients(client_id) ON DELETE CASCADE,
+    FOREIGN KEY (user_id) REFERENCES public.users(id) ON DELETE CASCADE
+);
+CREATE INDEX IF NOT EXISTS idx_oauth_authorization_codes_expires ON public.oauth_authorization_codes(expires_at);
+
+-- Codes no longer carry the login session's tokens; clients get scoped tokens instead
+ALTER TABLE public.oauth_authorization_codes DROP COLUMN IF EXISTS sealed_tokens;
+
+-- RFC 8628 device authorization requests (only the SHA-256 of the device code is stored)
+CREATE TABLE IF NOT EXISTS public.oauth_device_codes (
+    device_code_hash VARCHAR(64) PRIMARY KEY,
+    user_code VARCHAR(9) UNIQUE NOT NULL,
+    client_id VARCHAR(64) NOT NULL,
+    scope TEXT NOT NULL,
+    status VARCHAR(16) NOT NULL DEFAULT 'pending' CHECK (status IN ('pending', 'approved', 'denied')),
+    user_id VARCHAR(36) DEFAULT NULL,
+    poll_interval INTEGER NOT NULL DEFAULT 5,
+    last_polled_at TIMESTAMPTZ DEFAULT NULL,
+    expires_at TIMESTAMP NOT NULL,
+    FOREIGN KEY (client_id) REFERENCES public.oauth_clients(client_id) ON DELETE CASCADE,
+    FOREIGN KEY (user_id) REFERENCES public.users(id) ON DELETE CASCADE
+);
+CREATE INDEX IF NOT EXISTS idx_oauth_device_codes_expires ON public.oauth_device_codes(expires_at);
+
+-- Scoped sessions from the device grant and authorization codes; the refresh token is replaced on every use
+CREATE TABLE IF NOT EXISTS public.oauth_device_sessions (
+    id VARCHAR(36) PRIMARY KEY DEFAULT gen_random_uuid()::TEXT,
+    user_id VARCHAR(36) NOT NULL,
+    client_id VARCHAR(64) NOT NULL,
+    scope TEXT NOT NULL,
+    refresh_token_hash VARCHAR(64) UNIQUE NOT NULL,
+    created_at TIMESTAMP NOT NULL DEFAULT NOW(),
+    last_used_at TIMESTAMP NOT NULL DEFAULT NOW(),
+    expires_at TIMESTAMP NOT NULL,
+    revoked_at TIMESTAMP DEFAULT NULL,
+    FOREIGN KEY (client_id) REFERENCES public.oauth_clients(client_id) ON DELETE CASCADE,
+    FOREIGN KEY (user_id) REFERENCES public.users(id) ON DELETE CASCADE
+);
+CREATE INDEX IF NOT EXISTS idx_oauth_device_sessions_user ON public.oauth_device_sessions(user_id);
+
 -- Function to update updated_at timestamp
 CREATE OR REPLACE FUNCTION public.update_updated_at_column()
 RETURNS TRIGGER AS $$
@@ -72,6 +368,60 @@ CREATE TABLE IF NOT EXISTS public.discord_verifications (
 CREATE INDEX IF NOT EXISTS idx_discord_verifications_discord_id ON public.discord_verifications(discord_id);
 CREATE INDEX IF NOT EXISTS idx_discord_verifications_expires ON public.discord_verifications(expires_at);
 
+-- Game accounts being created for a Discord verification: written before the tUser insert and
+-- finished in the link transaction, so the reconciler can remove tUser rows that were never linked
+CREATE TABLE IF NOT EXISTS public.game_account_provisions (
+    id BIGSERIAL PRIMARY KEY,
+    user_id VARCHAR(36) NOT NULL,
+    game_username VARCHAR(255) NOT NULL,
+    game_account_id INTEGER DEFAULT NULL,
+    status TEXT NOT NULL DEFAULT 'creating' CHECK (status IN ('creating', 'linked', 'compensated')),
+    last_error TEXT DEFAULT NULL,
+    created_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+    updated_at TIMESTAMPTZ NOT NULL DEFAULT NOW()
+);
+
+CREATE INDEX IF NOT EXISTS idx_game_account_provisions_creating ON public.game_account_provisions(created_at) WHERE status = 'creating';
+
+-- Notifications for the Discord bot, written in the same transaction as the change they announce.
+-- The dispatcher retries with backoff; 'dead' = gave up, an admin can replay it.
+CREATE TABLE IF NOT EXISTS public.bot_outbox (
+    id BIGSERIAL PRIMARY KEY,
+    kind TEXT NOT NULL,
+    payload JSONB NOT NULL,
+    status TEXT NOT NULL DEFAULT 'pending' CHECK (status IN ('pending', 'delivered', 'dead')),
+    attempts INTEGER NOT NULL DEFAULT 0,
+    last_error TEXT DEFAULT NULL,
+    next_attempt_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+    created_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+    delivered_at TIMESTAMPTZ DEFAULT NULL
+);
+
+CREATE INDEX IF NOT EXISTS idx_bot_outbox_due ON public.bot_outbox(next_attempt_at) WHERE status = 'pending';
+-- Finds earlier pending messages about the same Discord user, which hold later ones back
+CREATE INDEX IF NOT EXISTS idx_bot_outbox_discord ON public.bot_outbox((payload->>'discord_id'), id) WHERE status = 'pending';
+
+-- Single-use launcher login tickets (only the SHA-256 of the ticket is stored)
+CREATE TABLE IF NOT EXISTS public.game_login_tickets (
+    ticket_hash VARCHAR(64) PRIMARY KEY,
+    user_id VARCHAR(36) NOT NULL,
+    game_account_id INTEGER NOT NULL,
+    created_at TIMESTAMP NOT NULL DEFAULT NOW(),
+    expires_at TIMESTAMP NOT NULL,
+    used_at TIMESTAMP DEFAULT NULL,
+    FOREIGN KEY (user_id) REFERENCES public.users(id) ON DELETE CASCADE
+);
+
+CREATE INDEX IF NOT EXISTS idx_game_login_tickets_expires ON public.game_login_tickets(expires_at);
+
+-- Last run of each scheduler job, so replicas don't run a job again within its interval
+CREATE TABLE IF NOT EXISTS public.scheduler_runs (
+    job TEXT PRIMARY KEY,
+    last_started_at TIMESTAMPTZ NOT NULL,
+    last_finished_at TIMESTAMPTZ DEFAULT NULL,
+    last_error TEXT DEFAULT NULL
+);
+
 -- ============================================
 -- FORUM SCHEMA
 -- ============================================
@@ -191,6 +541,26 @@ CREATE TABLE IF NOT EXISTS dashboard.item_mall_purchases (
     FOREIGN KEY (item_id) REFERENCES dashboard.items(id) ON DELETE CASCADE
 );
 
+-- Item mall orders: balance is reserved first, goods are delivered, then the order completes or is refunded.
+-- delivered_count is how many of the item's contents (ordered by item_contents.id) reached the game account.
+CREATE TABLE IF NOT EXISTS dashboard.orders (
+    id SERIAL PRIMARY KEY,
+    user_id TEXT NOT NULL,
+    item_id INTEGER NOT NULL,
+    quantity INTEGER NOT NULL DEFAULT 1,
+    total_cost INTEGER NOT NULL,
+    status TEXT NOT NULL DEFAULT 'delivering' CHECK (status IN ('delivering', 'completed', 'failed', 'refunded')),
+    delivered_count INTEGER NOT NULL DEFAULT 0,
+    last_error TEXT DEFAULT NULL,
+    created_at TIMESTAMP NOT NULL DEFAULT NOW(),
+    updated_at TIMESTAMP NOT NULL DEFAULT NOW(),
+    FOREIGN KEY (user_id) REFERENCES public.users(id) ON DELETE CASCADE,
+    FOREIGN KEY (item_id) REFERENCES dashboard.items(id) ON DELETE CASCADE
+);
+
+-- The delivery working on an order; a refund or retry replaces it so a stale delivery can't write
+ALTER TABLE dashboard.orders ADD COLUMN IF NOT EXISTS claim_id TEXT DEFAULT NULL;
+
 CREATE TABLE IF NOT EXISTS dashboard.credit_purchases (
     id SERIAL PRIMARY KEY,
     user_id TEXT NOT NULL,
@@ -228,9 +598,46 @@ CREATE TABLE IF NOT EXISTS dashboard.voucher_redemptions (
     UNIQUE(user_id, voucher_id)
 );
 
+-- Delivery progress of a redemption, tracked like dashboard.orders; redemptions from before
+-- this was tracked count as completed
+ALTER TABLE dashboard.voucher_redemptions ADD COLUMN IF NOT EXISTS status TEXT NOT NULL DEFAULT 'completed' CHECK (status IN ('delivering', 'completed', 'failed'));
+ALTER TABLE dashboard.voucher_redemptions ADD COLUMN IF NOT EXISTS delivered_count INTEGER NOT NULL DEFAULT 0;
+ALTER TABLE dashboard.voucher_redemptions ADD COLUMN IF NOT EXISTS last_error TEXT DEFAULT NULL;
+ALTER TABLE dashboard.voucher_redemptions ADD COLUMN IF NOT EXISTS updated_at TIMESTAMP NOT NULL DEFAULT NOW();
+ALTER TABLE dashboard.voucher_redemptions ADD COLUMN IF NOT EXISTS claim_id TEXT DEFAULT NULL;
+
+-- Every credit and debit of users.balance. A user's entries sum to their balance; the
+-- check-balance-drift job reports any difference, and a 'reconciliation' entry is only
+-- written when an admin accepts it.
+CREATE TABLE IF NOT EXISTS public.balance_ledger (
+    id BIGSERIAL PRIMARY KEY,
+    user_id TEXT NOT NULL,
+    amount INTEGER NOT NULL,
+    balance_after INTEGER NOT NULL,
+    kind TEXT NOT NULL CHECK (kind IN ('opening', 'purchase', 'top_up', 'refund', 'admin_grant', 'admin_deduction', 'reconciliation')),
+    reference TEXT DEFAULT NULL,
+    reason TEXT DEFAULT NULL,
+    actor_id TEXT DEFAULT NULL,
+    created_at TIMESTAMP NOT NULL DEFAULT NOW(),
+    FOREIGN KEY (user_id) REFERENCES public.users(id) ON DELETE CASCADE
+);
+
+CREATE INDEX IF NOT EXISTS idx_balance_ledger_user ON public.balance_ledger(user_id, id);
+
+-- Opening entries for balances held before the ledger existed
+INSERT INTO public.balance_ledger (user_id, amount, balance_after, kind, reason)
+SELECT u.id, u.balance, u.balance, 'opening', 'balance before the ledger'
+FROM public.users u
+WHERE COALESCE(u.balance, 0) <> 0
+  AND NOT EXISTS (SELECT 1 FROM public.balance_ledger l WHERE l.user_id = u.id);
+
 CREATE INDEX IF NOT EXISTS idx_credit_purchases_user ON dashboard.credit_purchases(user_id);
 CREATE INDEX IF NOT EXISTS idx_credit_purchases_status ON dashboard.credit_purchases(status);
+-- A payment is credited once, however often the payment flow posts it
+CREATE UNIQUE INDEX IF NOT EXISTS idx_credit_purchases_payment ON dashboard.credit_purchases(payment_id) WHERE payment_id IS NOT NULL;
 CREATE INDEX IF NOT EXISTS idx_purchases_user ON dashboard.item_mall_purchases(user_id);
+CREATE INDEX IF NOT EXISTS idx_orders_user ON dashboard.orders(user_id);
+CREATE INDEX IF NOT EXISTS idx_orders_status ON dashboard.orders(status);
 CREATE INDEX IF NOT EXISTS idx_vouchers_code ON dashboard.vouchers(code);
 CREATE INDEX IF NOT EXISTS idx_voucher_contents_voucher ON dashboard.voucher_contents(voucher_id);
 CREATE INDEX IF NOT EXISTS idx_voucher_redemptions_user ON dashboard.voucher_redemptions(user_id);
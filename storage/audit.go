@@ -0,0 +1,312 @@
+package storage
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Audit actor types
+const (
+	AuditActorUser    = "user"
+	AuditActorService = "service" // a client credentials token
+	AuditActorSystem  = "system"  // background jobs
+)
+
+// auditLockKey is the advisory lock that serializes appends, so every event
+// chains onto the one committed before it
+const auditLockKey = 0x61756469
+
+// AuditEvent is one row of the append-only audit log. Hash covers the event and the
+// previous event's hash, so changing or removing a row breaks the chain after it.
+type AuditEvent struct {
+	ID         int64           `json:"id"`
+	OccurredAt time.Time       `json:"occurred_at"`
+	ActorType  string          `json:"actor_type"`
+	ActorID    string          `json:"actor_id,omitempty"`
+	Action     string          `json:"action"`
+	TargetType string          `json:"target_type"`
+	TargetID   string          `json:"target_id"`
+	Before     json.RawMessage `json:"before,omitempty"`
+	After      json.RawMessage `json:"after,omitempty"`
+	IP         string          `json:"ip,omitempty"`
+	RequestID  string          `json:"request_id,omitempty"`
+	PrevHash   string          `json:"prev_hash"`
+	Hash       string          `json:"hash"`
+}
+
+// AuditRepository writes and reads public.audit_events
+type AuditRepository struct {
+	db *sql.DB
+}
+
+func NewAuditRepository(db *sql.DB) *AuditRepository {
+	return &AuditRepository{db: db}
+}
+
+const auditColumns = `id, occurred_at, actor_type, actor_id, action, target_type, target_id, before, after, ip_address, request_id, prev_hash, hash`
+
+func scanAuditEvent(row interface{ Scan(...any) error }) (*AuditEvent, error) {
+	var e AuditEvent
+	var actorID, ip, requestID sql.NullString
+	var before, after []byte
+	err := row.Scan(&e.ID, &e.OccurredAt, &e.ActorType, &actorID, &e.Action, &e.TargetType, &e.TargetID,
+		&before, &after, &ip, &requestID, &e.PrevHash, &e.Hash)
+	if err != nil {
+		return nil, err
+	}
+	e.ActorID = actorID.String
+	e.IP = ip.String
+	e.RequestID = requestID.String
+	if e.Before, err = canonicalJSON(before); err != nil {
+		return nil, err
+	}
+	if e.After, err = canonicalJSON(after); err != nil {
+		return nil, err
+	}
+	return &e, nil
+}
+
+// AppendAudit adds an event to the end of the chain in its own transaction. Use AppendAuditTx
+// instead when the event records a change made in a transaction, so both commit together.
+func (r *AuditRepository) AppendAudit(e *AuditEvent, before, after any) error {
+	tx, err := r.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if err := AppendAuditTx(tx, e, before, after); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// AppendAuditTx adds an event to the end of the chain inside tx. before and after are
+// marshalled to JSON and may be nil. ID, OccurredAt and the hashes are filled in on e.
+// It holds the chain's lock until tx ends, so call it as the last step before committing.
+func AppendAuditTx(tx *sql.Tx, e *AuditEvent, before, after any) error {
+	var err error
+	if e.Before, err = marshalCanonical(before); err != nil {
+		return err
+	}
+	if e.After, err = marshalCanonical(after); err != nil {
+		return err
+	}
+
+	if _, err := tx.Exec(`SELECT pg_advisory_xact_lock($1)`, auditLockKey); err != nil {
+		return err
+	}
+
+	err = tx.QueryRow(`SELECT hash FROM public.audit_events ORDER BY id DESC LIMIT 1`).Scan(&e.PrevHash)
+	if err != nil && err != sql.ErrNoRows {
+		return err
+	}
+
+	// Postgres keeps microseconds, so the hash is computed over what will be read back
+	e.OccurredAt = time.Now().UTC().Truncate(time.Microsecond)
+	e.Hash = e.computeHash()
+
+	return tx.QueryRow(`
+		INSERT INTO public.audit_events (occurred_at, actor_type, actor_id, action, target_type, target_id,
+			before, after, ip_address, request_id, prev_hash, hash)
+		VALUES ($1, $2, NULLIF($3, ''), $4, $5, $6, $7, $8, NULLIF($9, ''), NULLIF($10, ''), $11, $12)
+		RETURNING id
+	`, e.OccurredAt, e.ActorType, e.ActorID, e.Action, e.TargetType, e.TargetID,
+		nullJSON(e.Before), nullJSON(e.After), e.IP, e.RequestID, e.PrevHash, e.Hash).Scan(&e.ID)
+}
+
+// appendAuditTx is AppendAuditTx for repository methods that take an optional event;
+// a nil event, as passed by tests, is not recorded
+func appendAuditTx(tx *sql.Tx, e *AuditEvent, before, after any) error {
+	if e == nil {
+		return nil
+	}
+	return AppendAuditTx(tx, e, before, after)
+}
+
+// computeHash is the hex SHA-256 of the previous hash and the event's fields
+func (e *AuditEvent) computeHash() string {
+	data, _ := json.Marshal([]any{
+		e.PrevHash,
+		e.OccurredAt.UTC().Format(time.RFC3339Nano),
+		e.ActorType, e.ActorID,
+		e.Action, e.TargetType, e.TargetID,
+		e.Before, e.After,
+		e.IP, e.RequestID,
+	})
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+// AuditFilter selects a page of audit events. Zero values mean no filter.
+type AuditFilter struct {
+	ActorID    string
+	Action     string // exact action, or a prefix ending in "." such as "discord."
+	TargetType string
+	TargetID   string
+	Since      time.Time
+	Until      time.Time
+	Cursor     string // NextCursor of the previous page
+	Limit      int
+}
+
+// AuditPage is one page of ListAudit, newest first
+type AuditPage struct {
+	Events     []*AuditEvent `json:"events"`
+	NextCursor string        `json:"next_cursor,omitempty"`
+}
+
+// ListAudit returns audit events matching f, newest first (admin function).
+// Returns ErrInvalidCursor if f.Cursor is malformed.
+func (r *AuditRepository) ListAudit(f AuditFilter) (*AuditPage, error) {
+	var where []string
+	var args []any
+	arg := func(v any) string {
+		args = append(args, v)
+		return "$" + strconv.Itoa(len(args))
+	}
+
+	if f.ActorID != "" {
+		where = append(where, "actor_id = "+arg(f.ActorID))
+	}
+	if prefix, ok := strings.CutSuffix(f.Action, "."); ok {
+		where = append(where, "action LIKE "+arg(escapeLike(prefix)+".%"))
+	} else if f.Action != "" {
+		where = append(where, "action = "+arg(f.Action))
+	}
+	if f.TargetType != "" {
+		where = append(where, "target_type = "+arg(f.TargetType))
+	}
+	if f.TargetID != "" {
+		where = append(where, "target_id = "+arg(f.TargetID))
+	}
+	if !f.Since.IsZero() {
+		where = append(where, "occurred_at >= "+arg(f.Since))
+	}
+	if !f.Until.IsZero() {
+		where = append(where, "occurred_at < "+arg(f.Until))
+	}
+	if f.Cursor != "" {
+		beforeID, err := strconv.ParseInt(f.Cursor, 10, 64)
+		if err != nil || beforeID <= 0 {
+			return nil, ErrInvalidCursor
+		}
+		where = append(where, "id < "+arg(beforeID))
+	}
+	if f.Limit <= 0 {
+		f.Limit = 100
+	}
+
+	filter := ""
+	if len(where) > 0 {
+		filter = "WHERE " + strings.Join(where, " AND ")
+	}
+
+	rows, err := r.db.Query(`
+		SELECT `+auditColumns+`
+		FROM public.audit_events
+		`+filter+`
+		ORDER BY id DESC
+		LIMIT `+arg(f.Limit+1), args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	page := AuditPage{Events: []*AuditEvent{}}
+	for rows.Next() {
+		e, err := scanAuditEvent(rows)
+		if err != nil {
+			return nil, err
+		}
+		page.Events = append(page.Events, e)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	if len(page.Events) > f.Limit {
+		page.Events = page.Events[:f.Limit]
+		page.NextCursor = strconv.FormatInt(page.Events[f.Limit-1].ID, 10)
+	}
+
+	return &page, nil
+}
+
+// AuditChainReport is the result of VerifyAuditChain
+type AuditChainReport struct {
+	Checked  int    `json:"checked"`
+	Valid    bool   `json:"valid"`
+	BrokenAt int64  `json:"broken_at,omitempty"` // first event whose hash or link doesn't match
+	LastHash string `json:"last_hash,omitempty"` // note it down to detect removal of the newest events later
+}
+
+// VerifyAuditChain recomputes every hash from the start of the log
+func (r *AuditRepository) VerifyAuditChain() (*AuditChainReport, error) {
+	rows, err := r.db.Query(`SELECT ` + auditColumns + ` FROM public.audit_events ORDER BY id`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	report := AuditChainReport{Valid: true}
+	for rows.Next() {
+		e, err := scanAuditEvent(rows)
+		if err != nil {
+			return nil, err
+		}
+		report.Checked++
+
+		if e.PrevHash != report.LastHash || e.computeHash() != e.Hash {
+			report.Valid = false
+			report.BrokenAt = e.ID
+			return &report, nil
+		}
+		report.LastHash = e.Hash
+	}
+
+	return &report, rows.Err()
+}
+
+// marshalCanonical encodes v as canonical JSON, nil for a nil v
+func marshalCanonical(v any) (json.RawMessage, error) {
+	if v == nil {
+		return nil, nil
+	}
+	data, err := json.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+	return canonicalJSON(data)
+}
+
+// canonicalJSON re-encodes JSON with sorted keys and no whitespace, so a value hashes the
+// same before it's stored and after jsonb has normalized it
+func canonicalJSON(data []byte) (json.RawMessage, error) {
+	if len(data) == 0 || bytes.Equal(data, []byte("null")) {
+		return nil, nil
+	}
+
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.UseNumber()
+	var v any
+	if err := dec.Decode(&v); err != nil {
+		return nil, err
+	}
+	return json.Marshal(v)
+}
+
+// nullJSON stores an empty value as SQL NULL
+func nullJSON(data json.RawMessage) any {
+	if data == nil {
+		return nil
+	}
+	return []byte(data)
+}
@@ -0,0 +1,196 @@
+package storage
+
+import (
+	"database/sql"
+	"time"
+)
+
+// Ban Methods
+
+// activeBan matches user_bans rows still in force
+const activeBan = `lifted_at IS NULL AND (expires_at IS NULL OR expires_at > NOW())`
+
+// Ban is a suspension of a user, permanent when ExpiresAt is nil
+type Ban struct {
+	ID          int64      `json:"id"`
+	UserID      string     `json:"user_id"`
+	Reason      string     `json:"reason"`
+	BannedBy    string     `json:"banned_by"`
+	CreatedAt   time.Time  `json:"created_at"`
+	ExpiresAt   *time.Time `json:"expires_at"`
+	LiftedAt    *time.Time `json:"lifted_at,omitempty"`
+	LiftedBy    string     `json:"lifted_by,omitempty"`
+	GameBlocked bool       `json:"game_blocked"` // tUser.bIsBlock was set for this ban and not cleared yet
+}
+
+const banColumns = `id, user_id, reason, banned_by, created_at, expires_at, lifted_at, lifted_by, game_blocked`
+
+func scanBan(row interface{ Scan(...any) error }) (*Ban, error) {
+	var b Ban
+	var expiresAt, liftedAt sql.NullTime
+	var liftedBy sql.NullString
+	err := row.Scan(&b.ID, &b.UserID, &b.Reason, &b.BannedBy, &b.CreatedAt, &expiresAt, &liftedAt, &liftedBy, &b.GameBlocked)
+	if err != nil {
+		return nil, err
+	}
+	if expiresAt.Valid {
+		b.ExpiresAt = &expiresAt.Time
+	}
+	if liftedAt.Valid {
+		b.LiftedAt = &liftedAt.Time
+	}
+	b.LiftedBy = liftedBy.String
+	return &b, nil
+}
+
+// BanUser suspends a user until expiresAt, or permanently if it's nil. A ban already in
+// force is replaced. The ban is recorded as audit in the same transaction.
+// Returns sql.ErrNoRows if the user doesn't exist.
+func (r *ExtendedUserRepository) BanUser(userID, reason, bannedBy string, expiresAt *time.Time, audit *AuditEvent) (*Ban, error) {
+	tx, err := r.db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	var id string
+	if err := tx.QueryRow(`SELECT id FROM public.users WHERE id = $1 FOR UPDATE`, userID).Scan(&id); err != nil {
+		return nil, err
+	}
+
+	// The game block carries over to the new ban
+	var gameBlocked bool
+	err = tx.QueryRow(`
+		WITH lifted AS (
+			UPDATE public.user_bans
+			SET lifted_at = NOW(), lifted_by = $1, game_blocked = false
+			WHERE user_id = $2 AND `+activeBan+`
+			RETURNING game_blocked
+		)
+		SELECT EXISTS (SELECT 1 FROM lifted WHERE game_blocked)
+	`, bannedBy, userID).Scan(&gameBlocked)
+	if err != nil {
+		return nil, err
+	}
+
+	ban, err := scanBan(tx.QueryRow(`
+		INSERT INTO public.user_bans (user_id, reason, banned_by, expires_at, game_blocked)
+		VALUES ($1, $2, $3, $4, $5)
+		RETURNING `+banColumns,
+		userID, reason, bannedBy, expiresAt, gameBlocked))
+	if err != nil {
+		return nil, err
+	}
+
+	if err := appendAuditTx(tx, audit, nil, ban); err != nil {
+		return nil, err
+	}
+
+	return ban, tx.Commit()
+}
+
+// LiftBan ends the ban in force early and records audit in the same transaction.
+// Returns sql.ErrNoRows if the user isn't banned.
+func (r *ExtendedUserRepository) LiftBan(userID, liftedBy string, audit *AuditEvent) (*Ban, error) {
+	tx, err := r.db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	ban, err := scanBan(tx.QueryRow(`
+		UPDATE public.user_bans
+		SET lifted_at = NOW(), lifted_by = $1
+		WHERE user_id = $2 AND `+activeBan+`
+		RETURNING `+banColumns,
+		liftedBy, userID))
+	if err != nil {
+		return nil, err
+	}
+
+	if err := appendAuditTx(tx, audit, ban, nil); err != nil {
+		return nil, err
+	}
+
+	return ban, tx.Commit()
+}
+
+// ActiveBan returns the ban in force for a user. Returns sql.ErrNoRows if there is none.
+func (r *ExtendedUserRepository) ActiveBan(userID string) (*Ban, error) {
+	return scanBan(r.db.QueryRow(`
+		SELECT `+banColumns+`
+		FROM public.user_bans
+		WHERE user_id = $1 AND `+activeBan+`
+		ORDER BY id DESC
+		LIMIT 1
+	`, userID))
+}
+
+// ListBans returns a user's bans, newest first (admin function)
+func (r *ExtendedUserRepository) ListBans(userID string) ([]*Ban, error) {
+	rows, err := r.db.Query(`
+		SELECT `+banColumns+`
+		FROM public.user_bans
+		WHERE user_id = $1
+		ORDER BY id DESC
+	`, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	bans := []*Ban{}
+	for rows.Next() {
+		b, err := scanBan(rows)
+		if err != nil {
+			return nil, err
+		}
+		bans = append(bans, b)
+	}
+
+	return bans, rows.Err()
+}
+
+// SetBanGameBlocked records whether tUser.bIsBlock is set for a ban
+func (r *ExtendedUserRepository) SetBanGameBlocked(banID int64, blocked bool) error {
+	_, err := r.db.Exec(`UPDATE public.user_bans SET game_blocked = $1 WHERE id = $2`, blocked, banID)
+	return err
+}
+
+// ExpiredGameBlock is a ban that ended while its game account is still blocked
+type ExpiredGameBlock struct {
+	BanID         int64
+	UserID        string
+	GameAccountID int
+}
+
+// ListExpiredGameBlocks returns bans that expired, or were lifted without the game account
+// being unblocked, while no other ban is in force for the user
+func (r *ExtendedUserRepository) ListExpiredGameBlocks() ([]*ExpiredGameBlock, error) {
+	rows, err := r.db.Query(`
+		SELECT b.id, b.user_id, u.game_account_id
+		FROM public.user_bans b
+		JOIN public.users u ON u.id = b.user_id
+		WHERE b.game_blocked
+		  AND NOT (` + activeBan + `)
+		  AND u.game_account_id IS NOT NULL
+		  AND NOT EXISTS (SELECT 1 FROM public.user_bans a WHERE a.user_id = b.user_id AND ` + activeBan + `)
+		ORDER BY b.id
+		LIMIT 100
+	`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	blocks := []*ExpiredGameBlock{}
+	for rows.Next() {
+		var b ExpiredGameBlock
+		if err := rows.Scan(&b.BanID, &b.UserID, &b.GameAccountID); err != nil {
+			return nil, err
+		}
+		blocks = append(blocks, &b)
+	}
+
+	return blocks, rows.Err()
+}
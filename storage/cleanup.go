@@ -0,0 +1,106 @@
+package storage
+
+import (
+	"database/sql"
+	"time"
+)
+
+// Maintenance Methods
+//
+// Run by the scheduler. Each returns the number of rows removed.
+
+// purge runs a DELETE and returns how many rows it removed
+func purge(db *sql.DB, query string, args ...any) (int64, error) {
+	result, err := db.Exec(query, args...)
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected()
+}
+
+// PurgeExpiredRefreshTokens removes refresh tokens past their expiry. Their lineage
+// is kept, so presenting a rotated token is still detected as reuse.
+func (r *SessionRepository) PurgeExpiredRefreshTokens() (int64, error) {
+	return purge(r.db, `DELETE FROM public.refresh_tokens WHERE expires_at < NOW()`)
+}
+
+// PurgeEndedSessions removes session families, with their lineage, that issued no token
+// within retention and hold no live refresh token
+func (r *SessionRepository) PurgeEndedSessions(retention time.Duration) (int64, error) {
+	return purge(r.db, `
+		DELETE FROM public.refresh_token_families f
+		WHERE f.created_at < NOW() - make_interval(secs => $1)
+		  AND NOT EXISTS (
+			SELECT 1 FROM public.refresh_token_lineage l
+			WHERE l.family_id = f.id AND l.issued_at >= NOW() - make_interval(secs => $1)
+		  )
+		  AND NOT EXISTS (
+			SELECT 1 FROM public.refresh_token_lineage l
+			JOIN public.refresh_tokens rt ON rt.token_hash = l.token_hash AND rt.user_id = f.user_id
+			WHERE l.family_id = f.id
+		  )
+	`, retention.Seconds())
+}
+
+// PurgeExpiredAccessTokenRevocations removes denylist entries for access tokens that have expired anyway
+func (r *SessionRepository) PurgeExpiredAccessTokenRevocations() (int64, error) {
+	return purge(r.db, `DELETE FROM public.revoked_access_tokens WHERE expires_at < NOW()`)
+}
+
+// PurgeStaleDiscordVerifications removes verification tokens, used or not, that expired
+// more than retention ago. They're kept that long to help with support requests.
+func (r *ExtendedUserRepository) PurgeStaleDiscordVerifications(retention time.Duration) (int64, error) {
+	return purge(r.db, `
+		DELETE FROM public.discord_verifications
+		WHERE expires_at < NOW() - make_interval(secs => $1)
+	`, retention.Seconds())
+}
+
+// PurgeExpiredGameLoginTickets removes launcher tickets past their expiry
+func (r *ExtendedUserRepository) PurgeExpiredGameLoginTickets() (int64, error) {
+	return purge(r.db, `DELETE FROM public.game_login_tickets WHERE expires_at < NOW()`)
+}
+
+// PurgeExpiredPasswordResetTokens removes reset tokens past their expiry
+func (r *ExtendedUserRepository) PurgeExpiredPasswordResetTokens() (int64, error) {
+	return purge(r.db, `DELETE FROM public.password_reset_tokens WHERE expires_at < NOW()`)
+}
+
+// PurgeDeliveredOutbox removes outbox messages delivered more than retention ago.
+// Dead messages are kept until an admin replays them.
+func (r *ExtendedUserRepository) PurgeDeliveredOutbox(retention time.Duration) (int64, error) {
+	return purge(r.db, `
+		DELETE FROM public.bot_outbox
+		WHERE status = $1 AND delivered_at < NOW() - make_interval(secs => $2)
+	`, OutboxDelivered, retention.Seconds())
+}
+
+// PurgeExpiredMFATokens removes expired login challenges and step-up tokens
+func (r *MFARepository) PurgeExpiredMFATokens() (int64, error) {
+	challenges, err := purge(r.db, `DELETE FROM public.mfa_challenges WHERE expires_at < NOW()`)
+	if err != nil {
+		return 0, err
+	}
+
+	stepUps, err := purge(r.db, `DELETE FROM public.mfa_step_up_tokens WHERE expires_at < NOW()`)
+	return challenges + stepUps, err
+}
+
+// PurgeExpiredGrants removes expired authorization codes, device codes, client assertion
+// jtis, and device sessions that have expired or were revoked
+func (r *OAuthRepository) PurgeExpiredGrants() (int64, error) {
+	var total int64
+	for _, query := range []string{
+		`DELETE FROM public.oauth_authorization_codes WHERE expires_at < NOW()`,
+		`DELETE FROM public.oauth_device_codes WHERE expires_at < NOW()`,
+		`DELETE FROM public.oauth_client_assertions WHERE expires_at < NOW()`,
+		`DELETE FROM public.oauth_device_sessions WHERE expires_at < NOW() OR revoked_at IS NOT NULL`,
+	} {
+		n, err := purge(r.db, query)
+		if err != nil {
+			return total, err
+		}
+		total += n
+	}
+	return total, nil
+}
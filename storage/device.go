@@ -0,0 +1,206 @@
+package storage
+
+import (
+	"database/sql"
+	"errors"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// Device Authorization Grant Methods (RFC 8628)
+
+var (
+	// ErrDeviceCodeExpired is returned when polling with a device code whose request expired
+	ErrDeviceCodeExpired = errors.New("device code expired")
+	// ErrUserCodeTaken is returned when a new request's user code is already in use
+	ErrUserCodeTaken = errors.New("user code already in use")
+)
+
+const (
+	DeviceCodePending  = "pending"
+	DeviceCodeApproved = "approved"
+	DeviceCodeDenied   = "denied"
+)
+
+type DeviceCode struct {
+	UserCode   string    `json:"user_code"`
+	ClientID   string    `json:"client_id"`
+	ClientName string    `json:"client_name"`
+	Scope      string    `json:"scope"`
+	Status     string    `json:"-"`
+	UserID     string    `json:"-"`
+	ExpiresAt  time.Time `json:"expires_at"`
+	SlowDown   bool      `json:"-"` // polled faster than the interval
+}
+
+type DeviceSession struct {
+	UserID   string
+	ClientID string
+	Scope    string
+}
+
+// CreateDeviceCode stores a pending device authorization request.
+// Returns ErrUserCodeTaken if another request has the same user code.
+func (r *OAuthRepository) CreateDeviceCode(deviceCodeHash, userCode, clientID, scope string, interval int, expiresAt time.Time) error {
+	_, err := r.db.Exec(`
+		INSERT INTO public.oauth_device_codes (device_code_hash, user_code, client_id, scope, poll_interval, expires_at)
+		VALUES ($1, $2, $3, $4, $5, $6)
+	`, deviceCodeHash, userCode, clientID, scope, interval, expiresAt)
+
+	var pqErr *pq.Error
+	if errors.As(err, &pqErr) && pqErr.Code == "23505" && pqErr.Constraint == "oauth_device_codes_user_code_key" {
+		return ErrUserCodeTaken
+	}
+	return err
+}
+
+// GetPendingDeviceCode looks up a request by the code the user typed in.
+// Returns sql.ErrNoRows if it's unknown, expired or already decided.
+func (r *OAuthRepository) GetPendingDeviceCode(userCode string) (*DeviceCode, error) {
+	var d DeviceCode
+	err := r.db.QueryRow(`
+		SELECT d.user_code, d.client_id, c.name, d.scope, d.status, d.expires_at
+		FROM public.oauth_device_codes d
+		JOIN public.oauth_clients c ON c.client_id = d.client_id
+		WHERE d.user_code = $1
+		  AND d.status = 'pending'
+		  AND d.expires_at > NOW()
+	`, userCode).Scan(&d.UserCode, &d.ClientID, &d.ClientName, &d.Scope, &d.Status, &d.ExpiresAt)
+	if err != nil {
+		return nil, err
+	}
+	return &d, nil
+}
+
+// DecideDeviceCode approves or denies a pending request on behalf of userID.
+// Returns sql.ErrNoRows if it's unknown, expired or already decided.
+func (r *OAuthRepository) DecideDeviceCode(userCode, userID string, approve bool) error {
+	status := DeviceCodeDenied
+	if approve {
+		status = DeviceCodeApproved
+	}
+
+	result, err := r.db.Exec(`
+		UPDATE public.oauth_device_codes
+		SET status = $1, user_id = $2
+		WHERE user_code = $3
+		  AND status = 'pending'
+		  AND expires_at > NOW()
+	`, status, userID, userCode)
+	if err != nil {
+		return err
+	}
+
+	if n, _ := result.RowsAffected(); n == 0 {
+		return sql.ErrNoRows
+	}
+	return nil
+}
+
+// PollDeviceCode records a poll from the client and returns the request's state.
+// A decided request is deleted as it's returned, so its tokens are only handed out once.
+// Returns sql.ErrNoRows if the code is unknown or belongs to another client, and
+// ErrDeviceCodeExpired if the user never decided in time.
+func (r *OAuthRepository) PollDeviceCode(deviceCodeHash, clientID string) (*DeviceCode, error) {
+	tx, err := r.db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	var d DeviceCode
+	var userID sql.NullString
+	var live bool
+	err = tx.QueryRow(`
+		SELECT user_code, client_id, scope, status, user_id, expires_at, expires_at > NOW(),
+			last_polled_at IS NOT NULL AND last_polled_at > NOW() - make_interval(secs => poll_interval)
+		FROM public.oauth_device_codes
+		WHERE device_code_hash = $1
+		FOR UPDATE
+	`, deviceCodeHash).Scan(&d.UserCode, &d.ClientID, &d.Scope, &d.Status, &userID, &d.ExpiresAt, &live, &d.SlowDown)
+	if err != nil {
+		return nil, err
+	}
+	d.UserID = userID.String
+
+	if d.ClientID != clientID {
+		return nil, sql.ErrNoRows
+	}
+
+	switch {
+	case !live:
+		if _, err := tx.Exec(`DELETE FROM public.oauth_device_codes WHERE device_code_hash = $1`, deviceCodeHash); err != nil {
+			return nil, err
+		}
+		if err := tx.Commit(); err != nil {
+			return nil, err
+		}
+		return nil, ErrDeviceCodeExpired
+
+	case d.SlowDown:
+		_, err = tx.Exec(`
+			UPDATE public.oauth_device_codes
+			SET poll_interval = poll_interval + 5, last_polled_at = NOW()
+			WHERE device_code_hash = $1
+		`, deviceCodeHash)
+
+	case d.Status == DeviceCodePending:
+		_, err = tx.Exec(`UPDATE public.oauth_device_codes SET last_polled_at = NOW() WHERE device_code_hash = $1`, deviceCodeHash)
+
+	default:
+		_, err = tx.Exec(`DELETE FROM public.oauth_device_codes WHERE device_code_hash = $1`, deviceCodeHash)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return &d, tx.Commit()
+}
+
+// CreateDeviceSession stores the refresh token of a newly approved device, or of a client
+// that redeemed an authorization code
+func (r *OAuthRepository) CreateDeviceSession(userID, clientID, scope, refreshTokenHash string, expiresAt time.Time) error {
+	_, err := r.db.Exec(`
+		INSERT INTO public.oauth_device_sessions (user_id, client_id, scope, refresh_token_hash, expires_at)
+		VALUES ($1, $2, $3, $4, $5)
+	`, userID, clientID, scope, refreshTokenHash, expiresAt)
+	return err
+}
+
+// RotateDeviceSession swaps a device refresh token issued to clientID for its replacement.
+// Returns sql.ErrNoRows if the token is unknown, already used, revoked or expired.
+func (r *OAuthRepository) RotateDeviceSession(refreshTokenHash, newRefreshTokenHash, clientID string) (*DeviceSession, error) {
+	var s DeviceSession
+	err := r.db.QueryRow(`
+		UPDATE public.oauth_device_sessions
+		SET refresh_token_hash = $2, last_used_at = NOW()
+		WHERE refresh_token_hash = $1
+		  AND client_id = $3
+		  AND revoked_at IS NULL
+		  AND expires_at > NOW()
+		RETURNING user_id, client_id, scope
+	`, refreshTokenHash, newRefreshTokenHash, clientID).Scan(&s.UserID, &s.ClientID, &s.Scope)
+	if err != nil {
+		return nil, err
+	}
+	return &s, nil
+}
+
+// RevokeDeviceSession ends the device session a refresh token belongs to, if it was issued to clientID.
+// Returns sql.ErrNoRows if the token is unknown, another client's or already revoked.
+func (r *OAuthRepository) RevokeDeviceSession(refreshTokenHash, clientID string) error {
+	result, err := r.db.Exec(`
+		UPDATE public.oauth_device_sessions
+		SET revoked_at = NOW()
+		WHERE refresh_token_hash = $1 AND client_id = $2 AND revoked_at IS NULL
+	`, refreshTokenHash, clientID)
+	if err != nil {
+		return err
+	}
+
+	if n, _ := result.RowsAffected(); n == 0 {
+		return sql.ErrNoRows
+	}
+	return nil
+}
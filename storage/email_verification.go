@@ -0,0 +1,34 @@
+package storage
+
+import "database/sql"
+
+// Email Verification Methods
+
+// GetEmailStatus returns the user's email and whether it has been verified
+func (r *ExtendedUserRepository) GetEmailStatus(userID string) (email string, verified bool, err error) {
+	var verifiedAt sql.NullTime
+	err = r.db.QueryRow(`
+		SELECT email, email_verified_at FROM users WHERE id = $1
+	`, userID).Scan(&email, &verifiedAt)
+	return email, verifiedAt.Valid, err
+}
+
+// MarkEmailVerified verifies the user's email, provided it is still the address the link was sent to.
+// Returns sql.ErrNoRows if the email has changed since.
+func (r *ExtendedUserRepository) MarkEmailVerified(userID, email string) error {
+	result, err := r.db.Exec(`
+		UPDATE users
+		SET email_verified_at = COALESCE(email_verified_at, NOW()), updated_at = CURRENT_TIMESTAMP
+		WHERE id = $1 AND LOWER(email) = LOWER($2)
+	`, userID, email)
+	if err != nil {
+		return err
+	}
+
+	if n, err := result.RowsAffected(); err != nil {
+		return err
+	} else if n == 0 {
+		return sql.ErrNoRows
+	}
+	return nil
+}
@@ -0,0 +1,116 @@
+package storage
+
+import (
+	"database/sql"
+	"time"
+)
+
+// Game account provision statuses
+const (
+	ProvisionCreating    = "creating"    // tUser insert may or may not have happened yet
+	ProvisionLinked      = "linked"      // linked to the user in the same transaction as the link
+	ProvisionCompensated = "compensated" // the game account was removed again, or never created
+)
+
+// GameAccountProvision tracks a game account being created for a Discord verification.
+// It's written before the tUser insert, so a failure or crash before the link leaves a trail.
+type GameAccountProvision struct {
+	ID            int64     `json:"id"`
+	UserID        string    `json:"user_id"`
+	GameUsername  string    `json:"game_username"`
+	GameAccountID int       `json:"game_account_id,omitempty"` // 0 until the tUser insert is recorded
+	Status        string    `json:"status"`
+	LastError     string    `json:"last_error,omitempty"`
+	CreatedAt     time.Time `json:"created_at"`
+}
+
+// StartGameAccountProvision records that a game account is about to be created for userID
+func (r *ExtendedUserRepository) StartGameAccountProvision(userID, gameUsername string) (int64, error) {
+	var id int64
+	err := r.db.QueryRow(`
+		INSERT INTO public.game_account_provisions (user_id, game_username, status)
+		VALUES ($1, $2, $3)
+		RETURNING id
+	`, userID, gameUsername, ProvisionCreating).Scan(&id)
+	return id, err
+}
+
+// RecordGameAccountCreated stores the tUser row a provision created
+func (r *ExtendedUserRepository) RecordGameAccountCreated(provisionID int64, gameAccountID int) error {
+	_, err := r.db.Exec(`
+		UPDATE public.game_account_provisions
+		SET game_account_id = $1, updated_at = NOW()
+		WHERE id = $2
+	`, gameAccountID, provisionID)
+	return err
+}
+
+// finishGameAccountProvision marks a provision linked inside the link transaction
+func finishGameAccountProvision(tx *sql.Tx, provisionID int64, gameAccountID int) error {
+	_, err := tx.Exec(`
+		UPDATE public.game_account_provisions
+		SET status = $1, game_account_id = $2, last_error = NULL, updated_at = NOW()
+		WHERE id = $3
+	`, ProvisionLinked, gameAccountID, provisionID)
+	return err
+}
+
+// CompensateGameAccountProvision closes a provision whose game account was removed or never created
+func (r *ExtendedUserRepository) CompensateGameAccountProvision(provisionID int64, reason string) error {
+	_, err := r.db.Exec(`
+		UPDATE public.game_account_provisions
+		SET status = $1, last_error = $2, updated_at = NOW()
+		WHERE id = $3 AND status = $4
+	`, ProvisionCompensated, reason, provisionID, ProvisionCreating)
+	return err
+}
+
+// FailGameAccountProvision records why compensating a provision failed, leaving it for the reconciler
+func (r *ExtendedUserRepository) FailGameAccountProvision(provisionID int64, reason string) error {
+	_, err := r.db.Exec(`
+		UPDATE public.game_account_provisions
+		SET last_error = $1, updated_at = NOW()
+		WHERE id = $2 AND status = $3
+	`, reason, provisionID, ProvisionCreating)
+	return err
+}
+
+// ListStaleGameAccountProvisions returns provisions still creating after olderThan, which
+// means the request that started them failed without cleaning up or the server stopped
+func (r *ExtendedUserRepository) ListStaleGameAccountProvisions(olderThan time.Duration) ([]*GameAccountProvision, error) {
+	rows, err := r.db.Query(`
+		SELECT id, user_id, game_username, game_account_id, status, last_error, created_at
+		FROM public.game_account_provisions
+		WHERE status = $1 AND created_at < NOW() - make_interval(secs => $2)
+		ORDER BY id
+		LIMIT 100
+	`, ProvisionCreating, olderThan.Seconds())
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	provisions := []*GameAccountProvision{}
+	for rows.Next() {
+		var p GameAccountProvision
+		var gameAccountID sql.NullInt64
+		var lastError sql.NullString
+		if err := rows.Scan(&p.ID, &p.UserID, &p.GameUsername, &gameAccountID, &p.Status, &lastError, &p.CreatedAt); err != nil {
+			return nil, err
+		}
+		p.GameAccountID = int(gameAccountID.Int64)
+		p.LastError = lastError.String
+		provisions = append(provisions, &p)
+	}
+
+	return provisions, rows.Err()
+}
+
+// IsGameAccountLinked reports whether any user is linked to a game account
+func (r *ExtendedUserRepository) IsGameAccountLinked(gameAccountID int) (bool, error) {
+	var linked bool
+	err := r.db.QueryRow(`
+		SELECT EXISTS (SELECT 1 FROM public.users WHERE game_account_id = $1)
+	`, gameAccountID).Scan(&linked)
+	return linked, err
+}
@@ -0,0 +1,311 @@
+package storage
+
+import (
+	"database/sql"
+	"errors"
+	"strconv"
+	"time"
+)
+
+// Balance Ledger Methods
+
+var (
+	// ErrInsufficientBalance is returned for a debit that would take a balance below zero
+	ErrInsufficientBalance = errors.New("insufficient balance")
+	// ErrTopUpRecorded is returned for a payment that was already credited
+	ErrTopUpRecorded = errors.New("payment already credited")
+)
+
+// Ledger entry kinds
+const (
+	LedgerOpening        = "opening"         // balance held before the ledger existed
+	LedgerPurchase       = "purchase"        // item mall order, negative
+	LedgerTopUp          = "top_up"          // credits bought, posted with TopUp
+	LedgerRefund         = "refund"          // item mall order refunded
+	LedgerAdminGrant     = "admin_grant"     // credited by an admin
+	LedgerAdminDeduction = "admin_deduction" // debited by an admin
+	LedgerReconciliation = "reconciliation"  // balance change without an entry, accepted by an admin
+)
+
+// LedgerEntry is one credit (positive Amount) or debit (negative Amount) of a user's balance.
+// A user's entries sum to their balance.
+type LedgerEntry struct {
+	ID           int64     `json:"id"`
+	UserID       string    `json:"user_id"`
+	Amount       int       `json:"amount"`
+	BalanceAfter int       `json:"balance_after"`
+	Kind         string    `json:"kind"`
+	Reference    string    `json:"reference,omitempty"` // e.g. "order:42"
+	Reason       string    `json:"reason,omitempty"`
+	ActorID      string    `json:"actor_id,omitempty"` // admin who made the entry
+	CreatedAt    time.Time `json:"created_at"`
+}
+
+const ledgerColumns = `id, user_id, amount, balance_after, kind, reference, reason, actor_id, created_at`
+
+func scanLedgerEntry(row interface{ Scan(...any) error }) (*LedgerEntry, error) {
+	var e LedgerEntry
+	var reference, reason, actorID sql.NullString
+	err := row.Scan(&e.ID, &e.UserID, &e.Amount, &e.BalanceAfter, &e.Kind, &reference, &reason, &actorID, &e.CreatedAt)
+	if err != nil {
+		return nil, err
+	}
+	e.Reference = reference.String
+	e.Reason = reason.String
+	e.ActorID = actorID.String
+	return &e, nil
+}
+
+// postLedger changes a user's balance by amount and records the entry, inside tx.
+// Returns sql.ErrNoRows if the user doesn't exist or a debit exceeds the balance.
+func postLedger(tx *sql.Tx, userID string, amount int, kind, reference, reason, actorID string) (*LedgerEntry, error) {
+	var balance int
+	err := tx.QueryRow(`
+		UPDATE public.users
+		SET balance = COALESCE(balance, 0) + $1
+		WHERE id = $2 AND COALESCE(balance, 0) + $1 >= 0
+		RETURNING balance
+	`, amount, userID).Scan(&balance)
+	if err != nil {
+		return nil, err
+	}
+
+	return scanLedgerEntry(tx.QueryRow(`
+		INSERT INTO public.balance_ledger (user_id, amount, balance_after, kind, reference, reason, actor_id)
+		VALUES ($1, $2, $3, $4, NULLIF($5, ''), NULLIF($6, ''), NULLIF($7, ''))
+		RETURNING `+ledgerColumns,
+		userID, amount, balance, kind, reference, reason, actorID))
+}
+
+// AdjustBalance grants (positive amount) or deducts (negative amount) credits on an admin's
+// behalf and records audit in the same transaction. Returns sql.ErrNoRows if the user doesn't
+// exist, ErrInsufficientBalance if a deduction exceeds the balance.
+func (r *ExtendedUserRepository) AdjustBalance(userID string, amount int, reason, adminID string, audit *AuditEvent) (*LedgerEntry, error) {
+	tx, err := r.db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	var id string
+	if err := tx.QueryRow(`SELECT id FROM public.users WHERE id = $1 FOR UPDATE`, userID).Scan(&id); err != nil {
+		return nil, err
+	}
+
+	kind := LedgerAdminGrant
+	if amount < 0 {
+		kind = LedgerAdminDeduction
+	}
+
+	entry, err := postLedger(tx, userID, amount, kind, "", reason, adminID)
+	if err == sql.ErrNoRows {
+		return nil, ErrInsufficientBalance
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	err = appendAuditTx(tx, audit,
+		map[string]int{"balance": entry.BalanceAfter - entry.Amount},
+		map[string]interface{}{"balance": entry.BalanceAfter, "amount": entry.Amount, "reason": entry.Reason, "ledger_id": entry.ID})
+	if err != nil {
+		return nil, err
+	}
+
+	return entry, tx.Commit()
+}
+
+// TopUp credits a completed credit purchase to the user's balance, recording the purchase and its
+// ledger entry in the same transaction. The payment flow must post top-ups here rather than write
+// credit_purchases and the balance itself, or each one shows up as balance drift.
+// Returns ErrTopUpRecorded if paymentID was already credited, sql.ErrNoRows if the user doesn't exist.
+func (r *ExtendedUserRepository) TopUp(userID string, credits int, amountPaid, paymentID string, audit *AuditEvent) (*LedgerEntry, error) {
+	if credits <= 0 {
+		return nil, errors.New("top-up must credit a positive amount")
+	}
+
+	tx, err := r.db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	var purchaseID int
+	err = tx.QueryRow(`
+		INSERT INTO dashboard.credit_purchases (user_id, credits, amount_paid, payment_id, status)
+		VALUES ($1, $2, $3, NULLIF($4, ''), 'completed')
+		ON CONFLICT (payment_id) WHERE payment_id IS NOT NULL DO NOTHING
+		RETURNING id
+	`, userID, credits, amountPaid, paymentID).Scan(&purchaseID)
+	if err == sql.ErrNoRows {
+		return nil, ErrTopUpRecorded
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	entry, err := postLedger(tx, userID, credits, LedgerTopUp, "credit_purchase:"+strconv.Itoa(purchaseID), "", "")
+	if err != nil {
+		return nil, err
+	}
+
+	err = appendAuditTx(tx, audit,
+		map[string]int{"balance": entry.BalanceAfter - entry.Amount},
+		map[string]interface{}{"balance": entry.BalanceAfter, "credits": credits, "payment_id": paymentID, "ledger_id": entry.ID})
+	if err != nil {
+		return nil, err
+	}
+
+	return entry, tx.Commit()
+}
+
+// LedgerPage is one page of ListLedger, newest first
+type LedgerPage struct {
+	Entries    []*LedgerEntry `json:"entries"`
+	NextCursor string         `json:"next_cursor,omitempty"`
+}
+
+// ListLedger returns a user's ledger entries, newest first.
+// Returns ErrInvalidCursor if cursor is malformed.
+func (r *ExtendedUserRepository) ListLedger(userID, cursor string, limit int) (*LedgerPage, error) {
+	beforeID := int64(0)
+	if cursor != "" {
+		var err error
+		beforeID, err = strconv.ParseInt(cursor, 10, 64)
+		if err != nil || beforeID <= 0 {
+			return nil, ErrInvalidCursor
+		}
+	}
+	if limit <= 0 {
+		limit = 50
+	}
+
+	rows, err := r.db.Query(`
+		SELECT `+ledgerColumns+`
+		FROM public.balance_ledger
+		WHERE user_id = $1 AND ($2 = 0 OR id < $2)
+		ORDER BY id DESC
+		LIMIT $3
+	`, userID, beforeID, limit+1)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	page := LedgerPage{Entries: []*LedgerEntry{}}
+	for rows.Next() {
+		e, err := scanLedgerEntry(rows)
+		if err != nil {
+			return nil, err
+		}
+		page.Entries = append(page.Entries, e)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	if len(page.Entries) > limit {
+		page.Entries = page.Entries[:limit]
+		page.NextCursor = strconv.FormatInt(page.Entries[limit-1].ID, 10)
+	}
+
+	return &page, nil
+}
+
+// BalanceDrift is a user whose balance differs from the sum of their ledger entries,
+// i.e. the balance was changed without an entry
+type BalanceDrift struct {
+	UserID        string `json:"user_id"`
+	Balance       int    `json:"balance"`
+	LedgerBalance int    `json:"ledger_balance"`
+	Difference    int    `json:"difference"` // Balance - LedgerBalance
+}
+
+// ErrNoBalanceDrift is returned when resolving a user whose balance matches their ledger
+var ErrNoBalanceDrift = errors.New("balance matches ledger")
+
+// ListBalanceDrift returns up to limit users whose balance differs from their ledger. Nothing
+// is written: a change that bypassed the ledger may be unauthorized, so an admin decides
+// with ResolveBalanceDrift whether to keep or undo it.
+func (r *ExtendedUserRepository) ListBalanceDrift(limit int) ([]*BalanceDrift, error) {
+	rows, err := r.db.Query(`
+		SELECT u.id, COALESCE(u.balance, 0), COALESCE(SUM(l.amount), 0)
+		FROM public.users u
+		LEFT JOIN public.balance_ledger l ON l.user_id = u.id
+		GROUP BY u.id, u.balance
+		HAVING COALESCE(u.balance, 0) <> COALESCE(SUM(l.amount), 0)
+		ORDER BY u.id
+		LIMIT $1
+	`, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	drifts := []*BalanceDrift{}
+	for rows.Next() {
+		var d BalanceDrift
+		if err := rows.Scan(&d.UserID, &d.Balance, &d.LedgerBalance); err != nil {
+			return nil, err
+		}
+		d.Difference = d.Balance - d.LedgerBalance
+		drifts = append(drifts, &d)
+	}
+
+	return drifts, rows.Err()
+}
+
+// ResolveBalanceDrift settles a user's balance drift on an admin's behalf. With accept the
+// balance is kept and the difference booked as a reconciliation entry; otherwise the balance
+// is put back to the ledger's sum. The resolution is recorded as audit in the same transaction.
+// Returns sql.ErrNoRows if the user doesn't exist, ErrNoBalanceDrift if there's nothing to resolve.
+func (r *ExtendedUserRepository) ResolveBalanceDrift(userID string, accept bool, reason, adminID string, audit *AuditEvent) (*BalanceDrift, error) {
+	tx, err := r.db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	// The row lock keeps a purchase from posting between the check and the fix
+	d := BalanceDrift{UserID: userID}
+	err = tx.QueryRow(`SELECT COALESCE(balance, 0) FROM public.users WHERE id = $1 FOR UPDATE`, userID).Scan(&d.Balance)
+	if err != nil {
+		return nil, err
+	}
+	err = tx.QueryRow(`SELECT COALESCE(SUM(amount), 0) FROM public.balance_ledger WHERE user_id = $1`, userID).Scan(&d.LedgerBalance)
+	if err != nil {
+		return nil, err
+	}
+	d.Difference = d.Balance - d.LedgerBalance
+	if d.Difference == 0 {
+		return nil, ErrNoBalanceDrift
+	}
+
+	after := map[string]interface{}{"accepted": accept, "reason": reason}
+	if accept {
+		entry, err := scanLedgerEntry(tx.QueryRow(`
+			INSERT INTO public.balance_ledger (user_id, amount, balance_after, kind, reason, actor_id)
+			VALUES ($1, $2, $3, $4, $5, $6)
+			RETURNING `+ledgerColumns,
+			userID, d.Difference, d.Balance, LedgerReconciliation, reason, adminID))
+		if err != nil {
+			return nil, err
+		}
+		after["balance"], after["ledger_id"] = d.Balance, entry.ID
+	} else {
+		_, err = tx.Exec(`UPDATE public.users SET balance = $1 WHERE id = $2`, d.LedgerBalance, userID)
+		if err != nil {
+			return nil, err
+		}
+		after["balance"] = d.LedgerBalance
+	}
+
+	err = appendAuditTx(tx, audit,
+		map[string]int{"balance": d.Balance, "ledger_balance": d.LedgerBalance},
+		after)
+	if err != nil {
+		return nil, err
+	}
+
+	return &d, tx.Commit()
+}
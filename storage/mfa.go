@@ -0,0 +1,358 @@
+package storage
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base64"
+	"errors"
+	"strings"
+	"time"
+)
+
+// MFARepository stores TOTP enrollment, recovery codes, login challenges and step-up tokens.
+// TOTP secrets are encrypted with a server key, so the database alone can't generate codes.
+type MFARepository struct {
+	db     *sql.DB
+	secret cipher.AEAD
+}
+
+// NewMFARepository encrypts TOTP secrets with AES-256-GCM under a key derived from secretKey
+func NewMFARepository(db *sql.DB, secretKey string) (*MFARepository, error) {
+	if secretKey == "" {
+		return nil, errors.New("a TOTP secret key is required")
+	}
+
+	key := sha256.Sum256([]byte(secretKey))
+	block, err := aes.NewCipher(key[:])
+	if err != nil {
+		return nil, err
+	}
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+
+	return &MFARepository{db: db, secret: gcm}, nil
+}
+
+// sealedTOTPPrefix marks an encrypted totp_secret; secrets stored before encryption have none
+const sealedTOTPPrefix = "v1:"
+
+// sealTOTPSecret encrypts a secret, bound to its user so it can't be copied to another row
+func (r *MFARepository) sealTOTPSecret(userID, secret string) (string, error) {
+	nonce := make([]byte, r.secret.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return "", err
+	}
+	sealed := r.secret.Seal(nonce, nonce, []byte(secret), []byte(userID))
+	return sealedTOTPPrefix + base64.StdEncoding.EncodeToString(sealed), nil
+}
+
+func (r *MFARepository) openTOTPSecret(userID, stored string) (string, error) {
+	encoded, ok := strings.CutPrefix(stored, sealedTOTPPrefix)
+	if !ok {
+		return stored, nil
+	}
+
+	sealed, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil {
+		return "", err
+	}
+	if len(sealed) < r.secret.NonceSize() {
+		return "", errors.New("sealed TOTP secret too short")
+	}
+
+	nonce, ciphertext := sealed[:r.secret.NonceSize()], sealed[r.secret.NonceSize():]
+	secret, err := r.secret.Open(nil, nonce, ciphertext, []byte(userID))
+	if err != nil {
+		return "", err
+	}
+	return string(secret), nil
+}
+
+// EncryptStoredTOTPSecrets encrypts the secrets stored before they were encrypted.
+// Returns how many it encrypted.
+func (r *MFARepository) EncryptStoredTOTPSecrets() (int64, error) {
+	rows, err := r.db.Query(`
+		SELECT user_id, totp_secret
+		FROM public.user_mfa
+		WHERE totp_secret NOT LIKE $1 || '%'
+	`, sealedTOTPPrefix)
+	if err != nil {
+		return 0, err
+	}
+
+	plain := map[string]string{}
+	for rows.Next() {
+		var userID, secret string
+		if err := rows.Scan(&userID, &secret); err != nil {
+			rows.Close()
+			return 0, err
+		}
+		plain[userID] = secret
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return 0, err
+	}
+
+	var encrypted int64
+	for userID, secret := range plain {
+		sealed, err := r.sealTOTPSecret(userID, secret)
+		if err != nil {
+			return encrypted, err
+		}
+
+		// Skips a secret that was replaced in the meantime
+		result, err := r.db.Exec(`
+			UPDATE public.user_mfa SET totp_secret = $1
+			WHERE user_id = $2 AND totp_secret = $3
+		`, sealed, userID, secret)
+		if err != nil {
+			return encrypted, err
+		}
+		n, err := result.RowsAffected()
+		if err != nil {
+			return encrypted, err
+		}
+		encrypted += n
+	}
+
+	return encrypted, nil
+}
+
+type TOTPEnrollment struct {
+	Secret       string
+	Enabled      bool
+	LastUsedStep int64
+}
+
+// GetTOTP returns the user's enrollment, sql.ErrNoRows if they never started one
+func (r *MFARepository) GetTOTP(userID string) (*TOTPEnrollment, error) {
+	var e TOTPEnrollment
+	err := r.db.QueryRow(`
+		SELECT totp_secret, enabled_at IS NOT NULL, last_used_step
+		FROM public.user_mfa
+		WHERE user_id = $1
+	`, userID).Scan(&e.Secret, &e.Enabled, &e.LastUsedStep)
+	if err != nil {
+		return nil, err
+	}
+
+	e.Secret, err = r.openTOTPSecret(userID, e.Secret)
+	if err != nil {
+		return nil, err
+	}
+	return &e, nil
+}
+
+// IsTOTPEnabled reports whether the user has a confirmed enrollment
+func (r *MFARepository) IsTOTPEnabled(userID string) (bool, error) {
+	e, err := r.GetTOTP(userID)
+	if err == sql.ErrNoRows {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	return e.Enabled, nil
+}
+
+// StartTOTPEnrollment stores a new unconfirmed secret, replacing any earlier unconfirmed one.
+// Returns sql.ErrNoRows if TOTP is already enabled.
+func (r *MFARepository) StartTOTPEnrollment(userID, secret string) error {
+	sealed, err := r.sealTOTPSecret(userID, secret)
+	if err != nil {
+		return err
+	}
+
+	result, err := r.db.Exec(`
+		INSERT INTO public.user_mfa (user_id, totp_secret)
+		VALUES ($1, $2)
+		ON CONFLICT (user_id) DO UPDATE
+		SET totp_secret = EXCLUDED.totp_secret, last_used_step = 0, created_at = NOW()
+		WHERE public.user_mfa.enabled_at IS NULL
+	`, userID, sealed)
+	if err != nil {
+		return err
+	}
+
+	if n, err := result.RowsAffected(); err != nil {
+		return err
+	} else if n == 0 {
+		return sql.ErrNoRows
+	}
+	return nil
+}
+
+// ConfirmTOTP enables TOTP and replaces the user's recovery codes
+func (r *MFARepository) ConfirmTOTP(userID string, step int64, recoveryCodeHashes []string) error {
+	tx, err := r.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	_, err = tx.Exec(`
+		UPDATE public.user_mfa
+		SET enabled_at = NOW(), last_used_step = $1
+		WHERE user_id = $2
+	`, step, userID)
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.Exec(`DELETE FROM public.mfa_recovery_codes WHERE user_id = $1`, userID)
+	if err != nil {
+		return err
+	}
+
+	for _, hash := range recoveryCodeHashes {
+		_, err = tx.Exec(`
+			INSERT INTO public.mfa_recovery_codes (user_id, code_hash)
+			VALUES ($1, $2)
+		`, userID, hash)
+		if err != nil {
+			return err
+		}
+	}
+
+	return tx.Commit()
+}
+
+// DisableTOTP removes the enrollment and recovery codes and records audit in the same transaction
+func (r *MFARepository) DisableTOTP(userID string, audit *AuditEvent) error {
+	tx, err := r.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err = tx.Exec(`DELETE FROM public.user_mfa WHERE user_id = $1`, userID); err != nil {
+		return err
+	}
+	if _, err = tx.Exec(`DELETE FROM public.mfa_recovery_codes WHERE user_id = $1`, userID); err != nil {
+		return err
+	}
+	if err = appendAuditTx(tx, audit, nil, nil); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// UseTOTPStep records the time step of an accepted code. Returns false if that step
+// (or a later one) was already used, so a code can't be replayed.
+func (r *MFARepository) UseTOTPStep(userID string, step int64) (bool, error) {
+	result, err := r.db.Exec(`
+		UPDATE public.user_mfa
+		SET last_used_step = $1
+		WHERE user_id = $2 AND last_used_step < $1
+	`, step, userID)
+	if err != nil {
+		return false, err
+	}
+
+	n, err := result.RowsAffected()
+	return n == 1, err
+}
+
+// UseRecoveryCode burns a recovery code. Returns false if it doesn't exist or was used.
+func (r *MFARepository) UseRecoveryCode(userID, codeHash string) (bool, error) {
+	result, err := r.db.Exec(`
+		UPDATE public.mfa_recovery_codes
+		SET used_at = NOW()
+		WHERE id = (
+			SELECT id FROM public.mfa_recovery_codes
+			WHERE user_id = $1 AND code_hash = $2 AND used_at IS NULL
+			LIMIT 1
+		)
+	`, userID, codeHash)
+	if err != nil {
+		return false, err
+	}
+
+	n, err := result.RowsAffected()
+	return n == 1, err
+}
+
+// CreateChallenge stores a pending second login step
+func (r *MFARepository) CreateChallenge(challengeHash, userID string, sealedResponse []byte, expiresAt time.Time) error {
+	_, err := r.db.Exec(`
+		INSERT INTO public.mfa_challenges (challenge_hash, user_id, sealed_response, expires_at)
+		VALUES ($1, $2, $3, $4)
+	`, challengeHash, userID, sealedResponse, expiresAt)
+	return err
+}
+
+// GetChallenge returns an unexpired challenge, sql.ErrNoRows otherwise
+func (r *MFARepository) GetChallenge(challengeHash string) (userID string, sealedResponse []byte, err error) {
+	err = r.db.QueryRow(`
+		SELECT user_id, sealed_response
+		FROM public.mfa_challenges
+		WHERE challenge_hash = $1 AND expires_at > NOW()
+	`, challengeHash).Scan(&userID, &sealedResponse)
+	return userID, sealedResponse, err
+}
+
+// FailChallenge counts a wrong code against a challenge and deletes it once it has had
+// maxAttempts, so the user has to log in with their password again
+func (r *MFARepository) FailChallenge(challengeHash string, maxAttempts int) error {
+	var attempts int
+	err := r.db.QueryRow(`
+		UPDATE public.mfa_challenges
+		SET attempts = attempts + 1
+		WHERE challenge_hash = $1
+		RETURNING attempts
+	`, challengeHash).Scan(&attempts)
+	if err == sql.ErrNoRows {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	if attempts >= maxAttempts {
+		_, err = r.db.Exec(`DELETE FROM public.mfa_challenges WHERE challenge_hash = $1`, challengeHash)
+	}
+	return err
+}
+
+// DeleteChallenge removes a challenge once it has been answered.
+// Returns sql.ErrNoRows if another request already consumed it.
+func (r *MFARepository) DeleteChallenge(challengeHash string) error {
+	result, err := r.db.Exec(`DELETE FROM public.mfa_challenges WHERE challenge_hash = $1`, challengeHash)
+	if err != nil {
+		return err
+	}
+
+	if n, err := result.RowsAffected(); err != nil {
+		return err
+	} else if n == 0 {
+		return sql.ErrNoRows
+	}
+	return nil
+}
+
+// CreateStepUpToken stores proof of a recent MFA check
+func (r *MFARepository) CreateStepUpToken(tokenHash, userID string, expiresAt time.Time) error {
+	_, err := r.db.Exec(`
+		INSERT INTO public.mfa_step_up_tokens (token_hash, user_id, expires_at)
+		VALUES ($1, $2, $3)
+	`, tokenHash, userID, expiresAt)
+	return err
+}
+
+// ValidStepUpToken checks a step-up token belongs to the user and hasn't expired
+func (r *MFARepository) ValidStepUpToken(tokenHash, userID string) (bool, error) {
+	var exists bool
+	err := r.db.QueryRow(`
+		SELECT EXISTS (
+			SELECT 1 FROM public.mfa_step_up_tokens
+			WHERE token_hash = $1 AND user_id = $2 AND expires_at > NOW()
+		)
+	`, tokenHash, userID).Scan(&exists)
+	return exists, err
+}
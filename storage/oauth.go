@@ -0,0 +1,177 @@
+package storage
+
+import (
+	"database/sql"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// OAuthRepository stores OAuth clients, pending authorization codes and device grants
+type OAuthRepository struct {
+	db *sql.DB
+}
+
+func NewOAuthRepository(db *sql.DB) *OAuthRepository {
+	return &OAuthRepository{db: db}
+}
+
+type OAuthClient struct {
+	ID           string    `json:"client_id"`
+	Name         string    `json:"name"`
+	SecretHash   string    `json:"-"`
+	JWTPublicKey string    `json:"jwt_public_key,omitempty"` // PEM, for private_key_jwt authentication
+	RedirectURIs []string  `json:"redirect_uris"`
+	Scopes       []string  `json:"scopes"` // granted to the client itself through client credentials
+	Public       bool      `json:"public"`
+	CreatedAt    time.Time `json:"created_at"`
+}
+
+// AllowsRedirect reports whether uri exactly matches one of the registered redirect URIs
+func (c *OAuthClient) AllowsRedirect(uri string) bool {
+	for _, registered := range c.RedirectURIs {
+		if registered == uri {
+			return true
+		}
+	}
+	return false
+}
+
+// AllowsScopes reports whether every one of scopes was registered for the client
+func (c *OAuthClient) AllowsScopes(scopes []string) bool {
+	for _, scope := range scopes {
+		allowed := false
+		for _, registered := range c.Scopes {
+			if registered == scope {
+				allowed = true
+				break
+			}
+		}
+		if !allowed {
+			return false
+		}
+	}
+	return true
+}
+
+// CreateClient registers a client. SecretHash and JWTPublicKey are both empty for public clients.
+func (r *OAuthRepository) CreateClient(c *OAuthClient) error {
+	_, err := r.db.Exec(`
+		INSERT INTO public.oauth_clients (client_id, name, secret_hash, jwt_public_key, redirect_uris, scopes)
+		VALUES ($1, $2, NULLIF($3, ''), NULLIF($4, ''), $5, $6)
+	`, c.ID, c.Name, c.SecretHash, c.JWTPublicKey, pq.Array(c.RedirectURIs), pq.Array(c.Scopes))
+	return err
+}
+
+// GetClient returns a registered client, sql.ErrNoRows if unknown
+func (r *OAuthRepository) GetClient(clientID string) (*OAuthClient, error) {
+	var c OAuthClient
+	var secretHash, jwtPublicKey sql.NullString
+	err := r.db.QueryRow(`
+		SELECT client_id, name, secret_hash, jwt_public_key, redirect_uris, scopes, created_at
+		FROM public.oauth_clients
+		WHERE client_id = $1
+	`, clientID).Scan(&c.ID, &c.Name, &secretHash, &jwtPublicKey, pq.Array(&c.RedirectURIs), pq.Array(&c.Scopes), &c.CreatedAt)
+	if err != nil {
+		return nil, err
+	}
+
+	c.SecretHash = secretHash.String
+	c.JWTPublicKey = jwtPublicKey.String
+	c.Public = !secretHash.Valid && !jwtPublicKey.Valid
+	return &c, nil
+}
+
+// ListClients returns every registered client
+func (r *OAuthRepository) ListClients() ([]OAuthClient, error) {
+	rows, err := r.db.Query(`
+		SELECT client_id, name, COALESCE(jwt_public_key, ''), secret_hash IS NULL AND jwt_public_key IS NULL,
+			redirect_uris, scopes, created_at
+		FROM public.oauth_clients
+		ORDER BY created_at
+	`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	clients := []OAuthClient{}
+	for rows.Next() {
+		var c OAuthClient
+		if err := rows.Scan(&c.ID, &c.Name, &c.JWTPublicKey, &c.Public, pq.Array(&c.RedirectURIs), pq.Array(&c.Scopes), &c.CreatedAt); err != nil {
+			return nil, err
+		}
+		clients = append(clients, c)
+	}
+	return clients, rows.Err()
+}
+
+// DeleteClient removes a client and its pending codes
+func (r *OAuthRepository) DeleteClient(clientID string) error {
+	result, err := r.db.Exec(`DELETE FROM public.oauth_clients WHERE client_id = $1`, clientID)
+	if err != nil {
+		return err
+	}
+	if n, _ := result.RowsAffected(); n == 0 {
+		return sql.ErrNoRows
+	}
+	return nil
+}
+
+type AuthorizationCode struct {
+	ClientID      string
+	UserID        string
+	RedirectURI   string
+	Scope         string
+	Nonce         string
+	CodeChallenge string
+	AuthTime      time.Time
+}
+
+// CreateAuthorizationCode stores the hash of a new single-use authorization code
+func (r *OAuthRepository) CreateAuthorizationCode(codeHash string, c *AuthorizationCode, expiresAt time.Time) error {
+	_, err := r.db.Exec(`
+		INSERT INTO public.oauth_authorization_codes
+			(code_hash, client_id, user_id, redirect_uri, scope, nonce, code_challenge, expires_at)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8)
+	`, codeHash, c.ClientID, c.UserID, c.RedirectURI, c.Scope, c.Nonce, c.CodeChallenge, expiresAt)
+	return err
+}
+
+// ConsumeAuthorizationCode deletes a code and returns it, so it can only be exchanged once.
+// Returns sql.ErrNoRows if the code is unknown, expired or already used.
+func (r *OAuthRepository) ConsumeAuthorizationCode(codeHash string) (*AuthorizationCode, error) {
+	var c AuthorizationCode
+	var live bool
+	err := r.db.QueryRow(`
+		DELETE FROM public.oauth_authorization_codes
+		WHERE code_hash = $1
+		RETURNING client_id, user_id, redirect_uri, scope, nonce, code_challenge, auth_time,
+			expires_at > NOW()
+	`, codeHash).Scan(&c.ClientID, &c.UserID, &c.RedirectURI, &c.Scope, &c.Nonce, &c.CodeChallenge, &c.AuthTime, &live)
+	if err != nil {
+		return nil, err
+	}
+	if !live {
+		return nil, sql.ErrNoRows
+	}
+	return &c, nil
+}
+
+// UseClientAssertion records the jti of a client assertion so it can't be replayed.
+// Returns sql.ErrNoRows if the client already used it.
+func (r *OAuthRepository) UseClientAssertion(clientID, jti string, expiresAt time.Time) error {
+	result, err := r.db.Exec(`
+		INSERT INTO public.oauth_client_assertions (client_id, jti, expires_at)
+		VALUES ($1, $2, $3)
+		ON CONFLICT (client_id, jti) DO NOTHING
+	`, clientID, jti, expiresAt)
+	if err != nil {
+		return err
+	}
+
+	if n, _ := result.RowsAffected(); n == 0 {
+		return sql.ErrNoRows
+	}
+	return nil
+}
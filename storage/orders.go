@@ -0,0 +1,258 @@
+package storage
+
+import (
+	"database/sql"
+	"errors"
+	"strconv"
+)
+
+// Order statuses
+const (
+	OrderDelivering = "delivering" // balance reserved, goods being sent to the game account
+	OrderCompleted  = "completed"
+	OrderFailed     = "failed"   // delivery stopped part way, can be retried or refunded
+	OrderRefunded   = "refunded" // reserved balance returned to the user
+)
+
+// An order stuck in delivering for longer than this is assumed abandoned (e.g. server restart).
+// A delivery saves progress after every good and gives each one far less time than this.
+const staleDelivery = `updated_at < NOW() - INTERVAL '5 minutes'`
+
+// claimableOrder matches orders (and voucher redemptions) no delivery is working on. RefundOrder and ClaimOrderForRetry
+// both take an order through it and replace its claim_id, so only one of them gets it and
+// the delivery that held the old claim can't write to it any more.
+const claimableOrder = `(status = 'failed' OR (status = 'delivering' AND ` + staleDelivery + `))`
+
+// ErrOrderClaimLost is returned when a delivery writes to an order that was refunded or
+// claimed for a retry in the meantime
+var ErrOrderClaimLost = errors.New("order claimed by another delivery")
+
+type Order struct {
+	ID             int    `json:"id"`
+	UserID         string `json:"user_id"`
+	ItemID         int    `json:"item_id"`
+	Quantity       int    `json:"quantity"`
+	TotalCost      int    `json:"total_cost"`
+	Status         string `json:"status"`
+	DeliveredCount int    `json:"delivered_count"`
+	LastError      string `json:"last_error,omitempty"`
+	CreatedAt      string `json:"created_at"`
+	UpdatedAt      string `json:"updated_at"`
+	ClaimID        string `json:"-"` // held by the delivery working on the order
+}
+
+const orderColumns = `id, user_id, item_id, quantity, total_cost, status, delivered_count, last_error, created_at, updated_at, claim_id`
+
+func scanOrder(row interface{ Scan(...any) error }) (*Order, error) {
+	var o Order
+	var lastError, claimID sql.NullString
+	err := row.Scan(&o.ID, &o.UserID, &o.ItemID, &o.Quantity, &o.TotalCost, &o.Status, &o.DeliveredCount, &lastError, &o.CreatedAt, &o.UpdatedAt, &claimID)
+	if err != nil {
+		return nil, err
+	}
+	o.LastError = lastError.String
+	o.ClaimID = claimID.String
+	return &o, nil
+}
+
+// ReservePurchase debits the item price, opens an order in the delivering state and records
+// audit, atomically. Returns sql.ErrNoRows if the balance is insufficient.
+func (r *ExtendedUserRepository) ReservePurchase(userID string, itemID, quantity int, audit *AuditEvent) (order *Order, newBalance int, err error) {
+	tx, err := r.db.Begin()
+	if err != nil {
+		return nil, 0, err
+	}
+	defer tx.Rollback()
+
+	// Get item price
+	var price int
+	err = tx.QueryRow(`SELECT price FROM dashboard.items WHERE id = $1`, itemID).Scan(&price)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	totalCost := price * quantity
+
+	order, err = scanOrder(tx.QueryRow(`
+		INSERT INTO dashboard.orders (user_id, item_id, quantity, total_cost, status, claim_id)
+		VALUES ($1, $2, $3, $4, $5, gen_random_uuid()::TEXT)
+		RETURNING `+orderColumns,
+		userID, itemID, quantity, totalCost, OrderDelivering))
+	if err != nil {
+		return nil, 0, err
+	}
+
+	// Check and deduct balance
+	entry, err := postLedger(tx, userID, -totalCost, LedgerPurchase, "order:"+strconv.Itoa(order.ID), "", "")
+	if err == sql.ErrNoRows {
+		return nil, 0, sql.ErrNoRows // Insufficient balance
+	}
+	if err != nil {
+		return nil, 0, err
+	}
+	newBalance = entry.BalanceAfter
+
+	err = appendAuditTx(tx, audit,
+		map[string]int{"balance": newBalance + totalCost},
+		map[string]int{"balance": newBalance, "order_id": order.ID, "item_id": itemID, "cost": totalCost})
+	if err != nil {
+		return nil, 0, err
+	}
+
+	if err = tx.Commit(); err != nil {
+		return nil, 0, err
+	}
+
+	return order, newBalance, nil
+}
+
+// RecordOrderDelivery stores how many of the order's goods have reached the game account.
+// Returns ErrOrderClaimLost if the delivery no longer holds claimID.
+func (r *ExtendedUserRepository) RecordOrderDelivery(orderID int, claimID string, deliveredCount int) error {
+	result, err := r.db.Exec(`
+		UPDATE dashboard.orders
+		SET delivered_count = $1, updated_at = NOW()
+		WHERE id = $2 AND status = $3 AND claim_id = $4
+	`, deliveredCount, orderID, OrderDelivering, claimID)
+	return claimedRowUpdated(result, err, ErrOrderClaimLost)
+}
+
+// claimedRowUpdated turns a write to a claimed row that matched nothing into lost
+func claimedRowUpdated(result sql.Result, err, lost error) error {
+	if err != nil {
+		return err
+	}
+	if n, err := result.RowsAffected(); err != nil {
+		return err
+	} else if n == 0 {
+		return lost
+	}
+	return nil
+}
+
+// CompleteOrder marks a fully delivered order completed and records the purchase.
+// Returns ErrOrderClaimLost if the delivery no longer holds claimID.
+func (r *ExtendedUserRepository) CompleteOrder(orderID int, claimID string) error {
+	tx, err := r.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	var userID string
+	var itemID, quantity, totalCost int
+	err = tx.QueryRow(`
+		UPDATE dashboard.orders
+		SET status = $1, last_error = NULL, claim_id = NULL, updated_at = NOW()
+		WHERE id = $2 AND status = $3 AND claim_id = $4
+		RETURNING user_id, item_id, quantity, total_cost
+	`, OrderCompleted, orderID, OrderDelivering, claimID).Scan(&userID, &itemID, &quantity, &totalCost)
+	if err == sql.ErrNoRows {
+		return ErrOrderClaimLost
+	}
+	if err != nil {
+		return err
+	}
+
+	// Record purchase
+	_, err = tx.Exec(`
+		INSERT INTO dashboard.item_mall_purchases (user_id, item_id, quantity, price_paid)
+		VALUES ($1, $2, $3, $4)
+	`, userID, itemID, quantity, totalCost)
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// FailOrder parks an order that stopped part way so it can be retried or refunded later.
+// deliveredCount is saved with it, since the last good may have arrived without its progress
+// being recorded. Returns ErrOrderClaimLost if the delivery no longer holds claimID.
+func (r *ExtendedUserRepository) FailOrder(orderID int, claimID string, deliveredCount int, reason string) error {
+	result, err := r.db.Exec(`
+		UPDATE dashboard.orders
+		SET status = $1, last_error = $2, delivered_count = GREATEST(delivered_count, $3), updated_at = NOW()
+		WHERE id = $4 AND status = $5 AND claim_id = $6
+	`, OrderFailed, reason, deliveredCount, orderID, OrderDelivering, claimID)
+	return claimedRowUpdated(result, err, ErrOrderClaimLost)
+}
+
+// RefundOrder returns the reserved balance and records audit in the same transaction. actorID is
+// the admin who refunded it, empty for automatic refunds. Only failed or abandoned orders can be
+// refunded; returns sql.ErrNoRows otherwise.
+func (r *ExtendedUserRepository) RefundOrder(orderID int, reason, actorID string, audit *AuditEvent) (newBalance int, err error) {
+	tx, err := r.db.Begin()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	var userID string
+	var totalCost int
+	err = tx.QueryRow(`
+		UPDATE dashboard.orders
+		SET status = $1, last_error = $2, claim_id = NULL, updated_at = NOW()
+		WHERE id = $3 AND `+claimableOrder+`
+		RETURNING user_id, total_cost
+	`, OrderRefunded, reason, orderID).Scan(&userID, &totalCost)
+	if err != nil {
+		return 0, err
+	}
+
+	entry, err := postLedger(tx, userID, totalCost, LedgerRefund, "order:"+strconv.Itoa(orderID), reason, actorID)
+	if err != nil {
+		return 0, err
+	}
+	newBalance = entry.BalanceAfter
+
+	err = appendAuditTx(tx, audit, nil, map[string]interface{}{
+		"reason":      reason,
+		"new_balance": newBalance,
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	if err = tx.Commit(); err != nil {
+		return 0, err
+	}
+	return newBalance, nil
+}
+
+// ClaimOrderForRetry moves a failed (or abandoned) order back to delivering under a new claim,
+// so only one retry runs at a time. Returns sql.ErrNoRows if the order can't be retried.
+func (r *ExtendedUserRepository) ClaimOrderForRetry(orderID int) (*Order, error) {
+	return scanOrder(r.db.QueryRow(`
+		UPDATE dashboard.orders
+		SET status = $1, claim_id = gen_random_uuid()::TEXT, updated_at = NOW()
+		WHERE id = $2 AND `+claimableOrder+`
+		RETURNING `+orderColumns,
+		OrderDelivering, orderID))
+}
+
+// ListOrders returns orders, newest first, optionally filtered by status (admin function)
+func (r *ExtendedUserRepository) ListOrders(status string) ([]*Order, error) {
+	rows, err := r.db.Query(`
+		SELECT `+orderColumns+`
+		FROM dashboard.orders
+		WHERE $1 = '' OR status = $1
+		ORDER BY created_at DESC
+		LIMIT 500
+	`, status)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	orders := []*Order{}
+	for rows.Next() {
+		o, err := scanOrder(rows)
+		if err != nil {
+			return nil, err
+		}
+		orders = append(orders, o)
+	}
+
+	return orders, rows.Err()
+}
@@ -0,0 +1,204 @@
+package storage
+
+import (
+	"database/sql"
+	"encoding/json"
+	"time"
+)
+
+// Outbox statuses
+const (
+	OutboxPending   = "pending"
+	OutboxDelivered = "delivered"
+	OutboxDead      = "dead" // gave up after too many attempts, can be replayed by an admin
+)
+
+// Outbox message kinds, sent to the bot as the event field
+const (
+	OutboxDiscordLinked   = "discord.linked"
+	OutboxDiscordUnlinked = "discord.unlinked" // the bot should remove roles from the Discord user
+)
+
+// OutboxMessage is a notification for the Discord bot, written in the same transaction as
+// the change it announces so it survives bot outages and restarts
+type OutboxMessage struct {
+	ID            int64           `json:"id"`
+	Kind          string          `json:"kind"`
+	Payload       json.RawMessage `json:"payload"`
+	Status        string          `json:"status"`
+	Attempts      int             `json:"attempts"`
+	LastError     string          `json:"last_error,omitempty"`
+	NextAttemptAt time.Time       `json:"next_attempt_at"`
+	CreatedAt     time.Time       `json:"created_at"`
+	DeliveredAt   *time.Time      `json:"delivered_at,omitempty"`
+}
+
+// DiscordLinked is the payload of an OutboxDiscordLinked message
+type DiscordLinked struct {
+	DiscordID     string `json:"discord_id"`
+	Username      string `json:"username"`
+	GameAccountID int    `json:"game_account_id"`
+	Timestamp     int64  `json:"timestamp"`
+}
+
+// DiscordUnlinked is the payload of an OutboxDiscordUnlinked message
+type DiscordUnlinked struct {
+	DiscordID     string `json:"discord_id"`
+	Username      string `json:"username"`
+	GameAccountID int    `json:"game_account_id,omitempty"`
+	Timestamp     int64  `json:"timestamp"`
+}
+
+const outboxColumns = `id, kind, payload, status, attempts, last_error, next_attempt_at, created_at, delivered_at`
+
+func scanOutboxMessage(row interface{ Scan(...any) error }) (*OutboxMessage, error) {
+	var m OutboxMessage
+	var lastError sql.NullString
+	var deliveredAt sql.NullTime
+	err := row.Scan(&m.ID, &m.Kind, &m.Payload, &m.Status, &m.Attempts, &lastError, &m.NextAttemptAt, &m.CreatedAt, &deliveredAt)
+	if err != nil {
+		return nil, err
+	}
+	m.LastError = lastError.String
+	if deliveredAt.Valid {
+		m.DeliveredAt = &deliveredAt.Time
+	}
+	return &m, nil
+}
+
+// enqueueOutbox adds a message inside the caller's transaction
+func enqueueOutbox(tx *sql.Tx, kind string, payload interface{}) error {
+	data, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.Exec(`
+		INSERT INTO public.bot_outbox (kind, payload)
+		VALUES ($1, $2)
+	`, kind, data)
+	return err
+}
+
+// ClaimOutbox takes up to limit due messages and hides them from other dispatchers for lease,
+// counting the attempt. A message whose dispatcher dies mid-delivery is picked up again after the lease.
+// Messages about a Discord user are delivered in order: one waits while an earlier message about
+// the same user is still pending, so a retried link can't arrive after the unlink that followed it.
+func (r *ExtendedUserRepository) ClaimOutbox(limit int, lease time.Duration) ([]*OutboxMessage, error) {
+	rows, err := r.db.Query(`
+		UPDATE public.bot_outbox
+		SET attempts = attempts + 1, next_attempt_at = NOW() + make_interval(secs => $2)
+		WHERE id IN (
+			SELECT id FROM public.bot_outbox o
+			WHERE status = $3 AND next_attempt_at <= NOW()
+			  AND NOT EXISTS (
+				SELECT 1 FROM public.bot_outbox earlier
+				WHERE earlier.status = $3
+				  AND earlier.payload->>'discord_id' = o.payload->>'discord_id'
+				  AND earlier.id < o.id
+			  )
+			ORDER BY id
+			LIMIT $1
+			FOR UPDATE SKIP LOCKED
+		)
+		RETURNING `+outboxColumns,
+		limit, lease.Seconds(), OutboxPending)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	messages := []*OutboxMessage{}
+	for rows.Next() {
+		m, err := scanOutboxMessage(rows)
+		if err != nil {
+			return nil, err
+		}
+		messages = append(messages, m)
+	}
+
+	return messages, rows.Err()
+}
+
+// MarkOutboxDelivered records a successful delivery
+func (r *ExtendedUserRepository) MarkOutboxDelivered(id int64) error {
+	_, err := r.db.Exec(`
+		UPDATE public.bot_outbox
+		SET status = $1, last_error = NULL, delivered_at = NOW()
+		WHERE id = $2
+	`, OutboxDelivered, id)
+	return err
+}
+
+// RetryOutboxLater records a failed delivery to be attempted again at retryAt
+func (r *ExtendedUserRepository) RetryOutboxLater(id int64, reason string, retryAt time.Time) error {
+	_, err := r.db.Exec(`
+		UPDATE public.bot_outbox
+		SET last_error = $1, next_attempt_at = $2
+		WHERE id = $3 AND status = $4
+	`, reason, retryAt, id, OutboxPending)
+	return err
+}
+
+// DeadLetterOutbox stops retrying a message until an admin replays it
+func (r *ExtendedUserRepository) DeadLetterOutbox(id int64, reason string) error {
+	_, err := r.db.Exec(`
+		UPDATE public.bot_outbox
+		SET status = $1, last_error = $2
+		WHERE id = $3 AND status = $4
+	`, OutboxDead, reason, id, OutboxPending)
+	return err
+}
+
+// ReplayOutbox queues a dead message for delivery again with a fresh set of attempts,
+// recording audit in the same transaction. Returns sql.ErrNoRows if the message isn't dead.
+func (r *ExtendedUserRepository) ReplayOutbox(id int64, audit *AuditEvent) (*OutboxMessage, error) {
+	tx, err := r.db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	msg, err := scanOutboxMessage(tx.QueryRow(`
+		UPDATE public.bot_outbox
+		SET status = $1, attempts = 0, next_attempt_at = NOW()
+		WHERE id = $2 AND status = $3
+		RETURNING `+outboxColumns,
+		OutboxPending, id, OutboxDead))
+	if err != nil {
+		return nil, err
+	}
+
+	err = appendAuditTx(tx, audit, map[string]string{"status": OutboxDead, "last_error": msg.LastError}, map[string]string{"status": OutboxPending, "kind": msg.Kind})
+	if err != nil {
+		return nil, err
+	}
+
+	return msg, tx.Commit()
+}
+
+// ListOutbox returns outbox messages, newest first, optionally filtered by status (admin function)
+func (r *ExtendedUserRepository) ListOutbox(status string) ([]*OutboxMessage, error) {
+	rows, err := r.db.Query(`
+		SELECT `+outboxColumns+`
+		FROM public.bot_outbox
+		WHERE $1 = '' OR status = $1
+		ORDER BY id DESC
+		LIMIT 500
+	`, status)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	messages := []*OutboxMessage{}
+	for rows.Next() {
+		m, err := scanOutboxMessage(rows)
+		if err != nil {
+			return nil, err
+		}
+		messages = append(messages, m)
+	}
+
+	return messages, rows.Err()
+}
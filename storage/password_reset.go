@@ -0,0 +1,69 @@
+package storage
+
+import "time"
+
+// Password Reset Methods
+
+// GetUserByEmail returns the ID and username for an email address
+func (r *ExtendedUserRepository) GetUserByEmail(email string) (userID, username string, err error) {
+	err = r.db.QueryRow(`
+		SELECT id, username FROM users WHERE LOWER(email) = LOWER($1)
+	`, email).Scan(&userID, &username)
+	return userID, username, err
+}
+
+// CreatePasswordResetToken stores the hash of an emailed reset token
+func (r *ExtendedUserRepository) CreatePasswordResetToken(tokenHash, userID string, expiresAt time.Time) error {
+	_, err := r.db.Exec(`
+		INSERT INTO public.password_reset_tokens (token_hash, user_id, expires_at)
+		VALUES ($1, $2, $3)
+	`, tokenHash, userID, expiresAt)
+	return err
+}
+
+// ResetPassword consumes a reset token and sets the new password hash in one transaction.
+// Every other outstanding token for the user is burned too. audit is recorded in the same
+// transaction, with the token's user as its target.
+// Returns sql.ErrNoRows if the token is unknown, expired or already used.
+func (r *ExtendedUserRepository) ResetPassword(tokenHash, passwordHash string, audit *AuditEvent) (userID string, err error) {
+	tx, err := r.db.Begin()
+	if err != nil {
+		return "", err
+	}
+	defer tx.Rollback()
+
+	err = tx.QueryRow(`
+		UPDATE public.password_reset_tokens
+		SET used_at = NOW()
+		WHERE token_hash = $1 AND used_at IS NULL AND expires_at > NOW()
+		RETURNING user_id
+	`, tokenHash).Scan(&userID)
+	if err != nil {
+		return "", err
+	}
+
+	_, err = tx.Exec(`
+		UPDATE users SET password = $1, updated_at = CURRENT_TIMESTAMP WHERE id = $2
+	`, passwordHash, userID)
+	if err != nil {
+		return "", err
+	}
+
+	_, err = tx.Exec(`
+		UPDATE public.password_reset_tokens
+		SET used_at = NOW()
+		WHERE user_id = $1 AND used_at IS NULL
+	`, userID)
+	if err != nil {
+		return "", err
+	}
+
+	if audit != nil {
+		audit.TargetID = userID
+	}
+	if err := appendAuditTx(tx, audit, nil, nil); err != nil {
+		return "", err
+	}
+
+	return userID, tx.Commit()
+}
@@ -0,0 +1,346 @@
+package storage
+
+import (
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"errors"
+	"time"
+)
+
+// ErrRefreshTokenReused is returned when a token that was already rotated is presented again
+var ErrRefreshTokenReused = errors.New("refresh token already rotated")
+
+// SessionRepository tracks refresh token families. A family is one login session:
+// it starts at /login and gains a child token on every /refresh.
+type SessionRepository struct {
+	db *sql.DB
+}
+
+func NewSessionRepository(db *sql.DB) *SessionRepository {
+	return &SessionRepository{db: db}
+}
+
+// ClientMeta describes the client a refresh token was issued to
+type ClientMeta struct {
+	UserAgent string
+	IPAddress string
+}
+
+type RefreshTokenRecord struct {
+	FamilyID      string
+	UserID        string
+	ClientID      string // OAuth client the family was issued to, empty for first-party logins
+	Rotated       bool
+	FamilyRevoked bool
+}
+
+// HashToken returns the hex SHA-256 used to store refresh tokens
+func HashToken(token string) string {
+	hash := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(hash[:])
+}
+
+// StartFamily records a freshly issued refresh token as the root of a new family.
+// parentHash is set when an untracked token (issued before families existed) was rotated into it.
+func (r *SessionRepository) StartFamily(token, parentHash string, meta ClientMeta) (familyID string, err error) {
+	tx, err := r.db.Begin()
+	if err != nil {
+		return "", err
+	}
+	defer tx.Rollback()
+
+	var userID string
+	err = tx.QueryRow(`SELECT user_id FROM public.refresh_tokens WHERE token = $1`, token).Scan(&userID)
+	if err != nil {
+		return "", err
+	}
+
+	err = tx.QueryRow(`
+		INSERT INTO public.refresh_token_families (user_id)
+		VALUES ($1)
+		RETURNING id
+	`, userID).Scan(&familyID)
+	if err != nil {
+		return "", err
+	}
+
+	_, err = tx.Exec(`
+		INSERT INTO public.refresh_token_lineage (token_hash, family_id, parent_hash, user_id, user_agent, ip_address)
+		VALUES ($1, $2, NULLIF($3, ''), $4, $5, $6)
+	`, HashToken(token), familyID, parentHash, userID, meta.UserAgent, meta.IPAddress)
+	if err != nil {
+		return "", err
+	}
+
+	return familyID, tx.Commit()
+}
+
+// GetRefreshToken looks up a presented refresh token by its hash.
+// Returns sql.ErrNoRows for tokens issued before families were tracked.
+func (r *SessionRepository) GetRefreshToken(tokenHash string) (*RefreshTokenRecord, error) {
+	var rec RefreshTokenRecord
+	var clientID sql.NullString
+	err := r.db.QueryRow(`
+		SELECT l.family_id, l.user_id, f.client_id, l.rotated_at IS NOT NULL, f.revoked_at IS NOT NULL
+		FROM public.refresh_token_lineage l
+		JOIN public.refresh_token_families f ON f.id = l.family_id
+		WHERE l.token_hash = $1
+	`, tokenHash).Scan(&rec.FamilyID, &rec.UserID, &clientID, &rec.Rotated, &rec.FamilyRevoked)
+	if err != nil {
+		return nil, err
+	}
+	rec.ClientID = clientID.String
+	return &rec, nil
+}
+
+// BindFamilyClient records the OAuth client a session was handed to, so only that client
+// can refresh it at /oauth/token
+func (r *SessionRepository) BindFamilyClient(familyID, clientID string) error {
+	_, err := r.db.Exec(`UPDATE public.refresh_token_families SET client_id = $1 WHERE id = $2`, clientID, familyID)
+	return err
+}
+
+// RecordRotation marks parentHash as rotated and adds its replacement to the same family.
+// Returns ErrRefreshTokenReused if the parent was rotated by a concurrent request; the
+// replacement is still recorded so revoking the family also kills it.
+func (r *SessionRepository) RecordRotation(parentHash, token string, meta ClientMeta) error {
+	tx, err := r.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	reused := false
+	var familyID, userID string
+	err = tx.QueryRow(`
+		UPDATE public.refresh_token_lineage
+		SET rotated_at = NOW()
+		WHERE token_hash = $1 AND rotated_at IS NULL
+		RETURNING family_id, user_id
+	`, parentHash).Scan(&familyID, &userID)
+	if err == sql.ErrNoRows {
+		reused = true
+		err = tx.QueryRow(`
+			SELECT family_id, user_id FROM public.refresh_token_lineage WHERE token_hash = $1
+		`, parentHash).Scan(&familyID, &userID)
+	}
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.Exec(`
+		INSERT INTO public.refresh_token_lineage (token_hash, family_id, parent_hash, user_id, user_agent, ip_address)
+		VALUES ($1, $2, $3, $4, $5, $6)
+	`, HashToken(token), familyID, parentHash, userID, meta.UserAgent, meta.IPAddress)
+	if err != nil {
+		return err
+	}
+
+	if err = tx.Commit(); err != nil {
+		return err
+	}
+
+	if reused {
+		return ErrRefreshTokenReused
+	}
+	return nil
+}
+
+// RevokeFamily ends a session: the family is flagged and its live refresh token deleted
+func (r *SessionRepository) RevokeFamily(familyID, reason string) error {
+	tx, err := r.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if err := revokeFamilyTx(tx, familyID, reason); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+func revokeFamilyTx(tx *sql.Tx, familyID, reason string) error {
+	_, err := tx.Exec(`
+		UPDATE public.refresh_token_families
+		SET revoked_at = NOW(), revoked_reason = $1
+		WHERE id = $2 AND revoked_at IS NULL
+	`, reason, familyID)
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.Exec(`
+		DELETE FROM public.refresh_tokens
+		WHERE token_hash IN (
+			SELECT token_hash FROM public.refresh_token_lineage WHERE family_id = $1
+		)
+	`, familyID)
+	return err
+}
+
+type Session struct {
+	ID        string `json:"id"`
+	UserAgent string `json:"user_agent"`
+	IPAddress string `json:"ip_address"`
+	CreatedAt string `json:"created_at"`
+	LastUsed  string `json:"last_used_at"`
+	ExpiresAt string `json:"expires_at"`
+}
+
+// ListActiveSessions returns the user's sessions that still hold a live refresh token, most recently used first
+func (r *SessionRepository) ListActiveSessions(userID string) ([]Session, error) {
+	rows, err := r.db.Query(`
+		SELECT f.id, COALESCE(l.user_agent, ''), COALESCE(l.ip_address, ''), f.created_at, l.issued_at, rt.expires_at
+		FROM public.refresh_token_families f
+		JOIN public.refresh_token_lineage l ON l.family_id = f.id AND l.rotated_at IS NULL
+		JOIN public.refresh_tokens rt ON rt.token_hash = l.token_hash AND rt.user_id = f.user_id
+		WHERE f.user_id = $1
+		  AND f.revoked_at IS NULL
+		  AND rt.expires_at > NOW()
+		ORDER BY l.issued_at DESC
+	`, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	sessions := []Session{}
+	for rows.Next() {
+		var s Session
+		if err := rows.Scan(&s.ID, &s.UserAgent, &s.IPAddress, &s.CreatedAt, &s.LastUsed, &s.ExpiresAt); err != nil {
+			return nil, err
+		}
+		sessions = append(sessions, s)
+	}
+
+	return sessions, rows.Err()
+}
+
+// RevokeSession revokes one of the user's sessions and records audit in the same transaction.
+// Returns sql.ErrNoRows if the session doesn't exist, belongs to someone else or is already revoked.
+func (r *SessionRepository) RevokeSession(userID, familyID, reason string, audit *AuditEvent) error {
+	tx, err := r.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	var id string
+	err = tx.QueryRow(`
+		SELECT id FROM public.refresh_token_families
+		WHERE id = $1 AND user_id = $2 AND revoked_at IS NULL
+		FOR UPDATE
+	`, familyID, userID).Scan(&id)
+	if err != nil {
+		return err
+	}
+
+	if err := revokeFamilyTx(tx, id, reason); err != nil {
+		return err
+	}
+
+	if err := appendAuditTx(tx, audit, nil, map[string]string{"session_id": id, "reason": reason}); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// RevokeAllSessions logs the user out everywhere, including refresh tokens issued before families were tracked
+// and device grant sessions. Access tokens issued so far become inactive too. audit is recorded in
+// the same transaction; callers whose own change is audited pass nil.
+func (r *SessionRepository) RevokeAllSessions(userID, reason string, audit *AuditEvent) (revoked int64, err error) {
+	tx, err := r.db.Begin()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	_, err = tx.Exec(`
+		UPDATE public.refresh_token_families
+		SET revoked_at = NOW(), revoked_reason = $1
+		WHERE user_id = $2 AND revoked_at IS NULL
+	`, reason, userID)
+	if err != nil {
+		return 0, err
+	}
+
+	_, err = tx.Exec(`UPDATE public.users SET access_tokens_revoked_at = NOW() WHERE id = $1`, userID)
+	if err != nil {
+		return 0, err
+	}
+
+	_, err = tx.Exec(`
+		UPDATE public.oauth_device_sessions
+		SET revoked_at = NOW()
+		WHERE user_id = $1 AND revoked_at IS NULL
+	`, userID)
+	if err != nil {
+		return 0, err
+	}
+
+	result, err := tx.Exec(`DELETE FROM public.refresh_tokens WHERE user_id = $1`, userID)
+	if err != nil {
+		return 0, err
+	}
+
+	revoked, err = result.RowsAffected()
+	if err != nil {
+		return 0, err
+	}
+
+	if err := appendAuditTx(tx, audit, nil, map[string]interface{}{"revoked": revoked, "reason": reason}); err != nil {
+		return 0, err
+	}
+
+	return revoked, tx.Commit()
+}
+
+// UserIDForRefreshToken returns who a live refresh token was issued to
+func (r *SessionRepository) UserIDForRefreshToken(token string) (string, error) {
+	var userID string
+	err := r.db.QueryRow(`SELECT user_id FROM public.refresh_tokens WHERE token = $1`, token).Scan(&userID)
+	return userID, err
+}
+
+// RevokeAccessToken puts an access token on the denylist until it expires.
+// userID is empty for service client tokens.
+func (r *SessionRepository) RevokeAccessToken(tokenID, userID string, expiresAt time.Time) error {
+	_, err := r.db.Exec(`
+		INSERT INTO public.revoked_access_tokens (token_id, user_id, expires_at)
+		VALUES ($1, NULLIF($2, ''), $3)
+		ON CONFLICT (token_id) DO NOTHING
+	`, tokenID, userID, expiresAt)
+	return err
+}
+
+// IsAccessTokenRevoked reports whether an access token is on the denylist, was issued
+// before the user's last logout everywhere, or belongs to a user who no longer exists or is banned.
+// issuedAt is the token's iat, which has whole seconds, so the logout time is compared at the same
+// precision; otherwise a token issued in the second after a logout would count as revoked.
+func (r *SessionRepository) IsAccessTokenRevoked(tokenID, userID string, issuedAt time.Time) (bool, error) {
+	var revoked bool
+	err := r.db.QueryRow(`
+		SELECT EXISTS (SELECT 1 FROM public.revoked_access_tokens WHERE token_id = $1)
+			OR NOT EXISTS (
+				SELECT 1 FROM public.users
+				WHERE id = $2
+				  AND (access_tokens_revoked_at IS NULL OR date_trunc('second', access_tokens_revoked_at) <= $3)
+			)
+			OR EXISTS (SELECT 1 FROM public.user_bans WHERE user_id = $2 AND `+activeBan+`)
+	`, tokenID, userID, issuedAt).Scan(&revoked)
+	return revoked, err
+}
+
+// IsTokenIDRevoked reports whether a token is on the denylist. Used for service client
+// tokens, which have no user.
+func (r *SessionRepository) IsTokenIDRevoked(tokenID string) (bool, error) {
+	var revoked bool
+	err := r.db.QueryRow(`
+		SELECT EXISTS (SELECT 1 FROM public.revoked_access_tokens WHERE token_id = $1)
+	`, tokenID).Scan(&revoked)
+	return revoked, err
+}
@@ -0,0 +1,41 @@
+package storage
+
+import "time"
+
+// Game Login Ticket Methods
+
+type GameLoginTicket struct {
+	UserID        string
+	Username      string
+	GameAccountID int
+}
+
+// CreateGameLoginTicket stores the hash of a new single-use launcher ticket
+func (r *ExtendedUserRepository) CreateGameLoginTicket(ticketHash, userID string, gameAccountID int, expiresAt time.Time) error {
+	_, err := r.db.Exec(`
+		INSERT INTO public.game_login_tickets (ticket_hash, user_id, game_account_id, expires_at)
+		VALUES ($1, $2, $3, $4)
+	`, ticketHash, userID, gameAccountID, expiresAt)
+	return err
+}
+
+// ConsumeGameLoginTicket atomically marks a ticket used and returns who it belongs to.
+// Returns sql.ErrNoRows if the ticket is unknown, expired or already used.
+func (r *ExtendedUserRepository) ConsumeGameLoginTicket(ticketHash string) (*GameLoginTicket, error) {
+	var t GameLoginTicket
+	err := r.db.QueryRow(`
+		UPDATE public.game_login_tickets t
+		SET used_at = NOW()
+		FROM public.users u
+		WHERE t.ticket_hash = $1
+		  AND t.used_at IS NULL
+		  AND t.expires_at > NOW()
+		  AND u.id = t.user_id
+		RETURNING t.user_id, u.username, t.game_account_id
+	`, ticketHash).Scan(&t.UserID, &t.Username, &t.GameAccountID)
+
+	if err != nil {
+		return nil, err
+	}
+	return &t, nil
+}
@@ -0,0 +1,242 @@
+package storage
+
+import (
+	"database/sql"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Admin User Search Methods
+
+// ErrInvalidCursor is returned for a cursor that wasn't issued for the requested sort
+var ErrInvalidCursor = errors.New("invalid cursor")
+
+// User sort orders for SearchUsers
+const (
+	UserSortCreated  = "created_at"
+	UserSortUsername = "username"
+	UserSortBalance  = "balance"
+)
+
+// Page sizes for SearchUsers
+const (
+	DefaultUserPageSize = 50
+	MaxUserPageSize     = 200
+)
+
+// userSortColumns maps a sort order to its column and the type its cursor value is cast to
+var userSortColumns = map[string]struct{ column, cast string }{
+	UserSortCreated:  {"created_at", "timestamp"},
+	UserSortUsername: {"username", "text"},
+	UserSortBalance:  {"COALESCE(balance, 0)", "integer"},
+}
+
+// ValidUserSort reports whether sort is one of the UserSort constants
+func ValidUserSort(sort string) bool {
+	_, ok := userSortColumns[sort]
+	return ok
+}
+
+// UserFilter selects a page of users. Zero values mean no filter.
+type UserFilter struct {
+	Search     string // part of the username or email, or an exact Discord ID
+	Role       string
+	GameLinked *bool
+	Banned     *bool  // a ban is in force
+	Sort       string // one of the UserSort constants, UserSortCreated otherwise
+	Ascending  bool
+	Cursor     string // NextCursor of the previous page
+	Limit      int
+}
+
+// AdminUser is a user as shown in the admin panel
+type AdminUser struct {
+	ID              string    `json:"id"`
+	Username        string    `json:"username"`
+	Email           string    `json:"email"`
+	Role            string    `json:"role"`
+	ProfileImage    string    `json:"profile_image"`
+	Balance         int       `json:"balance"`
+	GameAccountID   *int      `json:"game_account_id"`
+	DiscordID       string    `json:"discord_id,omitempty"`
+	DiscordUsername string    `json:"discord_username,omitempty"`
+	EmailVerified   bool      `json:"email_verified"`
+	Banned          bool      `json:"banned"`
+	CreatedAt       time.Time `json:"created_at"`
+}
+
+// UserPage is one page of SearchUsers. Total counts every match, not just this page.
+type UserPage struct {
+	Users      []*AdminUser `json:"users"`
+	NextCursor string       `json:"next_cursor,omitempty"`
+	Total      int          `json:"total"`
+}
+
+// userCursor is the position after the last user of a page, encoded as base64url JSON
+type userCursor struct {
+	Sort  string `json:"s"`
+	Value string `json:"v"`
+	ID    string `json:"id"`
+}
+
+// SearchUsers returns a page of users matching f, using keyset pagination so deep pages
+// stay cheap. Returns ErrInvalidCursor if f.Cursor is malformed or from another sort.
+func (r *ExtendedUserRepository) SearchUsers(f UserFilter) (*UserPage, error) {
+	if !ValidUserSort(f.Sort) {
+		f.Sort = UserSortCreated
+	}
+	sort := userSortColumns[f.Sort]
+	if f.Limit <= 0 {
+		f.Limit = DefaultUserPageSize
+	}
+
+	var where []string
+	var args []any
+	arg := func(v any) string {
+		args = append(args, v)
+		return "$" + strconv.Itoa(len(args))
+	}
+
+	if f.Search != "" {
+		pattern := arg("%" + escapeLike(f.Search) + "%")
+		where = append(where, "(username ILIKE "+pattern+" OR email ILIKE "+pattern+" OR discord_id = "+arg(f.Search)+")")
+	}
+	if f.Role != "" {
+		where = append(where, "role = "+arg(f.Role))
+	}
+	if f.GameLinked != nil {
+		if *f.GameLinked {
+			where = append(where, "game_account_id IS NOT NULL")
+		} else {
+			where = append(where, "game_account_id IS NULL")
+		}
+	}
+	if f.Banned != nil {
+		banned := "EXISTS (SELECT 1 FROM public.user_bans b WHERE b.user_id = users.id AND " + activeBan + ")"
+		if !*f.Banned {
+			banned = "NOT " + banned
+		}
+		where = append(where, banned)
+	}
+
+	filter := ""
+	if len(where) > 0 {
+		filter = "WHERE " + strings.Join(where, " AND ")
+	}
+
+	var page UserPage
+	if err := r.db.QueryRow(`SELECT COUNT(*) FROM public.users `+filter, args...).Scan(&page.Total); err != nil {
+		return nil, err
+	}
+
+	if f.Cursor != "" {
+		c, err := decodeUserCursor(f.Cursor)
+		if err != nil || c.Sort != f.Sort {
+			return nil, ErrInvalidCursor
+		}
+		op := "<"
+		if f.Ascending {
+			op = ">"
+		}
+		where = append(where, "("+sort.column+", id) "+op+" ("+arg(c.Value)+"::"+sort.cast+", "+arg(c.ID)+")")
+		filter = "WHERE " + strings.Join(where, " AND ")
+	}
+
+	direction := "DESC"
+	if f.Ascending {
+		direction = "ASC"
+	}
+
+	// One extra row tells whether there's a next page
+	rows, err := r.db.Query(`
+		SELECT id, username, email, role, profile_image, COALESCE(balance, 0), game_account_id,
+			discord_id, discord_username, email_verified_at IS NOT NULL,
+			EXISTS (SELECT 1 FROM public.user_bans b WHERE b.user_id = users.id AND `+activeBan+`), created_at
+		FROM public.users
+		`+filter+`
+		ORDER BY `+sort.column+` `+direction+`, id `+direction+`
+		LIMIT `+arg(f.Limit+1), args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	page.Users = []*AdminUser{}
+	for rows.Next() {
+		var u AdminUser
+		var profileImage, discordID, discordUsername sql.NullString
+		var gameAccountID sql.NullInt64
+		err := rows.Scan(&u.ID, &u.Username, &u.Email, &u.Role, &profileImage, &u.Balance, &gameAccountID,
+			&discordID, &discordUsername, &u.EmailVerified, &u.Banned, &u.CreatedAt)
+		if err != nil {
+			return nil, err
+		}
+		u.ProfileImage = profileImage.String
+		u.DiscordID = discordID.String
+		u.DiscordUsername = discordUsername.String
+		if gameAccountID.Valid {
+			id := int(gameAccountID.Int64)
+			u.GameAccountID = &id
+		}
+		page.Users = append(page.Users, &u)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	if len(page.Users) > f.Limit {
+		page.Users = page.Users[:f.Limit]
+		last := page.Users[f.Limit-1]
+		page.NextCursor = encodeUserCursor(f.Sort, last)
+	}
+
+	return &page, nil
+}
+
+func encodeUserCursor(sort string, u *AdminUser) string {
+	c := userCursor{Sort: sort, ID: u.ID}
+	switch sort {
+	case UserSortUsername:
+		c.Value = u.Username
+	case UserSortBalance:
+		c.Value = strconv.Itoa(u.Balance)
+	default:
+		c.Value = u.CreatedAt.Format(time.RFC3339Nano)
+	}
+	data, _ := json.Marshal(c)
+	return base64.RawURLEncoding.EncodeToString(data)
+}
+
+func decodeUserCursor(cursor string) (*userCursor, error) {
+	data, err := base64.RawURLEncoding.DecodeString(cursor)
+	if err != nil {
+		return nil, err
+	}
+	var c userCursor
+	if err := json.Unmarshal(data, &c); err != nil {
+		return nil, err
+	}
+	if c.ID == "" {
+		return nil, ErrInvalidCursor
+	}
+	if c.Sort == UserSortBalance {
+		if _, err := strconv.Atoi(c.Value); err != nil {
+			return nil, err
+		}
+	}
+	if c.Sort == UserSortCreated {
+		if _, err := time.Parse(time.RFC3339Nano, c.Value); err != nil {
+			return nil, err
+		}
+	}
+	return &c, nil
+}
+
+// escapeLike escapes the LIKE wildcards in s so it matches literally
+func escapeLike(s string) string {
+	return strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`).Replace(s)
+}
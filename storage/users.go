@@ -2,8 +2,11 @@ package storage
 
 import (
 	"database/sql"
+	"errors"
+	"time"
 
 	"github.com/ethan-mdev/central-auth/storage"
+	"github.com/lib/pq"
 )
 
 // ExtendedUserRepository wraps the central-auth UserRepository
@@ -20,6 +23,18 @@ func NewExtendedUserRepository(repo storage.UserRepository, db *sql.DB) *Extende
 	}
 }
 
+var (
+	ErrVoucherRedeemed  = errors.New("voucher already redeemed by this user")
+	ErrVoucherExhausted = errors.New("voucher has reached maximum redemptions")
+	// ErrRedemptionClaimLost is returned when a delivery writes to a voucher redemption that
+	// was claimed for a retry in the meantime
+	ErrRedemptionClaimLost = errors.New("voucher redemption claimed by another delivery")
+	ErrGameAlreadyLinked   = errors.New("user already has a linked game account")
+
+	ErrDiscordNotLinked       = errors.New("no discord account linked")
+	ErrDiscordLinkedElsewhere = errors.New("discord account is linked to another user")
+)
+
 type GameCredentials struct {
 	Username      string
 	ApiKey        string
@@ -121,51 +136,31 @@ func (r *ExtendedUserRepository) GetUsernameByID(userID string) (string, error)
 	return username, err
 }
 
-// UpdateRole updates a user's role (admin function)
-func (r *ExtendedUserRepository) UpdateRole(userID, role string) error {
-	_, err := r.db.Exec(
-		"UPDATE users SET role = $1, updated_at = CURRENT_TIMESTAMP WHERE id = $2",
-		role,
-		userID,
-	)
-	return err
-}
-
-// ListAll returns all users (admin function)
-func (r *ExtendedUserRepository) ListAll() ([]map[string]interface{}, error) {
-	rows, err := r.db.Query(`
-		SELECT id, username, email, role, profile_image, balance, created_at 
-		FROM users 
-		ORDER BY created_at DESC
-	`)
+// UpdateRole updates a user's role and returns the previous one (admin function),
+// recording audit in the same transaction. Returns sql.ErrNoRows if the user doesn't exist.
+func (r *ExtendedUserRepository) UpdateRole(userID, role string, audit *AuditEvent) (oldRole string, err error) {
+	tx, err := r.db.Begin()
 	if err != nil {
-		return nil, err
+		return "", err
 	}
-	defer rows.Close()
-
-	var users []map[string]interface{}
-	for rows.Next() {
-		var id, username, email, role string
-		var profileImage sql.NullString
-		var balance int
-		var createdAt string
+	defer tx.Rollback()
 
-		if err := rows.Scan(&id, &username, &email, &role, &profileImage, &balance, &createdAt); err != nil {
-			return nil, err
-		}
+	err = tx.QueryRow(`
+		UPDATE users u
+		SET role = $1, updated_at = CURRENT_TIMESTAMP
+		FROM (SELECT id, role FROM users WHERE id = $2 FOR UPDATE) old
+		WHERE u.id = old.id
+		RETURNING old.role
+	`, role, userID).Scan(&oldRole)
+	if err != nil {
+		return "", err
+	}
 
-		users = append(users, map[string]interface{}{
-			"id":            id,
-			"username":      username,
-			"email":         email,
-			"role":          role,
-			"profile_image": profileImage.String,
-			"balance":       balance,
-			"created_at":    createdAt,
-		})
+	if err := appendAuditTx(tx, audit, map[string]string{"role": oldRole}, map[string]string{"role": role}); err != nil {
+		return "", err
 	}
 
-	return users, nil
+	return oldRole, tx.Commit()
 }
 
 // GetItemByID fetches an item from the dashboard.items table
@@ -222,57 +217,6 @@ func (r *ExtendedUserRepository) GetItemContents(itemID int) ([]map[string]int,
 	return contents, rows.Err()
 }
 
-// PurchaseItem handles the entire purchase transaction atomically
-func (r *ExtendedUserRepository) PurchaseItem(userID string, itemID, quantity int) (newBalance int, err error) {
-	// Start transaction
-	tx, err := r.db.Begin()
-	if err != nil {
-		return 0, err
-	}
-	defer tx.Rollback()
-
-	// Get item price
-	var price int
-	err = tx.QueryRow(`SELECT price FROM dashboard.items WHERE id = $1`, itemID).Scan(&price)
-	if err != nil {
-		return 0, err
-	}
-
-	totalCost := price * quantity
-
-	// Check and deduct balance
-	err = tx.QueryRow(`
-		UPDATE users 
-		SET balance = balance - $1 
-		WHERE id = $2 AND balance >= $1
-		RETURNING balance
-	`, totalCost, userID).Scan(&newBalance)
-
-	if err == sql.ErrNoRows {
-		return 0, sql.ErrNoRows // Insufficient balance
-	}
-	if err != nil {
-		return 0, err
-	}
-
-	// Record purchase
-	_, err = tx.Exec(`
-		INSERT INTO dashboard.item_mall_purchases (user_id, item_id, quantity, price_paid)
-		VALUES ($1, $2, $3, $4)
-	`, userID, itemID, quantity, totalCost)
-
-	if err != nil {
-		return 0, err
-	}
-
-	// Commit transaction
-	if err = tx.Commit(); err != nil {
-		return 0, err
-	}
-
-	return newBalance, nil
-}
-
 // GetVoucherByCode fetches voucher details by code
 func (r *ExtendedUserRepository) GetVoucherByCode(code string) (map[string]interface{}, error) {
 	var id int
@@ -332,40 +276,194 @@ func (r *ExtendedUserRepository) GetVoucherContents(voucherID int) ([]map[string
 	return contents, rows.Err()
 }
 
-// IsVoucherRedeemed checks if a user has already redeemed a voucher
-func (r *ExtendedUserRepository) IsVoucherRedeemed(userID string, voucherID int) (bool, error) {
-	var count int
-	err := r.db.QueryRow(`
-		SELECT COUNT(*) 
-		FROM dashboard.voucher_redemptions 
-		WHERE user_id = $1 AND voucher_id = $2
-	`, userID, voucherID).Scan(&count)
+// VoucherRedemption is one user's redemption of a voucher. Its goods are delivered like an
+// order's: progress is saved after every good, and a delivery that stops part way is parked as
+// failed for an admin to retry.
+type VoucherRedemption struct {
+	ID             int    `json:"id"`
+	UserID         string `json:"user_id"`
+	VoucherID      int    `json:"voucher_id"`
+	Status         string `json:"status"` // one of the Order statuses except refunded
+	DeliveredCount int    `json:"delivered_count"`
+	LastError      string `json:"last_error,omitempty"`
+	RedeemedAt     string `json:"redeemed_at"`
+	UpdatedAt      string `json:"updated_at"`
+	ClaimID        string `json:"-"` // held by the delivery working on the redemption
+}
 
+const voucherRedemptionColumns = `id, user_id, voucher_id, status, delivered_count, last_error, redeemed_at, updated_at, claim_id`
+
+func scanVoucherRedemption(row interface{ Scan(...any) error }) (*VoucherRedemption, error) {
+	var v VoucherRedemption
+	var lastError, claimID sql.NullString
+	err := row.Scan(&v.ID, &v.UserID, &v.VoucherID, &v.Status, &v.DeliveredCount, &lastError, &v.RedeemedAt, &v.UpdatedAt, &claimID)
 	if err != nil {
-		return false, err
+		return nil, err
 	}
+	v.LastError = lastError.String
+	v.ClaimID = claimID.String
+	return &v, nil
+}
 
-	return count > 0, nil
+// ClaimVoucher atomically records a redemption, in the delivering state, before any goods are delivered.
+// The voucher row is locked so concurrent claims can't go over max_total_redemptions.
+// The claim is recorded as audit in the same transaction.
+// Returns ErrVoucherRedeemed or ErrVoucherExhausted if the claim is refused.
+func (r *ExtendedUserRepository) ClaimVoucher(userID string, voucherID int, audit *AuditEvent) (*VoucherRedemption, error) {
+	tx, err := r.db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	var code string
+	var maxTotalRedemptions sql.NullInt64
+	err = tx.QueryRow(`
+		SELECT code, max_total_redemptions
+		FROM dashboard.vouchers
+		WHERE id = $1
+		FOR UPDATE
+	`, voucherID).Scan(&code, &maxTotalRedemptions)
+	if err != nil {
+		return nil, err
+	}
+
+	if maxTotalRedemptions.Valid {
+		var count int
+		err = tx.QueryRow(`
+			SELECT COUNT(*)
+			FROM dashboard.voucher_redemptions
+			WHERE voucher_id = $1
+		`, voucherID).Scan(&count)
+		if err != nil {
+			return nil, err
+		}
+
+		if int64(count) >= maxTotalRedemptions.Int64 {
+			return nil, ErrVoucherExhausted
+		}
+	}
+
+	redemption, err := scanVoucherRedemption(tx.QueryRow(`
+		INSERT INTO dashboard.voucher_redemptions (user_id, voucher_id, status, claim_id)
+		VALUES ($1, $2, $3, gen_random_uuid()::TEXT)
+		ON CONFLICT (user_id, voucher_id) DO NOTHING
+		RETURNING `+voucherRedemptionColumns,
+		userID, voucherID, OrderDelivering))
+	if err == sql.ErrNoRows {
+		return nil, ErrVoucherRedeemed
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	err = appendAuditTx(tx, audit, nil, map[string]interface{}{
+		"voucher_id":    voucherID,
+		"voucher_code":  code,
+		"redemption_id": redemption.ID,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return redemption, tx.Commit()
 }
 
-// MarkVoucherRedeemed records that a user has redeemed a voucher
-func (r *ExtendedUserRepository) MarkVoucherRedeemed(userID string, voucherID int) error {
-	_, err := r.db.Exec(`
-		INSERT INTO dashboard.voucher_redemptions (user_id, voucher_id)
-		VALUES ($1, $2)
-	`, userID, voucherID)
-	return err
+// ReleaseVoucherClaim removes a redemption none of whose goods were delivered so the user can
+// try again, recording audit in the same transaction. Returns ErrRedemptionClaimLost if the
+// delivery no longer holds claimID or goods were delivered after all.
+func (r *ExtendedUserRepository) ReleaseVoucherClaim(redemption *VoucherRedemption, audit *AuditEvent) error {
+	tx, err := r.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	result, err := tx.Exec(`
+		DELETE FROM dashboard.voucher_redemptions
+		WHERE id = $1 AND claim_id = $2 AND delivered_count = 0
+	`, redemption.ID, redemption.ClaimID)
+	if err := claimedRowUpdated(result, err, ErrRedemptionClaimLost); err != nil {
+		return err
+	}
+
+	err = appendAuditTx(tx, audit, map[string]int{"voucher_id": redemption.VoucherID, "redemption_id": redemption.ID}, nil)
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
 }
 
-// GetTotalRedemptionCount returns total number of times a voucher has been redeemed
-func (r *ExtendedUserRepository) GetTotalRedemptionCount(voucherID int) (int, error) {
-	var count int
-	err := r.db.QueryRow(`
-		SELECT COUNT(*) 
-		FROM dashboard.voucher_redemptions 
-		WHERE voucher_id = $1
-	`, voucherID).Scan(&count)
-	return count, err
+// RecordVoucherDelivery stores how many of the redemption's goods have reached the game account.
+// Returns ErrRedemptionClaimLost if the delivery no longer holds claimID.
+func (r *ExtendedUserRepository) RecordVoucherDelivery(redemptionID int, claimID string, deliveredCount int) error {
+	result, err := r.db.Exec(`
+		UPDATE dashboard.voucher_redemptions
+		SET delivered_count = $1, updated_at = NOW()
+		WHERE id = $2 AND status = $3 AND claim_id = $4
+	`, deliveredCount, redemptionID, OrderDelivering, claimID)
+	return claimedRowUpdated(result, err, ErrRedemptionClaimLost)
+}
+
+// CompleteVoucherRedemption marks a fully delivered redemption completed.
+// Returns ErrRedemptionClaimLost if the delivery no longer holds claimID.
+func (r *ExtendedUserRepository) CompleteVoucherRedemption(redemptionID int, claimID string) error {
+	result, err := r.db.Exec(`
+		UPDATE dashboard.voucher_redemptions
+		SET status = $1, last_error = NULL, claim_id = NULL, updated_at = NOW()
+		WHERE id = $2 AND status = $3 AND claim_id = $4
+	`, OrderCompleted, redemptionID, OrderDelivering, claimID)
+	return claimedRowUpdated(result, err, ErrRedemptionClaimLost)
+}
+
+// FailVoucherRedemption parks a redemption that stopped part way so an admin can retry it,
+// saving deliveredCount with it like FailOrder. Returns ErrRedemptionClaimLost if the delivery
+// no longer holds claimID.
+func (r *ExtendedUserRepository) FailVoucherRedemption(redemptionID int, claimID string, deliveredCount int, reason string) error {
+	result, err := r.db.Exec(`
+		UPDATE dashboard.voucher_redemptions
+		SET status = $1, last_error = $2, delivered_count = GREATEST(delivered_count, $3), updated_at = NOW()
+		WHERE id = $4 AND status = $5 AND claim_id = $6
+	`, OrderFailed, reason, deliveredCount, redemptionID, OrderDelivering, claimID)
+	return claimedRowUpdated(result, err, ErrRedemptionClaimLost)
+}
+
+// ClaimVoucherRedemptionForRetry moves a failed (or abandoned) redemption back to delivering
+// under a new claim. Returns sql.ErrNoRows if the redemption can't be retried.
+func (r *ExtendedUserRepository) ClaimVoucherRedemptionForRetry(redemptionID int) (*VoucherRedemption, error) {
+	return scanVoucherRedemption(r.db.QueryRow(`
+		UPDATE dashboard.voucher_redemptions
+		SET status = $1, claim_id = gen_random_uuid()::TEXT, updated_at = NOW()
+		WHERE id = $2 AND `+claimableOrder+`
+		RETURNING `+voucherRedemptionColumns,
+		OrderDelivering, redemptionID))
+}
+
+// ListVoucherRedemptions returns redemptions, newest first, optionally filtered by status (admin function)
+func (r *ExtendedUserRepository) ListVoucherRedemptions(status string) ([]*VoucherRedemption, error) {
+	rows, err := r.db.Query(`
+		SELECT `+voucherRedemptionColumns+`
+		FROM dashboard.voucher_redemptions
+		WHERE $1 = '' OR status = $1
+		ORDER BY redeemed_at DESC
+		LIMIT 500
+	`, status)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	redemptions := []*VoucherRedemption{}
+	for rows.Next() {
+		v, err := scanVoucherRedemption(rows)
+		if err != nil {
+			return nil, err
+		}
+		redemptions = append(redemptions, v)
+	}
+
+	return redemptions, rows.Err()
 }
 
 // Discord Verification Methods
@@ -403,26 +501,280 @@ func (r *ExtendedUserRepository) GetDiscordVerification(token string) (*DiscordV
 	return &v, nil
 }
 
-// MarkDiscordVerificationUsed marks a token as used
-func (r *ExtendedUserRepository) MarkDiscordVerificationUsed(token, userID string) error {
-	_, err := r.db.Exec(`
+// ClaimDiscordVerification marks a token used by userID, atomically, so it can only be
+// claimed once. Returns sql.ErrNoRows if the token is unknown, used or expired.
+func (r *ExtendedUserRepository) ClaimDiscordVerification(token, userID string) (*DiscordVerification, error) {
+	var v DiscordVerification
+	err := r.db.QueryRow(`
 		UPDATE public.discord_verifications
 		SET used = true, used_at = NOW(), used_by = $1
-		WHERE token = $2
-	`, userID, token)
-	return err
+		WHERE token = $2 AND used = false AND expires_at > NOW()
+		RETURNING discord_id, discord_username, expires_at
+	`, userID, token).Scan(&v.DiscordID, &v.DiscordUsername, &v.ExpiresAt)
+	if err != nil {
+		return nil, err
+	}
+	v.Used = true
+	return &v, nil
 }
 
-// LinkDiscordAndGameAccount links both Discord and game account to a user
-func (r *ExtendedUserRepository) LinkDiscordAndGameAccount(userID string, gameAccountID int, apiKey, discordID, discordUsername string) error {
+// ReleaseDiscordVerification hands a claimed token back when linking failed, so the user can try again
+func (r *ExtendedUserRepository) ReleaseDiscordVerification(token, userID string) error {
 	_, err := r.db.Exec(`
+		UPDATE public.discord_verifications
+		SET used = false, used_at = NULL, used_by = NULL
+		WHERE token = $1 AND used_by = $2
+	`, token, userID)
+	return err
+}
+
+// LinkDiscordAndGameAccount links both Discord and game account to a user, finishes the
+// game account's provision, queues the bot notification and records audit, all in one transaction.
+// Returns ErrGameAlreadyLinked if the user got a game account in the meantime.
+func (r *ExtendedUserRepository) LinkDiscordAndGameAccount(userID string, gameAccountID int, apiKey, discordID, discordUsername string, provisionID int64, audit *AuditEvent) error {
+	tx, err := r.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	result, err := tx.Exec(`
 		UPDATE public.users
 		SET game_account_id = $1,
 		    game_api_key = $2,
 		    discord_id = $3,
 		    discord_username = $4,
 		    updated_at = CURRENT_TIMESTAMP
-		WHERE id = $5
+		WHERE id = $5 AND game_account_id IS NULL
 	`, gameAccountID, apiKey, discordID, discordUsername, userID)
-	return err
+	if isDiscordTaken(err) {
+		return ErrDiscordLinkedElsewhere
+	}
+	if err != nil {
+		return err
+	}
+	if n, _ := result.RowsAffected(); n == 0 {
+		return ErrGameAlreadyLinked
+	}
+
+	if err := checkDiscordFree(tx, discordID, userID); err != nil {
+		return err
+	}
+
+	if err := finishGameAccountProvision(tx, provisionID, gameAccountID); err != nil {
+		return err
+	}
+
+	err = enqueueOutbox(tx, OutboxDiscordLinked, DiscordLinked{
+		DiscordID:     discordID,
+		Username:      discordUsername,
+		GameAccountID: gameAccountID,
+		Timestamp:     time.Now().Unix(),
+	})
+	if err != nil {
+		return err
+	}
+
+	err = appendAuditTx(tx, audit, nil, map[string]interface{}{
+		"discord_id":       discordID,
+		"discord_username": discordUsername,
+		"game_account_id":  gameAccountID,
+	})
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// RelinkDiscord switches the Discord account of a user who already has a game account,
+// queueing bot notifications to drop the old Discord user's roles and grant the new one's,
+// and records audit in the same transaction.
+// Returns the previous Discord ID, if any, or sql.ErrNoRows if the user has no game account yet.
+func (r *ExtendedUserRepository) RelinkDiscord(userID, discordID, discordUsername string, audit *AuditEvent) (oldDiscordID string, err error) {
+	tx, err := r.db.Begin()
+	if err != nil {
+		return "", err
+	}
+	defer tx.Rollback()
+
+	var previousID, previousUsername sql.NullString
+	var gameAccountID int
+	err = tx.QueryRow(`
+		SELECT discord_id, discord_username, game_account_id
+		FROM public.users
+		WHERE id = $1 AND game_account_id IS NOT NULL
+		FOR UPDATE
+	`, userID).Scan(&previousID, &previousUsername, &gameAccountID)
+	if err != nil {
+		return "", err
+	}
+
+	if err := checkDiscordFree(tx, discordID, userID); err != nil {
+		return "", err
+	}
+
+	_, err = tx.Exec(`
+		UPDATE public.users
+		SET discord_id = $1, discord_username = $2, updated_at = CURRENT_TIMESTAMP
+		WHERE id = $3
+	`, discordID, discordUsername, userID)
+	if isDiscordTaken(err) {
+		return "", ErrDiscordLinkedElsewhere
+	}
+	if err != nil {
+		return "", err
+	}
+
+	now := time.Now().Unix()
+	if previousID.Valid && previousID.String != discordID {
+		err = enqueueOutbox(tx, OutboxDiscordUnlinked, DiscordUnlinked{
+			DiscordID:     previousID.String,
+			Username:      previousUsername.String,
+			GameAccountID: gameAccountID,
+			Timestamp:     now,
+		})
+		if err != nil {
+			return "", err
+		}
+	}
+
+	err = enqueueOutbox(tx, OutboxDiscordLinked, DiscordLinked{
+		DiscordID:     discordID,
+		Username:      discordUsername,
+		GameAccountID: gameAccountID,
+		Timestamp:     now,
+	})
+	if err != nil {
+		return "", err
+	}
+
+	err = appendAuditTx(tx, audit,
+		map[string]string{"discord_id": previousID.String},
+		map[string]string{"discord_id": discordID, "discord_username": discordUsername})
+	if err != nil {
+		return "", err
+	}
+
+	return previousID.String, tx.Commit()
+}
+
+// UnlinkDiscord removes a user's Discord account, keeping the game account, queues the bot
+// notification and records audit. Returns ErrDiscordNotLinked if there's nothing to unlink.
+func (r *ExtendedUserRepository) UnlinkDiscord(userID string, audit *AuditEvent) (discordID string, err error) {
+	tx, err := r.db.Begin()
+	if err != nil {
+		return "", err
+	}
+	defer tx.Rollback()
+
+	var discordUsername string
+	var gameAccountID sql.NullInt64
+	err = tx.QueryRow(`
+		SELECT discord_id, discord_username, game_account_id
+		FROM public.users
+		WHERE id = $1 AND discord_id IS NOT NULL
+		FOR UPDATE
+	`, userID).Scan(&discordID, &discordUsername, &gameAccountID)
+	if err == sql.ErrNoRows {
+		return "", ErrDiscordNotLinked
+	}
+	if err != nil {
+		return "", err
+	}
+
+	_, err = tx.Exec(`
+		UPDATE public.users
+		SET discord_id = NULL, discord_username = NULL, updated_at = CURRENT_TIMESTAMP
+		WHERE id = $1
+	`, userID)
+	if err != nil {
+		return "", err
+	}
+
+	err = enqueueOutbox(tx, OutboxDiscordUnlinked, DiscordUnlinked{
+		DiscordID:     discordID,
+		Username:      discordUsername,
+		GameAccountID: int(gameAccountID.Int64),
+		Timestamp:     time.Now().Unix(),
+	})
+	if err != nil {
+		return "", err
+	}
+
+	if err := appendAuditTx(tx, audit, map[string]string{"discord_id": discordID}, nil); err != nil {
+		return "", err
+	}
+
+	return discordID, tx.Commit()
+}
+
+// isDiscordTaken reports whether err is a violation of the one-user-per-Discord-account index,
+// i.e. a concurrent link of the same Discord account committed first
+func isDiscordTaken(err error) bool {
+	var pqErr *pq.Error
+	return errors.As(err, &pqErr) && pqErr.Code == "23505" && pqErr.Constraint == "idx_users_discord_id_unique"
+}
+
+// checkDiscordFree returns ErrDiscordLinkedElsewhere if another user has the Discord account.
+// It only gives the common case a clear error early; the unique index settles races.
+func checkDiscordFree(tx *sql.Tx, discordID, userID string) error {
+	var taken bool
+	err := tx.QueryRow(`
+		SELECT EXISTS (SELECT 1 FROM public.users WHERE discord_id = $1 AND id <> $2)
+	`, discordID, userID).Scan(&taken)
+	if err != nil {
+		return err
+	}
+	if taken {
+		return ErrDiscordLinkedElsewhere
+	}
+	return nil
+}
+
+// RotateGameApiKey replaces the user's game API key. The users row stays locked while
+// updateGame writes the new hash to the game database, and nothing is committed unless it succeeds.
+// Returns sql.ErrNoRows if the user has no linked game account.
+// The rotation is recorded as audit in the same transaction, after updateGame.
+// If recording or the final commit fails after updateGame succeeded, the caller gets the old key back so it can undo the game side.
+func (r *ExtendedUserRepository) RotateGameApiKey(userID, newKey string, updateGame func(gameAccountID int) error, audit *AuditEvent) (gameAccountID int, oldKey string, err error) {
+	tx, err := r.db.Begin()
+	if err != nil {
+		return 0, "", err
+	}
+	defer tx.Rollback()
+
+	err = tx.QueryRow(`
+		SELECT game_account_id, game_api_key
+		FROM users
+		WHERE id = $1 AND game_account_id IS NOT NULL AND game_api_key IS NOT NULL
+		FOR UPDATE
+	`, userID).Scan(&gameAccountID, &oldKey)
+	if err != nil {
+		return 0, "", err
+	}
+
+	_, err = tx.Exec(`
+		UPDATE users
+		SET game_api_key = $1, updated_at = CURRENT_TIMESTAMP
+		WHERE id = $2
+	`, newKey, userID)
+	if err != nil {
+		return 0, "", err
+	}
+
+	if err = updateGame(gameAccountID); err != nil {
+		return 0, "", err
+	}
+
+	// Taken after updateGame so the audit lock isn't held across the game database call
+	if err = appendAuditTx(tx, audit, nil, map[string]int{"game_account_id": gameAccountID}); err != nil {
+		return gameAccountID, oldKey, err
+	}
+
+	if err = tx.Commit(); err != nil {
+		return gameAccountID, oldKey, err
+	}
+
+	return gameAccountID, oldKey, nil
 }
@@ -0,0 +1,160 @@
+package storage
+
+import (
+	"database/sql"
+	"fmt"
+	"os"
+	"sync"
+	"testing"
+
+	_ "github.com/lib/pq"
+)
+
+// openTestDB connects to the database in TEST_DATABASE_URL, which must have schema/init.sql applied
+func openTestDB(t *testing.T) *sql.DB {
+	t.Helper()
+
+	url := os.Getenv("TEST_DATABASE_URL")
+	if url == "" {
+		t.Skip("TEST_DATABASE_URL not set")
+	}
+
+	db, err := sql.Open("postgres", url)
+	if err != nil {
+		t.Fatalf("open database: %v", err)
+	}
+	if err := db.Ping(); err != nil {
+		t.Fatalf("ping database: %v", err)
+	}
+	t.Cleanup(func() { db.Close() })
+	return db
+}
+
+func TestClaimVoucherLimitHoldsUnderConcurrency(t *testing.T) {
+	db := openTestDB(t)
+	repo := NewExtendedUserRepository(nil, db)
+
+	const workers = 20
+	prefix := fmt.Sprintf("claimtest-%d", os.Getpid())
+
+	var voucherID int
+	err := db.QueryRow(`
+		INSERT INTO dashboard.vouchers (code, description, max_total_redemptions)
+		VALUES ($1, 'concurrency test', 1)
+		RETURNING id
+	`, prefix).Scan(&voucherID)
+	if err != nil {
+		t.Fatalf("create voucher: %v", err)
+	}
+	t.Cleanup(func() {
+		db.Exec(`DELETE FROM dashboard.vouchers WHERE id = $1`, voucherID)
+		db.Exec(`DELETE FROM public.users WHERE id LIKE $1`, prefix+"%")
+	})
+
+	userIDs := make([]string, workers)
+	for i := range userIDs {
+		userIDs[i] = fmt.Sprintf("%s-%d", prefix, i)
+		_, err := db.Exec(`
+			INSERT INTO public.users (id, username, email, password)
+			VALUES ($1, $1, $1 || '@example.com', 'x')
+		`, userIDs[i])
+		if err != nil {
+			t.Fatalf("create user: %v", err)
+		}
+	}
+
+	var wg sync.WaitGroup
+	errs := make(chan error, workers)
+	start := make(chan struct{})
+	for _, userID := range userIDs {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			<-start
+			_, err := repo.ClaimVoucher(userID, voucherID, nil)
+			errs <- err
+		}()
+	}
+	close(start)
+	wg.Wait()
+	close(errs)
+
+	claimed, exhausted := 0, 0
+	for err := range errs {
+		switch err {
+		case nil:
+			claimed++
+		case ErrVoucherExhausted:
+			exhausted++
+		default:
+			t.Errorf("unexpected error: %v", err)
+		}
+	}
+
+	if claimed != 1 {
+		t.Errorf("claimed = %d, want 1", claimed)
+	}
+	if exhausted != workers-1 {
+		t.Errorf("exhausted = %d, want %d", exhausted, workers-1)
+	}
+
+	var count int
+	db.QueryRow(`SELECT COUNT(*) FROM dashboard.voucher_redemptions WHERE voucher_id = $1`, voucherID).Scan(&count)
+	if count != 1 {
+		t.Errorf("redemptions recorded = %d, want 1", count)
+	}
+}
+
+func TestClaimVoucherOncePerUser(t *testing.T) {
+	db := openTestDB(t)
+	repo := NewExtendedUserRepository(nil, db)
+
+	prefix := fmt.Sprintf("claimonce-%d", os.Getpid())
+
+	var voucherID int
+	err := db.QueryRow(`
+		INSERT INTO dashboard.vouchers (code, description)
+		VALUES ($1, 'once per user test')
+		RETURNING id
+	`, prefix).Scan(&voucherID)
+	if err != nil {
+		t.Fatalf("create voucher: %v", err)
+	}
+	t.Cleanup(func() {
+		db.Exec(`DELETE FROM dashboard.vouchers WHERE id = $1`, voucherID)
+		db.Exec(`DELETE FROM public.users WHERE id = $1`, prefix)
+	})
+
+	_, err = db.Exec(`
+		INSERT INTO public.users (id, username, email, password)
+		VALUES ($1, $1, $1 || '@example.com', 'x')
+	`, prefix)
+	if err != nil {
+		t.Fatalf("create user: %v", err)
+	}
+
+	redemption, err := repo.ClaimVoucher(prefix, voucherID, nil)
+	if err != nil {
+		t.Fatalf("first claim: %v", err)
+	}
+	if _, err := repo.ClaimVoucher(prefix, voucherID, nil); err != ErrVoucherRedeemed {
+		t.Fatalf("second claim = %v, want ErrVoucherRedeemed", err)
+	}
+
+	// A released claim can be made again
+	if err := repo.ReleaseVoucherClaim(redemption, nil); err != nil {
+		t.Fatalf("release: %v", err)
+	}
+	redemption, err = repo.ClaimVoucher(prefix, voucherID, nil)
+	if err != nil {
+		t.Fatalf("claim after release: %v", err)
+	}
+
+	// Once a good has been delivered the claim is kept
+	if err := repo.RecordVoucherDelivery(redemption.ID, redemption.ClaimID, 1); err != nil {
+		t.Fatalf("record delivery: %v", err)
+	}
+	if err := repo.ReleaseVoucherClaim(redemption, nil); err != ErrRedemptionClaimLost {
+		t.Fatalf("release after delivery = %v, want ErrRedemptionClaimLost", err)
+	}
+}
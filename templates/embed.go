@@ -0,0 +1,17 @@
+package templates
+
+import (
+	"embed"
+	"html/template"
+)
+
+//go:embed *.html
+var Pages embed.FS
+
+func Load(name string) *template.Template {
+	tmpl, err := template.ParseFS(Pages, name)
+	if err != nil {
+		panic("failed to load template: " + name)
+	}
+	return tmpl
+}